@@ -0,0 +1,378 @@
+package collector
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+const defaultCgroupPath = "/sys/fs/cgroup"
+
+// cgroups v1 reports no memory limit as a huge page aligned value
+const cgroupV1NoLimit = 1 << 62
+
+// the cgroups of docker and mesos containers and of systemd services
+var defaultCgroupRules = []string{
+	`^/docker/(?P<container_id>[0-9a-f]{64})$`,
+	`^/system\.slice/docker-(?P<container_id>[0-9a-f]{64})\.scope$`,
+	`^/mesos/(?P<mesos_container_id>[0-9a-f-]{36})$`,
+	`^/system\.slice/(?P<service>[^/]+)\.service$`,
+}
+
+// the cgroups v1 hierarchies the metrics are read from
+var cgroupV1Controllers = []string{"cpu", "cpuacct", "memory", "blkio", "pids"}
+
+// memory.stat fields by cgroups version, v1 names differ for the same pages
+var cgroupMemoryStats = map[string]map[string]string{
+	"1": {
+		"rss":         "cgroup.memory.anon",
+		"cache":       "cgroup.memory.file",
+		"shmem":       "cgroup.memory.shmem",
+		"mapped_file": "cgroup.memory.file_mapped",
+		"dirty":       "cgroup.memory.file_dirty",
+		"pgfault":     "cgroup.memory.pgfault",
+		"pgmajfault":  "cgroup.memory.pgmajfault",
+	},
+	"2": {
+		"anon":        "cgroup.memory.anon",
+		"file":        "cgroup.memory.file",
+		"shmem":       "cgroup.memory.shmem",
+		"file_mapped": "cgroup.memory.file_mapped",
+		"file_dirty":  "cgroup.memory.file_dirty",
+		"pgfault":     "cgroup.memory.pgfault",
+		"pgmajfault":  "cgroup.memory.pgmajfault",
+	},
+}
+
+// Cgroups collector type
+// Collects the CPU, memory, I/O and pids usage of the cgroups matching
+// the rules, straight from the cgroup filesystem. The named groups of
+// the first matching rule become dimensions of the cgroup's metrics.
+type Cgroups struct {
+	baseCollector
+	cgroupPath string
+	// 1, 2 or auto to use v2 when the unified hierarchy is mounted
+	version string
+	rules   []*regexp.Regexp
+}
+
+func init() {
+	RegisterCollector("Cgroups", newCgroups)
+}
+
+// newCgroups Simple constructor for Cgroups collector
+func newCgroups(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	c := new(Cgroups)
+	c.channel = channel
+	c.interval = initialInterval
+	c.log = log
+
+	c.name = "Cgroups"
+	c.cgroupPath = defaultCgroupPath
+	c.version = "auto"
+	c.rules = compileCollectorRegexps(c.log, defaultCgroupRules)
+	return c
+}
+
+// Configure Override default parameters
+func (c *Cgroups) Configure(configMap map[string]interface{}) {
+	if cgroupPath, exists := configMap["cgroupPath"]; exists {
+		c.cgroupPath = cgroupPath.(string)
+	}
+	if version, exists := configMap["version"]; exists {
+		switch version := config.GetAsInt(version, 0); version {
+		case 1, 2:
+			c.version = strconv.Itoa(version)
+		default:
+			c.version = "auto"
+		}
+	}
+	if rules, exists := configMap["rules"]; exists {
+		c.rules = compileCollectorRegexps(c.log, rules)
+	}
+	c.configureCommonParams(configMap)
+}
+
+// detectVersion returns the configured version, or the one of the
+// hierarchy mounted on cgroupPath
+func (c *Cgroups) detectVersion() string {
+	if c.version != "auto" {
+		return c.version
+	}
+	if _, err := os.Stat(filepath.Join(c.cgroupPath, "cgroup.controllers")); err == nil {
+		return "2"
+	}
+	return "1"
+}
+
+// Collect emits the metrics of the cgroups matching the rules
+func (c *Cgroups) Collect() {
+	version := c.detectVersion()
+
+	for cgroup, dimensions := range c.findCgroups(version) {
+		var metrics []metric.Metric
+		if version == "2" {
+			metrics = c.cgroupV2Metrics(cgroup)
+		} else {
+			metrics = c.cgroupV1Metrics(cgroup)
+		}
+
+		for _, m := range metrics {
+			m.AddDimension("cgroup", cgroup)
+			m.AddDimensions(dimensions)
+			c.Channel() <- m
+		}
+	}
+}
+
+// findCgroups returns the dimensions of the cgroups matching the rules,
+// by path relative to the root of the hierarchies
+func (c *Cgroups) findCgroups(version string) map[string]map[string]string {
+	roots := []string{c.cgroupPath}
+	if version == "1" {
+		roots = nil
+		for _, controller := range cgroupV1Controllers {
+			roots = append(roots, filepath.Join(c.cgroupPath, controller))
+		}
+	}
+
+	cgroups := make(map[string]map[string]string)
+	for _, root := range roots {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			cgroup := "/" + strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(path, root)), "/")
+			if _, seen := cgroups[cgroup]; seen {
+				return nil
+			}
+			if dimensions, matched := c.matchRules(cgroup); matched {
+				cgroups[cgroup] = dimensions
+			}
+			return nil
+		})
+	}
+	return cgroups
+}
+
+// matchRules returns the named groups of the first rule matching the cgroup
+func (c *Cgroups) matchRules(cgroup string) (map[string]string, bool) {
+	for _, rule := range c.rules {
+		match := rule.FindStringSubmatch(cgroup)
+		if match == nil {
+			continue
+		}
+
+		dimensions := make(map[string]string)
+		for i, name := range rule.SubexpNames() {
+			if name != "" && match[i] != "" {
+				dimensions[name] = match[i]
+			}
+		}
+		return dimensions, true
+	}
+	return nil, false
+}
+
+func (c *Cgroups) cgroupV2Metrics(cgroup string) []metric.Metric {
+	dir := filepath.Join(c.cgroupPath, cgroup)
+	var metrics []metric.Metric
+
+	cpu := readCgroupStat(filepath.Join(dir, "cpu.stat"))
+	for field, name := range map[string]string{
+		"usage_usec":     "cgroup.cpu.usage_seconds",
+		"user_usec":      "cgroup.cpu.user_seconds",
+		"system_usec":    "cgroup.cpu.system_seconds",
+		"throttled_usec": "cgroup.cpu.throttled_seconds",
+	} {
+		if value, exists := cpu[field]; exists {
+			metrics = append(metrics, cgroupCounter(name, value/1e6))
+		}
+	}
+	metrics = append(metrics, cgroupThrottling(cpu)...)
+
+	metrics = append(metrics, cgroupValues(dir, map[string]string{
+		"memory.current": "cgroup.memory.usage",
+		"memory.max":     "cgroup.memory.limit",
+		"pids.current":   "cgroup.pids.current",
+		"pids.max":       "cgroup.pids.limit",
+	})...)
+	metrics = append(metrics, cgroupMemoryStatMetrics("2", readCgroupStat(filepath.Join(dir, "memory.stat")))...)
+
+	// io.stat has a line of key=value pairs per device
+	io := make(map[string]float64)
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "io.stat")); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			for _, field := range strings.Fields(line) {
+				keyValue := strings.SplitN(field, "=", 2)
+				if len(keyValue) != 2 {
+					continue
+				}
+				if value, err := strconv.ParseFloat(keyValue[1], 64); err == nil {
+					io[keyValue[0]] += value
+				}
+			}
+		}
+	}
+	return append(metrics, cgroupIOMetrics(io["rbytes"], io["wbytes"], io["rios"], io["wios"], len(io) > 0)...)
+}
+
+func (c *Cgroups) cgroupV1Metrics(cgroup string) []metric.Metric {
+	controller := func(name string) string {
+		return filepath.Join(c.cgroupPath, name, cgroup)
+	}
+	var metrics []metric.Metric
+
+	if usage, ok := readCgroupValue(filepath.Join(controller("cpuacct"), "cpuacct.usage")); ok {
+		metrics = append(metrics, cgroupCounter("cgroup.cpu.usage_seconds", usage/1e9))
+	}
+	// cpuacct.stat is in USER_HZ, which is 100 on all architectures
+	cpuacct := readCgroupStat(filepath.Join(controller("cpuacct"), "cpuacct.stat"))
+	if user, exists := cpuacct["user"]; exists {
+		metrics = append(metrics, cgroupCounter("cgroup.cpu.user_seconds", user/100))
+	}
+	if system, exists := cpuacct["system"]; exists {
+		metrics = append(metrics, cgroupCounter("cgroup.cpu.system_seconds", system/100))
+	}
+	cpu := readCgroupStat(filepath.Join(controller("cpu"), "cpu.stat"))
+	if throttled, exists := cpu["throttled_time"]; exists {
+		metrics = append(metrics, cgroupCounter("cgroup.cpu.throttled_seconds", throttled/1e9))
+	}
+	metrics = append(metrics, cgroupThrottling(cpu)...)
+
+	metrics = append(metrics, cgroupValues(controller("memory"), map[string]string{
+		"memory.usage_in_bytes": "cgroup.memory.usage",
+	})...)
+	if limit, ok := readCgroupValue(filepath.Join(controller("memory"), "memory.limit_in_bytes")); ok && limit < cgroupV1NoLimit {
+		metrics = append(metrics, metric.WithValue("cgroup.memory.limit", limit))
+	}
+	metrics = append(metrics, cgroupMemoryStatMetrics("1", readCgroupStat(filepath.Join(controller("memory"), "memory.stat")))...)
+	metrics = append(metrics, cgroupValues(controller("pids"), map[string]string{
+		"pids.current": "cgroup.pids.current",
+		"pids.max":     "cgroup.pids.limit",
+	})...)
+
+	bytes, bytesFound := readBlkioStat(filepath.Join(controller("blkio"), "blkio.throttle.io_service_bytes"))
+	ios, iosFound := readBlkioStat(filepath.Join(controller("blkio"), "blkio.throttle.io_serviced"))
+	return append(metrics, cgroupIOMetrics(bytes["Read"], bytes["Write"], ios["Read"], ios["Write"], bytesFound && iosFound)...)
+}
+
+func cgroupCounter(name string, value float64) metric.Metric {
+	m := metric.WithValue(name, value)
+	m.MetricType = metric.CumulativeCounter
+	return m
+}
+
+func cgroupThrottling(cpu map[string]float64) []metric.Metric {
+	var metrics []metric.Metric
+	if periods, exists := cpu["nr_periods"]; exists {
+		metrics = append(metrics, cgroupCounter("cgroup.cpu.periods", periods))
+	}
+	if throttled, exists := cpu["nr_throttled"]; exists {
+		metrics = append(metrics, cgroupCounter("cgroup.cpu.throttled_periods", throttled))
+	}
+	return metrics
+}
+
+// cgroupValues returns gauges of the single value files of a cgroup
+func cgroupValues(dir string, files map[string]string) []metric.Metric {
+	var metrics []metric.Metric
+	for file, name := range files {
+		if value, ok := readCgroupValue(filepath.Join(dir, file)); ok {
+			metrics = append(metrics, metric.WithValue(name, value))
+		}
+	}
+	return metrics
+}
+
+func cgroupMemoryStatMetrics(version string, stat map[string]float64) []metric.Metric {
+	var metrics []metric.Metric
+	for field, name := range cgroupMemoryStats[version] {
+		value, exists := stat[field]
+		if !exists {
+			continue
+		}
+		if strings.HasPrefix(field, "pg") {
+			metrics = append(metrics, cgroupCounter(name, value))
+		} else {
+			metrics = append(metrics, metric.WithValue(name, value))
+		}
+	}
+	return metrics
+}
+
+func cgroupIOMetrics(readBytes, writeBytes, reads, writes float64, found bool) []metric.Metric {
+	if !found {
+		return nil
+	}
+	return []metric.Metric{
+		cgroupCounter("cgroup.io.read_bytes", readBytes),
+		cgroupCounter("cgroup.io.write_bytes", writeBytes),
+		cgroupCounter("cgroup.io.reads", reads),
+		cgroupCounter("cgroup.io.writes", writes),
+	}
+}
+
+// readCgroupValue reads a single value file, limits set to max are not values
+func readCgroupValue(path string) (float64, bool) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(string(content)), 64)
+	return value, err == nil
+}
+
+// readCgroupStat reads the "key value" lines of files such as cpu.stat
+func readCgroupStat(path string) map[string]float64 {
+	stat := make(map[string]float64)
+	file, err := os.Open(path)
+	if err != nil {
+		return stat
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			stat[fields[0]] = value
+		}
+	}
+	return stat
+}
+
+// readBlkioStat sums the "major:minor operation value" lines of the
+// blkio files by operation
+func readBlkioStat(path string) (map[string]float64, bool) {
+	stat := make(map[string]float64)
+	file, err := os.Open(path)
+	if err != nil {
+		return stat, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		if value, err := strconv.ParseFloat(fields[2], 64); err == nil {
+			stat[fields[1]] += value
+		}
+	}
+	return stat, true
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"fullerite/metric"
+	"fullerite/test_utils"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCgroupContainerID = "4f1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8"
+
+func getTestCgroups(version string, configMap map[string]interface{}) *Cgroups {
+	configMap["cgroupPath"] = testFixture("cgroup/v" + version)
+	return newTestCollector(newCgroups, configMap).(*Cgroups)
+}
+
+func TestCgroupsConfigure(t *testing.T) {
+	c := newCgroups(make(chan metric.Metric), 10, test_utils.BuildLogger()).(*Cgroups)
+	assert.Equal(t, "/sys/fs/cgroup", c.cgroupPath)
+	assert.Equal(t, "auto", c.version)
+	assert.Equal(t, len(defaultCgroupRules), len(c.rules))
+
+	c.Configure(map[string]interface{}{
+		"cgroupPath": "/host/sys/fs/cgroup",
+		"version":    "1",
+		"rules":      []interface{}{`^/kubepods/(?P<pod>[^/]+)$`, "(", 1},
+	})
+	assert.Equal(t, "/host/sys/fs/cgroup", c.cgroupPath)
+	assert.Equal(t, "1", c.version)
+	assert.Equal(t, 1, len(c.rules))
+}
+
+func TestCgroupsDetectVersion(t *testing.T) {
+	assert.Equal(t, "2", getTestCgroups("2", map[string]interface{}{}).detectVersion())
+	assert.Equal(t, "1", getTestCgroups("1", map[string]interface{}{}).detectVersion())
+	assert.Equal(t, "1", getTestCgroups("2", map[string]interface{}{"version": 1}).detectVersion())
+}
+
+func TestCgroupsFindCgroups(t *testing.T) {
+	c := getTestCgroups("2", map[string]interface{}{
+		"rules": []interface{}{`^/user\.slice/user-(?P<uid>[0-9]+)\.slice$`, `^/system\.slice/[^/]+$`},
+	})
+
+	assert.Equal(t, map[string]map[string]string{
+		"/user.slice/user-1000.slice": {"uid": "1000"},
+		"/system.slice/nginx.service": {},
+	}, c.findCgroups("2"))
+}
+
+func TestCgroupsCollectV2(t *testing.T) {
+	collected := metricsByName(collectAll(t, getTestCgroups("2", map[string]interface{}{})))
+
+	assert.Equal(t, 20, len(collected))
+	for _, m := range collected {
+		assert.Equal(t, "/system.slice/nginx.service", m.Dimensions["cgroup"])
+		assert.Equal(t, "nginx", m.Dimensions["service"])
+	}
+
+	assert.Equal(t, 2.5, collected["cgroup.cpu.usage_seconds"].Value)
+	assert.Equal(t, metric.CumulativeCounter, collected["cgroup.cpu.usage_seconds"].MetricType)
+	assert.Equal(t, 0.35, collected["cgroup.cpu.throttled_seconds"].Value)
+	assert.Equal(t, 7.0, collected["cgroup.cpu.throttled_periods"].Value)
+	assert.Equal(t, 104857600.0, collected["cgroup.memory.usage"].Value)
+	assert.Equal(t, 536870912.0, collected["cgroup.memory.limit"].Value)
+	assert.Equal(t, 52428800.0, collected["cgroup.memory.anon"].Value)
+	assert.Equal(t, metric.CumulativeCounter, collected["cgroup.memory.pgmajfault"].MetricType)
+	assert.Equal(t, 2097152.0, collected["cgroup.io.read_bytes"].Value)
+	assert.Equal(t, 150.0, collected["cgroup.io.reads"].Value)
+	assert.Equal(t, 12.0, collected["cgroup.pids.current"].Value)
+
+	// pids.max is max
+	_, exists := collected["cgroup.pids.limit"]
+	assert.False(t, exists)
+}
+
+func TestCgroupsCollectV1(t *testing.T) {
+	collected := metricsByName(collectAll(t, getTestCgroups("1", map[string]interface{}{})))
+
+	assert.Equal(t, 20, len(collected))
+	for _, m := range collected {
+		assert.Equal(t, "/docker/"+testCgroupContainerID, m.Dimensions["cgroup"])
+		assert.Equal(t, testCgroupContainerID, m.Dimensions["container_id"])
+	}
+
+	assert.Equal(t, 4.0, collected["cgroup.cpu.usage_seconds"].Value)
+	assert.Equal(t, 3.0, collected["cgroup.cpu.user_seconds"].Value)
+	assert.Equal(t, 0.25, collected["cgroup.cpu.throttled_seconds"].Value)
+	assert.Equal(t, 209715200.0, collected["cgroup.memory.usage"].Value)
+	assert.Equal(t, 52428800.0, collected["cgroup.memory.anon"].Value)
+	assert.Equal(t, 41943040.0, collected["cgroup.memory.file"].Value)
+	assert.Equal(t, 8192.0, collected["cgroup.io.write_bytes"].Value)
+	assert.Equal(t, 1.0, collected["cgroup.io.reads"].Value)
+	assert.Equal(t, 100.0, collected["cgroup.pids.limit"].Value)
+
+	// the memory limit is unset
+	_, exists := collected["cgroup.memory.limit"]
+	assert.False(t, exists)
+}
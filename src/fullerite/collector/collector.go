@@ -3,7 +3,9 @@ package collector
 import (
 	"fullerite/config"
 	"fullerite/metric"
+	"fullerite/util"
 
+	"net/http"
 	"regexp"
 	"strings"
 
@@ -13,6 +15,9 @@ import (
 const (
 	// DefaultCollectionInterval the interval to collect on unless overridden by a collectors config
 	DefaultCollectionInterval = 10
+
+	// where the system collectors read from unless their procPath is set
+	defaultSystemProcPath = "/proc"
 )
 
 var defaultLog = l.WithFields(l.Fields{"app": "fullerite", "pkg": "collector"})
@@ -86,6 +91,10 @@ type baseCollector struct {
 	blacklist           []string
 	dimensionsBlacklist map[string]string
 
+	// set when tls or proxy settings are configured,
+	// http.DefaultTransport is used otherwise
+	transport http.RoundTripper
+
 	// intentionally exported
 	log *l.Entry
 }
@@ -108,6 +117,59 @@ func (col *baseCollector) configureCommonParams(configMap map[string]interface{}
 	if asInterface, exists := configMap["dimensions_blacklist"]; exists {
 		col.dimensionsBlacklist = config.GetAsMap(asInterface)
 	}
+
+	col.configureTransport(configMap)
+}
+
+// configureTransport builds the transport of HTTP collectors
+// from the same tls and proxy settings handlers accept
+func (col *baseCollector) configureTransport(configMap map[string]interface{}) {
+	tlsSettings, hasTLS := configMap["tls"]
+	proxySetting, hasProxy := configMap["proxy"]
+	if !hasTLS && !hasProxy {
+		return
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if hasTLS {
+		tlsConfig, err := util.ParseTLSSettings(tlsSettings).Config()
+		if err != nil {
+			// never fall back to plaintext or drop the client certificate
+			col.log.Error("Invalid tls settings, requests are disabled: ", err)
+			col.transport = failingTransport{err}
+			return
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if hasProxy {
+		proxy, err := util.ParseProxy(proxySetting)
+		if err != nil {
+			// never bypass the proxy
+			col.log.Error("Invalid proxy ", proxySetting, ", requests are disabled: ", err)
+			col.transport = failingTransport{err}
+			return
+		}
+		transport.Proxy = proxy
+	}
+	col.transport = transport
+}
+
+// failingTransport fails every request, it replaces transports
+// whose settings are invalid
+type failingTransport struct {
+	err error
+}
+
+func (t failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// httpTransport returns the transport HTTP collectors make requests with
+func (col *baseCollector) httpTransport() http.RoundTripper {
+	if col.transport == nil {
+		return http.DefaultTransport
+	}
+	return col.transport
 }
 
 // SetInterval : set the interval to collect on
@@ -198,3 +260,91 @@ func (col *baseCollector) ContainsBlacklistedDimension(dimensions map[string]str
 	}
 	return false
 }
+
+// compileCollectorRegexp compiles a configured pattern, or a list of
+// patterns matching any of them, keeping the current one when it is invalid
+func compileCollectorRegexp(log *l.Entry, pattern interface{}, current *regexp.Regexp) *regexp.Regexp {
+	var expression string
+	switch value := pattern.(type) {
+	case string:
+		expression = value
+	case []string:
+		expression = joinCollectorRegexps(value)
+	case []interface{}:
+		patterns := make([]string, 0, len(value))
+		for _, item := range value {
+			asString, ok := item.(string)
+			if !ok {
+				log.Warn("Ignoring the regex list ", pattern, ": ", item, " is not a string")
+				return current
+			}
+			patterns = append(patterns, asString)
+		}
+		expression = joinCollectorRegexps(patterns)
+	default:
+		log.Warn("Ignoring the regex ", pattern, ": expected a string or a list of strings")
+		return current
+	}
+
+	re, err := regexp.Compile(expression)
+	if err != nil {
+		log.Warn("Failed to compile regex: ", pattern, err)
+		return current
+	}
+	return re
+}
+
+// compileCollectorRegexps compiles a configured list of patterns,
+// skipping the entries that are not strings or not valid
+func compileCollectorRegexps(log *l.Entry, patterns interface{}) []*regexp.Regexp {
+	var items []interface{}
+	switch value := patterns.(type) {
+	case string:
+		for _, pattern := range config.GetAsSlice(value) {
+			items = append(items, pattern)
+		}
+	case []string:
+		for _, pattern := range value {
+			items = append(items, pattern)
+		}
+	case []interface{}:
+		items = value
+	default:
+		log.Warn("Ignoring the regex list ", patterns, ": expected a list of strings")
+		return nil
+	}
+
+	compiled := make([]*regexp.Regexp, 0, len(items))
+	for _, item := range items {
+		pattern, ok := item.(string)
+		if !ok {
+			log.Warn("Ignoring the regex ", item, ": not a string")
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Warn("Failed to compile regex: ", pattern, err)
+			continue
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled
+}
+
+// joinCollectorRegexps matches any of the patterns
+func joinCollectorRegexps(patterns []string) string {
+	grouped := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		grouped[i] = "(?:" + pattern + ")"
+	}
+	return strings.Join(grouped, "|")
+}
+
+// matchesFilters returns true if the value matches the include
+// pattern, when there is one, and not the exclude pattern
+func matchesFilters(value string, include, exclude *regexp.Regexp) bool {
+	if include != nil && !include.MatchString(value) {
+		return false
+	}
+	return exclude == nil || !exclude.MatchString(value)
+}
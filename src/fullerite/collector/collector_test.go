@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"fullerite/metric"
+	"fullerite/test_utils"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -69,3 +70,26 @@ func TestDimensionsBlacklistNotSet(t *testing.T) {
 	result := col.ContainsBlacklistedDimension(m.Dimensions)
 	assert.False(t, result)
 }
+
+func TestCompileCollectorRegexp(t *testing.T) {
+	log := test_utils.BuildLogger()
+	current := compileCollectorRegexp(log, "^sd", nil)
+	assert.True(t, current.MatchString("sda"))
+
+	listed := compileCollectorRegexp(log, []interface{}{"^sd", "^nvme"}, current)
+	assert.True(t, listed.MatchString("nvme0n1"))
+	assert.True(t, listed.MatchString("sda"))
+	assert.False(t, listed.MatchString("loop0"))
+
+	assert.Equal(t, current, compileCollectorRegexp(log, []interface{}{"^sd", 1}, current))
+	assert.Equal(t, current, compileCollectorRegexp(log, 1, current))
+	assert.Equal(t, current, compileCollectorRegexp(log, "(", current))
+}
+
+func TestCompileCollectorRegexps(t *testing.T) {
+	log := test_utils.BuildLogger()
+	assert.Equal(t, 2, len(compileCollectorRegexps(log, []interface{}{"^a", 1, "(", "^b"})))
+	assert.Equal(t, 1, len(compileCollectorRegexps(log, []string{"^a"})))
+	assert.Equal(t, 2, len(compileCollectorRegexps(log, `["^a", "^b"]`)))
+	assert.Equal(t, 0, len(compileCollectorRegexps(log, 1)))
+}
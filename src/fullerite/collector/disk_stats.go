@@ -0,0 +1,168 @@
+package collector
+
+import (
+	"fullerite/metric"
+
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// only whole disks are kept by default, partitions and loop devices are skipped
+const defaultDiskStatsDevices = `^(sd[a-z]+|hd[a-z]+|vd[a-z]+|xvd[a-z]+|nvme[0-9]+n[0-9]+|dm-[0-9]+|md[0-9]+)$`
+
+// sectors of /proc/diskstats are always 512 bytes
+const diskSectorSize = 512
+
+// diskStat holds the /proc/diskstats counters we care about
+type diskStat struct {
+	reads          float64
+	sectorsRead    float64
+	msReading      float64
+	writes         float64
+	sectorsWritten float64
+	msWriting      float64
+	inProgress     float64
+	msDoingIO      float64
+}
+
+// DiskStats collector type
+// Collects the IOPS, throughput, await and utilisation of block devices
+// over the time elapsed since the previous collection
+type DiskStats struct {
+	baseCollector
+	procPath       string
+	devices        *regexp.Regexp
+	excludeDevices *regexp.Regexp
+
+	previous     map[string]diskStat
+	previousTime time.Time
+}
+
+func init() {
+	RegisterCollector("DiskStats", newDiskStats)
+}
+
+// newDiskStats Simple constructor for DiskStats collector
+func newDiskStats(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	c := new(DiskStats)
+	c.channel = channel
+	c.interval = initialInterval
+	c.log = log
+
+	c.name = "DiskStats"
+	c.procPath = defaultSystemProcPath
+	c.devices = regexp.MustCompile(defaultDiskStatsDevices)
+	c.previous = make(map[string]diskStat)
+	return c
+}
+
+// Configure Override default parameters
+func (c *DiskStats) Configure(configMap map[string]interface{}) {
+	if procPath, exists := configMap["procPath"]; exists {
+		c.procPath = procPath.(string)
+	}
+	if devices, exists := configMap["devices"]; exists {
+		c.devices = compileCollectorRegexp(c.log, devices, c.devices)
+	}
+	if excludeDevices, exists := configMap["excludeDevices"]; exists {
+		c.excludeDevices = compileCollectorRegexp(c.log, excludeDevices, c.excludeDevices)
+	}
+	c.configureCommonParams(configMap)
+}
+
+// Collect emits the metrics of the devices matching the filters
+func (c *DiskStats) Collect() {
+	stats, err := c.readDiskStats()
+	if err != nil {
+		c.log.Error("Unable to read diskstats: ", err)
+		return
+	}
+
+	for _, m := range c.diskStatsMetrics(stats, time.Now()) {
+		c.Channel() <- m
+	}
+}
+
+func (c *DiskStats) readDiskStats() (map[string]diskStat, error) {
+	file, err := os.Open(filepath.Join(c.procPath, "diskstats"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stats := make(map[string]diskStat)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 || !matchesFilters(fields[2], c.devices, c.excludeDevices) {
+			continue
+		}
+
+		values := make([]float64, 11)
+		for i := range values {
+			values[i], _ = strconv.ParseFloat(fields[i+3], 64)
+		}
+		stats[fields[2]] = diskStat{
+			reads:          values[0],
+			sectorsRead:    values[2],
+			msReading:      values[3],
+			writes:         values[4],
+			sectorsWritten: values[6],
+			msWriting:      values[7],
+			inProgress:     values[8],
+			msDoingIO:      values[9],
+		}
+	}
+	return stats, scanner.Err()
+}
+
+// diskStatsMetrics returns the rates of the devices seen at the
+// previous collection, and the I/Os in progress of all of them
+func (c *DiskStats) diskStatsMetrics(stats map[string]diskStat, now time.Time) []metric.Metric {
+	elapsed := now.Sub(c.previousTime).Seconds()
+	previousStats := c.previous
+	c.previous = stats
+	c.previousTime = now
+
+	var metrics []metric.Metric
+	for device, stat := range stats {
+		values := map[string]float64{"disk.io_in_progress": stat.inProgress}
+
+		previous, seen := previousStats[device]
+		if seen && elapsed > 0 && stat.reads >= previous.reads && stat.writes >= previous.writes {
+			reads := stat.reads - previous.reads
+			writes := stat.writes - previous.writes
+
+			values["disk.reads_per_second"] = reads / elapsed
+			values["disk.writes_per_second"] = writes / elapsed
+			values["disk.read_bytes_per_second"] = (stat.sectorsRead - previous.sectorsRead) * diskSectorSize / elapsed
+			values["disk.write_bytes_per_second"] = (stat.sectorsWritten - previous.sectorsWritten) * diskSectorSize / elapsed
+			values["disk.util_percentage"] = (stat.msDoingIO - previous.msDoingIO) / (elapsed * 10)
+			values["disk.read_await"] = diskAwait(stat.msReading-previous.msReading, reads)
+			values["disk.write_await"] = diskAwait(stat.msWriting-previous.msWriting, writes)
+			values["disk.await"] = diskAwait(stat.msReading+stat.msWriting-previous.msReading-previous.msWriting, reads+writes)
+		}
+
+		for name, value := range values {
+			m := metric.WithValue(name, value)
+			m.AddDimension("device", device)
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics
+}
+
+// diskAwait returns the time spent per I/O, 0 when there was none
+func diskAwait(total, count float64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return total / count
+}
@@ -0,0 +1,56 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskStatsReadDevices(t *testing.T) {
+	stats, err := newTestCollector(newDiskStats, map[string]interface{}{}).(*DiskStats).readDiskStats()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(stats))
+	assert.Equal(t, 10000.0, stats["sda"].reads)
+	assert.Equal(t, 400000.0, stats["sda"].sectorsWritten)
+	assert.Equal(t, 2.0, stats["sda"].inProgress)
+
+	stats, err = newTestCollector(newDiskStats, map[string]interface{}{
+		"devices":        "^(sd|dm-)",
+		"excludeDevices": "^dm-",
+	}).(*DiskStats).readDiskStats()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(stats))
+	_, exists := stats["sda1"]
+	assert.True(t, exists)
+}
+
+func TestDiskStatsMetrics(t *testing.T) {
+	c := newTestCollector(newDiskStats, map[string]interface{}{}).(*DiskStats)
+	now := time.Now()
+
+	first := map[string]diskStat{"sda": {reads: 100, sectorsRead: 1000, msReading: 100, writes: 50, msWriting: 100, msDoingIO: 1000}}
+	second := map[string]diskStat{"sda": {reads: 300, sectorsRead: 3000, msReading: 500, writes: 150, msWriting: 400, msDoingIO: 6000, inProgress: 3}}
+
+	metrics := c.diskStatsMetrics(first, now)
+	assert.Equal(t, 1, len(metrics))
+	assert.Equal(t, "disk.io_in_progress", metrics[0].Name)
+
+	values := make(map[string]float64)
+	for _, m := range c.diskStatsMetrics(second, now.Add(10*time.Second)) {
+		assert.Equal(t, "sda", m.Dimensions["device"])
+		values[m.Name] = m.Value
+	}
+
+	assert.Equal(t, map[string]float64{
+		"disk.io_in_progress":         3,
+		"disk.reads_per_second":       20,
+		"disk.writes_per_second":      10,
+		"disk.read_bytes_per_second":  2000 * 512 / 10,
+		"disk.write_bytes_per_second": 0,
+		"disk.util_percentage":        50,
+		"disk.read_await":             2,
+		"disk.write_await":            3,
+		"disk.await":                  700.0 / 300,
+	}, values)
+}
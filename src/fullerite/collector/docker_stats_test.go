@@ -112,14 +112,14 @@ func TestDockerStatsBuildMetrics(t *testing.T) {
 		"instance_name": "main",
 	}
 	expectedMetrics := []metric.Metric{
-		metric.Metric{"DockerMemoryUsed", "gauge", 50, baseDims},
-		metric.Metric{"DockerMemoryLimit", "gauge", 70, baseDims},
-		metric.Metric{"DockerCpuPercentage", "gauge", 0.5, baseDims},
-		metric.Metric{"DockerCpuThrottledPeriods", "cumcounter", 123, baseDims},
-		metric.Metric{"DockerCpuThrottledNanoseconds", "cumcounter", 456, baseDims},
-		metric.Metric{"DockerTxBytes", "cumcounter", 20, netDims},
-		metric.Metric{"DockerRxBytes", "cumcounter", 10, netDims},
-		metric.Metric{"DockerContainerCount", "counter", 1, expectedDimsGen},
+		metric.Metric{Name: "DockerMemoryUsed", MetricType: "gauge", Value: 50, Dimensions: baseDims},
+		metric.Metric{Name: "DockerMemoryLimit", MetricType: "gauge", Value: 70, Dimensions: baseDims},
+		metric.Metric{Name: "DockerCpuPercentage", MetricType: "gauge", Value: 0.5, Dimensions: baseDims},
+		metric.Metric{Name: "DockerCpuThrottledPeriods", MetricType: "cumcounter", Value: 123, Dimensions: baseDims},
+		metric.Metric{Name: "DockerCpuThrottledNanoseconds", MetricType: "cumcounter", Value: 456, Dimensions: baseDims},
+		metric.Metric{Name: "DockerTxBytes", MetricType: "cumcounter", Value: 20, Dimensions: netDims},
+		metric.Metric{Name: "DockerRxBytes", MetricType: "cumcounter", Value: 10, Dimensions: netDims},
+		metric.Metric{Name: "DockerContainerCount", MetricType: "counter", Value: 1, Dimensions: expectedDimsGen},
 	}
 
 	d := getSUT()
@@ -184,14 +184,14 @@ func TestDockerStatsBuildwithEmitImageName(t *testing.T) {
 		"instance_name": "main",
 	}
 	expectedMetrics := []metric.Metric{
-		metric.Metric{"DockerMemoryUsed", "gauge", 50, baseDims},
-		metric.Metric{"DockerMemoryLimit", "gauge", 70, baseDims},
-		metric.Metric{"DockerCpuPercentage", "gauge", 0.5, baseDims},
-		metric.Metric{"DockerCpuThrottledPeriods", "cumcounter", 123, baseDims},
-		metric.Metric{"DockerCpuThrottledNanoseconds", "cumcounter", 456, baseDims},
-		metric.Metric{"DockerTxBytes", "cumcounter", 20, netDims},
-		metric.Metric{"DockerRxBytes", "cumcounter", 10, netDims},
-		metric.Metric{"DockerContainerCount", "counter", 1, expectedDimsGen},
+		metric.Metric{Name: "DockerMemoryUsed", MetricType: "gauge", Value: 50, Dimensions: baseDims},
+		metric.Metric{Name: "DockerMemoryLimit", MetricType: "gauge", Value: 70, Dimensions: baseDims},
+		metric.Metric{Name: "DockerCpuPercentage", MetricType: "gauge", Value: 0.5, Dimensions: baseDims},
+		metric.Metric{Name: "DockerCpuThrottledPeriods", MetricType: "cumcounter", Value: 123, Dimensions: baseDims},
+		metric.Metric{Name: "DockerCpuThrottledNanoseconds", MetricType: "cumcounter", Value: 456, Dimensions: baseDims},
+		metric.Metric{Name: "DockerTxBytes", MetricType: "cumcounter", Value: 20, Dimensions: netDims},
+		metric.Metric{Name: "DockerRxBytes", MetricType: "cumcounter", Value: 10, Dimensions: netDims},
+		metric.Metric{Name: "DockerContainerCount", MetricType: "counter", Value: 1, Dimensions: expectedDimsGen},
 	}
 
 	d := getSUT()
@@ -245,12 +245,12 @@ func TestDockerStatsBuildMetricsWithNameAsEnvVariable(t *testing.T) {
 	}
 
 	expectedMetrics := []metric.Metric{
-		metric.Metric{"DockerMemoryUsed", "gauge", 50, expectedDims},
-		metric.Metric{"DockerMemoryLimit", "gauge", 70, expectedDims},
-		metric.Metric{"DockerCpuPercentage", "gauge", 0.5, expectedDims},
-		metric.Metric{"DockerCpuThrottledPeriods", "cumcounter", 123, expectedDims},
-		metric.Metric{"DockerCpuThrottledNanoseconds", "cumcounter", 456, expectedDims},
-		metric.Metric{"DockerContainerCount", "counter", 1, expectedDimsGen},
+		metric.Metric{Name: "DockerMemoryUsed", MetricType: "gauge", Value: 50, Dimensions: expectedDims},
+		metric.Metric{Name: "DockerMemoryLimit", MetricType: "gauge", Value: 70, Dimensions: expectedDims},
+		metric.Metric{Name: "DockerCpuPercentage", MetricType: "gauge", Value: 0.5, Dimensions: expectedDims},
+		metric.Metric{Name: "DockerCpuThrottledPeriods", MetricType: "cumcounter", Value: 123, Dimensions: expectedDims},
+		metric.Metric{Name: "DockerCpuThrottledNanoseconds", MetricType: "cumcounter", Value: 456, Dimensions: expectedDims},
+		metric.Metric{Name: "DockerContainerCount", MetricType: "counter", Value: 1, Dimensions: expectedDimsGen},
 	}
 
 	d := getSUT()
@@ -0,0 +1,192 @@
+package collector
+
+import (
+	"fullerite/metric"
+
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// pseudo filesystems and the kernel's mountpoints are skipped by default
+const (
+	defaultFilesystemExcludeFstypes     = `^(autofs|binfmt_misc|bpf|cgroup2?|configfs|debugfs|devpts|devtmpfs|fusectl|hugetlbfs|mqueue|nsfs|overlay|proc|pstore|rpc_pipefs|securityfs|selinuxfs|squashfs|sysfs|tmpfs|tracefs)$`
+	defaultFilesystemExcludeMountpoints = `^/(dev|proc|run|sys)($|/)`
+)
+
+// filesystemUsage is what statfs tells about a mounted filesystem
+type filesystemUsage struct {
+	bytesTotal  float64
+	bytesFree   float64
+	bytesAvail  float64
+	inodesTotal float64
+	inodesFree  float64
+}
+
+type mount struct {
+	device     string
+	mountpoint string
+	fstype     string
+}
+
+// Filesystem collector type
+// Collects the bytes and inodes used and free of mounted filesystems.
+// In a container, procPath and rootPath point to the host's /proc and /
+// so that the host's filesystems are the ones stat'ed
+type Filesystem struct {
+	baseCollector
+	procPath           string
+	rootPath           string
+	fstypes            *regexp.Regexp
+	excludeFstypes     *regexp.Regexp
+	mountpoints        *regexp.Regexp
+	excludeMountpoints *regexp.Regexp
+}
+
+func init() {
+	RegisterCollector("Filesystem", newFilesystem)
+}
+
+// newFilesystem Simple constructor for Filesystem collector
+func newFilesystem(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	c := new(Filesystem)
+	c.channel = channel
+	c.interval = initialInterval
+	c.log = log
+
+	c.name = "Filesystem"
+	c.procPath = defaultSystemProcPath
+	c.rootPath = "/"
+	c.excludeFstypes = regexp.MustCompile(defaultFilesystemExcludeFstypes)
+	c.excludeMountpoints = regexp.MustCompile(defaultFilesystemExcludeMountpoints)
+	return c
+}
+
+// Configure Override default parameters
+func (c *Filesystem) Configure(configMap map[string]interface{}) {
+	if procPath, exists := configMap["procPath"]; exists {
+		c.procPath = procPath.(string)
+	}
+	if rootPath, exists := configMap["rootPath"]; exists {
+		c.rootPath = rootPath.(string)
+	}
+	if fstypes, exists := configMap["fstypes"]; exists {
+		c.fstypes = compileCollectorRegexp(c.log, fstypes, c.fstypes)
+	}
+	if excludeFstypes, exists := configMap["excludeFstypes"]; exists {
+		c.excludeFstypes = compileCollectorRegexp(c.log, excludeFstypes, c.excludeFstypes)
+	}
+	if mountpoints, exists := configMap["mountpoints"]; exists {
+		c.mountpoints = compileCollectorRegexp(c.log, mountpoints, c.mountpoints)
+	}
+	if excludeMountpoints, exists := configMap["excludeMountpoints"]; exists {
+		c.excludeMountpoints = compileCollectorRegexp(c.log, excludeMountpoints, c.excludeMountpoints)
+	}
+	c.configureCommonParams(configMap)
+}
+
+// Collect emits the usage of the mounted filesystems matching the filters
+func (c *Filesystem) Collect() {
+	mounts, err := c.readMounts()
+	if err != nil {
+		c.log.Error("Unable to read mounts: ", err)
+		return
+	}
+
+	for _, mount := range mounts {
+		usage, err := statfs(c.statPath(mount.mountpoint))
+		if err != nil {
+			c.log.Warn("Unable to stat ", c.statPath(mount.mountpoint), ": ", err)
+			continue
+		}
+		for _, m := range filesystemMetrics(mount, usage) {
+			c.Channel() <- m
+		}
+	}
+}
+
+// statPath returns where the mountpoint is seen from under rootPath
+func (c *Filesystem) statPath(mountpoint string) string {
+	return filepath.Join(c.rootPath, mountpoint)
+}
+
+// readMounts returns the filesystems matching the filters,
+// once per mountpoint
+func (c *Filesystem) readMounts() ([]mount, error) {
+	file, err := os.Open(filepath.Join(c.procPath, "mounts"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []mount
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		m := mount{
+			device:     unescapeMountField(fields[0]),
+			mountpoint: unescapeMountField(fields[1]),
+			fstype:     fields[2],
+		}
+		if seen[m.mountpoint] ||
+			!matchesFilters(m.fstype, c.fstypes, c.excludeFstypes) ||
+			!matchesFilters(m.mountpoint, c.mountpoints, c.excludeMountpoints) {
+			continue
+		}
+		seen[m.mountpoint] = true
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountField decodes the octal escapes of spaces,
+// tabs and backslashes in /proc/mounts
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+
+	var unescaped bytes.Buffer
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if code, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(field[i])
+	}
+	return unescaped.String()
+}
+
+func filesystemMetrics(mount mount, usage filesystemUsage) []metric.Metric {
+	values := map[string]float64{
+		"filesystem.bytes_total":  usage.bytesTotal,
+		"filesystem.bytes_used":   usage.bytesTotal - usage.bytesFree,
+		"filesystem.bytes_free":   usage.bytesAvail,
+		"filesystem.inodes_total": usage.inodesTotal,
+		"filesystem.inodes_used":  usage.inodesTotal - usage.inodesFree,
+		"filesystem.inodes_free":  usage.inodesFree,
+	}
+
+	metrics := make([]metric.Metric, 0, len(values))
+	for name, value := range values {
+		m := metric.WithValue(name, value)
+		m.AddDimension("mountpoint", mount.mountpoint)
+		m.AddDimension("device", mount.device)
+		m.AddDimension("fstype", mount.fstype)
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
@@ -0,0 +1,22 @@
+// +build linux
+
+package collector
+
+import "syscall"
+
+// statfs returns the usage of the filesystem mounted on path
+func statfs(path string) (filesystemUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return filesystemUsage{}, err
+	}
+
+	blockSize := float64(stat.Bsize)
+	return filesystemUsage{
+		bytesTotal:  float64(stat.Blocks) * blockSize,
+		bytesFree:   float64(stat.Bfree) * blockSize,
+		bytesAvail:  float64(stat.Bavail) * blockSize,
+		inodesTotal: float64(stat.Files),
+		inodesFree:  float64(stat.Ffree),
+	}, nil
+}
@@ -0,0 +1,23 @@
+// +build linux
+
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilesystemCollect(t *testing.T) {
+	// only / exists on every host
+	c := newTestCollector(newFilesystem, map[string]interface{}{"mountpoints": "^/$"})
+
+	values := make(map[string]float64)
+	for _, m := range collectAll(t, c) {
+		assert.Equal(t, "/", m.Dimensions["mountpoint"])
+		values[m.Name] = m.Value
+	}
+	assert.Equal(t, 6, len(values))
+	assert.True(t, values["filesystem.bytes_total"] > 0)
+	assert.True(t, values["filesystem.bytes_used"] <= values["filesystem.bytes_total"])
+}
@@ -0,0 +1,10 @@
+// +build !linux
+
+package collector
+
+import "errors"
+
+// statfs is only implemented on linux, like /proc/mounts
+func statfs(path string) (filesystemUsage, error) {
+	return filesystemUsage{}, errors.New("statfs is not supported on this platform")
+}
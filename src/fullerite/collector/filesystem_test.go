@@ -0,0 +1,57 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilesystemReadMounts(t *testing.T) {
+	mounts, err := newTestCollector(newFilesystem, map[string]interface{}{}).(*Filesystem).readMounts()
+	assert.Nil(t, err)
+	assert.Equal(t, []mount{
+		{device: "/dev/sda1", mountpoint: "/", fstype: "ext4"},
+		{device: "/dev/sdb1", mountpoint: "/srv/data files", fstype: "xfs"},
+	}, mounts)
+
+	mounts, err = newTestCollector(newFilesystem, map[string]interface{}{
+		"fstypes":            "^(ext4|tmpfs)$",
+		"excludeFstypes":     "^xfs$",
+		"mountpoints":        "^/run",
+		"excludeMountpoints": "^/proc",
+	}).(*Filesystem).readMounts()
+	assert.Nil(t, err)
+	assert.Equal(t, []mount{{device: "tmpfs", mountpoint: "/run", fstype: "tmpfs"}}, mounts)
+}
+
+func TestFilesystemMetrics(t *testing.T) {
+	usage := filesystemUsage{bytesTotal: 1000, bytesFree: 400, bytesAvail: 300, inodesTotal: 100, inodesFree: 90}
+	values := make(map[string]float64)
+	for _, m := range filesystemMetrics(mount{"/dev/sda1", "/", "ext4"}, usage) {
+		assert.Equal(t, map[string]string{"device": "/dev/sda1", "mountpoint": "/", "fstype": "ext4"}, m.Dimensions)
+		values[m.Name] = m.Value
+	}
+
+	assert.Equal(t, map[string]float64{
+		"filesystem.bytes_total":  1000,
+		"filesystem.bytes_used":   600,
+		"filesystem.bytes_free":   300,
+		"filesystem.inodes_total": 100,
+		"filesystem.inodes_used":  10,
+		"filesystem.inodes_free":  90,
+	}, values)
+}
+
+func TestFilesystemRootPath(t *testing.T) {
+	c := newTestCollector(newFilesystem, map[string]interface{}{}).(*Filesystem)
+	assert.Equal(t, "/var/lib", c.statPath("/var/lib"))
+
+	c = newTestCollector(newFilesystem, map[string]interface{}{"rootPath": "/host"}).(*Filesystem)
+	assert.Equal(t, "/host/var/lib", c.statPath("/var/lib"))
+	assert.Equal(t, "/host", c.statPath("/"))
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	assert.Equal(t, "/mnt/a b\tc\\d", unescapeMountField(`/mnt/a\040b\011c\134d`))
+	assert.Equal(t, "/mnt/trailing\\04", unescapeMountField(`/mnt/trailing\04`))
+}
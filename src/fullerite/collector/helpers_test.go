@@ -0,0 +1,58 @@
+package collector
+
+import (
+	"fullerite/metric"
+	"fullerite/test_utils"
+
+	"path"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// testFixture returns the path of a file or directory of src/fixtures
+func testFixture(name string) string {
+	return path.Join(test_utils.DirectoryOfCurrentFile(), "/../../fixtures", name)
+}
+
+// newTestCollector builds a collector configured with configMap, the system
+// collectors read the fixtures of /proc unless procPath is set
+func newTestCollector(newFunc func(chan metric.Metric, int, *l.Entry) Collector, configMap map[string]interface{}) Collector {
+	if _, exists := configMap["procPath"]; !exists {
+		configMap["procPath"] = testFixture("proc")
+	}
+	c := newFunc(make(chan metric.Metric), 10, test_utils.BuildLogger())
+	c.Configure(configMap)
+	return c
+}
+
+// collectAll runs Collect and returns the metrics it emitted
+func collectAll(t *testing.T, c Collector) []metric.Metric {
+	done := make(chan bool)
+	go func() {
+		c.Collect()
+		close(done)
+	}()
+
+	var collected []metric.Metric
+	for {
+		select {
+		case m := <-c.Channel():
+			collected = append(collected, m)
+		case <-done:
+			return collected
+		case <-time.After(2 * time.Second):
+			t.Fatal("Collected only ", collected)
+		}
+	}
+}
+
+// metricsByName indexes metrics by their name
+func metricsByName(metrics []metric.Metric) map[string]metric.Metric {
+	byName := make(map[string]metric.Metric, len(metrics))
+	for _, m := range metrics {
+		byName[m.Name] = m
+	}
+	return byName
+}
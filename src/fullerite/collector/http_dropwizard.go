@@ -81,7 +81,7 @@ func (h *httpDropwizardCollector) queryService(s ServiceEndpoint) {
 	endpoint := fmt.Sprintf("http://localhost:%s/%s", s.Port, s.Path)
 	serviceLog.Debug("making GET request to ", endpoint)
 
-	rawResponse, schemaVer, err := queryEndpoint(endpoint, h.timeout)
+	rawResponse, schemaVer, err := queryEndpoint(endpoint, h.timeout, h.httpTransport())
 	if err != nil {
 		serviceLog.Warn("Failed to query endpoint ", endpoint, ": ", err)
 		return
@@ -43,7 +43,8 @@ func (base baseHTTPCollector) makeRequest() []metric.Metric {
 	}
 
 	client := http.Client{
-		Timeout: time.Duration(2) * time.Second,
+		Timeout:   time.Duration(2) * time.Second,
+		Transport: base.httpTransport(),
 	}
 
 	rsp, err := client.Get(base.endpoint)
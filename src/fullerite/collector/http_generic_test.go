@@ -81,3 +81,85 @@ func TestWorkingGenericHTTP(t *testing.T) {
 	assert.NotNil(t, m, "should have produced a single metric")
 	assert.True(t, ensureEmpty(col.Channel()), "There should have only been a single metric")
 }
+
+func TestGenericHTTPThroughProxy(t *testing.T) {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		proxiedHost = req.URL.Host
+		fmt.Fprint(writer, "proxied")
+	}))
+	defer proxy.Close()
+
+	col := buildBaseHTTPCollector("http://collector.invalid/metrics")
+	col.configureCommonParams(map[string]interface{}{"proxy": proxy.URL})
+
+	var body string
+	col.rspHandler = func(rsp *http.Response) []metric.Metric {
+		txt, _ := ioutil.ReadAll(rsp.Body)
+		body = string(txt)
+		return []metric.Metric{}
+	}
+	col.errHandler = func(err error) {
+		t.Fatal(err)
+	}
+
+	col.makeRequest()
+	assert.Equal(t, "collector.invalid", proxiedHost)
+	assert.Equal(t, "proxied", body)
+}
+
+func TestGenericHTTPDefaultTransport(t *testing.T) {
+	col := buildBaseHTTPCollector("http://localhost")
+	col.configureCommonParams(map[string]interface{}{})
+	assert.Equal(t, http.DefaultTransport, col.httpTransport())
+}
+
+func TestGenericHTTPInvalidTLSPreventsRequests(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+
+	col := buildBaseHTTPCollector(ts.URL)
+	col.configureCommonParams(map[string]interface{}{
+		"tls": map[string]interface{}{"caFile": "/does/not/exist"},
+	})
+
+	var requestErr error
+	col.rspHandler = func(rsp *http.Response) []metric.Metric {
+		t.Fatal("The request should not have been sent")
+		return nil
+	}
+	col.errHandler = func(err error) {
+		requestErr = err
+	}
+
+	col.makeRequest()
+	assert.NotNil(t, requestErr)
+	assert.Equal(t, 0, requests)
+}
+
+func TestGenericHTTPInvalidProxyPreventsRequests(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+
+	col := buildBaseHTTPCollector(ts.URL)
+	col.configureCommonParams(map[string]interface{}{"proxy": "not-a-url"})
+
+	var requestErr error
+	col.rspHandler = func(rsp *http.Response) []metric.Metric {
+		t.Fatal("The request should not bypass the proxy")
+		return nil
+	}
+	col.errHandler = func(err error) {
+		requestErr = err
+	}
+
+	col.makeRequest()
+	assert.NotNil(t, requestErr)
+	assert.Equal(t, 0, requests)
+}
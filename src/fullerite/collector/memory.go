@@ -0,0 +1,179 @@
+package collector
+
+import (
+	"fullerite/metric"
+
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// metrics of the /proc/meminfo fields, in bytes except the hugepage counts
+var meminfoMetrics = map[string]string{
+	"MemTotal":        "memory.total",
+	"MemFree":         "memory.free",
+	"MemAvailable":    "memory.available",
+	"Buffers":         "memory.buffers",
+	"Cached":          "memory.cached",
+	"Shmem":           "memory.shared",
+	"Active":          "memory.active",
+	"Inactive":        "memory.inactive",
+	"Dirty":           "memory.dirty",
+	"Writeback":       "memory.writeback",
+	"Slab":            "memory.slab",
+	"SReclaimable":    "memory.slab_reclaimable",
+	"SwapTotal":       "swap.total",
+	"SwapFree":        "swap.free",
+	"SwapCached":      "swap.cached",
+	"HugePages_Total": "hugepages.total",
+	"HugePages_Free":  "hugepages.free",
+	"HugePages_Rsvd":  "hugepages.reserved",
+	"HugePages_Surp":  "hugepages.surplus",
+	"Hugepagesize":    "hugepages.size",
+}
+
+// the metrics emitted when no whitelist is configured, every
+// /proc/vmstat field is available as vmstat.<field>
+var defaultMemoryWhitelist = []string{
+	`^memory\.`,
+	`^swap\.`,
+	`^hugepages\.`,
+	`^vmstat\.(pswpin|pswpout|pgpgin|pgpgout|pgfault|pgmajfault|oom_kill)$`,
+}
+
+// Memory collector type
+// Collects the memory, swap and hugepages usage from /proc/meminfo
+// and the paging, swapping and OOM kill counters from /proc/vmstat
+type Memory struct {
+	baseCollector
+	procPath  string
+	whitelist []*regexp.Regexp
+}
+
+func init() {
+	RegisterCollector("Memory", newMemory)
+}
+
+// newMemory Simple constructor for Memory collector
+func newMemory(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	c := new(Memory)
+	c.channel = channel
+	c.interval = initialInterval
+	c.log = log
+
+	c.name = "Memory"
+	c.procPath = defaultSystemProcPath
+	c.whitelist = compileCollectorRegexps(c.log, defaultMemoryWhitelist)
+	return c
+}
+
+// Configure Override default parameters
+func (c *Memory) Configure(configMap map[string]interface{}) {
+	if procPath, exists := configMap["procPath"]; exists {
+		c.procPath = procPath.(string)
+	}
+	if whitelist, exists := configMap["whitelist"]; exists {
+		c.whitelist = compileCollectorRegexps(c.log, whitelist)
+	}
+	c.configureCommonParams(configMap)
+}
+
+func (c *Memory) whitelisted(name string) bool {
+	for _, re := range c.whitelist {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Collect emits the whitelisted memory metrics
+func (c *Memory) Collect() {
+	var metrics []metric.Metric
+
+	meminfo, err := readProcFields(filepath.Join(c.procPath, "meminfo"))
+	if err != nil {
+		c.log.Error("Unable to read meminfo: ", err)
+	} else {
+		metrics = append(metrics, c.meminfoMetrics(meminfo)...)
+	}
+
+	vmstat, err := readProcFields(filepath.Join(c.procPath, "vmstat"))
+	if err != nil {
+		c.log.Error("Unable to read vmstat: ", err)
+	} else {
+		metrics = append(metrics, c.vmstatMetrics(vmstat)...)
+	}
+
+	for _, m := range metrics {
+		if c.whitelisted(m.Name) {
+			c.Channel() <- m
+		}
+	}
+}
+
+func (c *Memory) meminfoMetrics(meminfo map[string]float64) []metric.Metric {
+	metrics := make([]metric.Metric, 0, len(meminfoMetrics)+2)
+	for field, name := range meminfoMetrics {
+		if value, exists := meminfo[field]; exists {
+			metrics = append(metrics, metric.WithValue(name, value))
+		}
+	}
+
+	// used memory excludes the page cache and the reclaimable slab
+	if total, exists := meminfo["MemTotal"]; exists {
+		used := total - meminfo["MemFree"] - meminfo["Buffers"] - meminfo["Cached"] - meminfo["SReclaimable"]
+		metrics = append(metrics, metric.WithValue("memory.used", used))
+	}
+	if total, exists := meminfo["SwapTotal"]; exists {
+		metrics = append(metrics, metric.WithValue("swap.used", total-meminfo["SwapFree"]))
+	}
+	return metrics
+}
+
+// vmstatMetrics returns the nr_ fields, which are current page counts,
+// as gauges and the other fields as counters
+func (c *Memory) vmstatMetrics(vmstat map[string]float64) []metric.Metric {
+	metrics := make([]metric.Metric, 0, len(vmstat))
+	for field, value := range vmstat {
+		m := metric.WithValue("vmstat."+field, value)
+		if !strings.HasPrefix(field, "nr_") {
+			m.MetricType = metric.CumulativeCounter
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// readProcFields reads "name value [unit]" lines, such as the ones of
+// /proc/meminfo or /proc/vmstat, values in kB are converted to bytes
+func readProcFields(path string) (map[string]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fields := make(map[string]float64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) < 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			continue
+		}
+		if len(parts) > 2 && parts[2] == "kB" {
+			value *= 1024
+		}
+		fields[strings.TrimSuffix(parts[0], ":")] = value
+	}
+	return fields, scanner.Err()
+}
@@ -0,0 +1,52 @@
+package collector
+
+import (
+	"fullerite/metric"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCollect(t *testing.T) {
+	c := newTestCollector(newMemory, map[string]interface{}{})
+	collected := metricsByName(collectAll(t, c))
+
+	assert.Equal(t, 16384000.0*1024, collected["memory.total"].Value)
+	assert.Equal(t, 8192000.0*1024, collected["memory.available"].Value)
+	assert.Equal(t, (16384000.0-2048000-512000-4096000-400000)*1024, collected["memory.used"].Value)
+	assert.Equal(t, 1024000.0*1024, collected["swap.used"].Value)
+	assert.Equal(t, 16.0, collected["hugepages.total"].Value)
+	assert.Equal(t, 2048.0*1024, collected["hugepages.size"].Value)
+
+	assert.Equal(t, 300.0, collected["vmstat.pswpin"].Value)
+	assert.Equal(t, 2.0, collected["vmstat.oom_kill"].Value)
+	assert.Equal(t, metric.CumulativeCounter, collected["vmstat.pgmajfault"].MetricType)
+
+	_, exists := collected["vmstat.pgsteal_kswapd"]
+	assert.False(t, exists)
+}
+
+func TestMemoryCollectWhitelist(t *testing.T) {
+	c := newTestCollector(newMemory, map[string]interface{}{
+		"whitelist": []interface{}{`^memory\.(used|available)$`, `^vmstat\.nr_`},
+	})
+	collected := metricsByName(collectAll(t, c))
+
+	assert.Equal(t, 4, len(collected))
+	assert.Equal(t, metric.Gauge, collected["vmstat.nr_dirty"].MetricType)
+	assert.Equal(t, 256.0, collected["vmstat.nr_dirty"].Value)
+	_, exists := collected["memory.used"]
+	assert.True(t, exists)
+}
+
+func TestMemoryWhitelistIgnoresInvalidEntries(t *testing.T) {
+	c := newTestCollector(newMemory, map[string]interface{}{
+		"whitelist": []interface{}{`^memory\.used$`, 1, "("},
+	})
+	collected := metricsByName(collectAll(t, c))
+
+	assert.Equal(t, 1, len(collected))
+	_, exists := collected["memory.used"]
+	assert.True(t, exists)
+}
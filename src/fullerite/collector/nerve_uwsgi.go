@@ -94,7 +94,7 @@ func (n *nerveUWSGICollector) queryService(serviceName string, port int) {
 	endpoint := fmt.Sprintf("http://localhost:%d/%s", port, n.queryPath)
 	serviceLog.Debug("making GET request to ", endpoint)
 
-	rawResponse, schemaVer, err := queryEndpoint(endpoint, n.timeout)
+	rawResponse, schemaVer, err := queryEndpoint(endpoint, n.timeout, n.httpTransport())
 	if err != nil {
 		serviceLog.Warn("Failed to query endpoint ", endpoint, ": ", err)
 		return
@@ -117,9 +117,10 @@ func (n *nerveUWSGICollector) queryService(serviceName string, port int) {
 	}
 }
 
-func queryEndpoint(endpoint string, timeout int) ([]byte, string, error) {
+func queryEndpoint(endpoint string, timeout int, transport http.RoundTripper) ([]byte, string, error) {
 	client := http.Client{
-		Timeout: time.Duration(timeout) * time.Second,
+		Timeout:   time.Duration(timeout) * time.Second,
+		Transport: transport,
 	}
 
 	rsp, err := client.Get(endpoint)
@@ -0,0 +1,185 @@
+package collector
+
+import (
+	"fullerite/metric"
+
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/prometheus/procfs"
+)
+
+const defaultNetworkExcludeInterfaces = `^lo$`
+
+// metrics of the /proc/net/snmp and /proc/net/netstat counters
+var networkProtocolMetrics = map[string]string{
+	"Tcp.ActiveOpens":          "tcp.active_opens",
+	"Tcp.PassiveOpens":         "tcp.passive_opens",
+	"Tcp.AttemptFails":         "tcp.attempt_fails",
+	"Tcp.EstabResets":          "tcp.established_resets",
+	"Tcp.InSegs":               "tcp.in_segments",
+	"Tcp.OutSegs":              "tcp.out_segments",
+	"Tcp.RetransSegs":          "tcp.retransmitted_segments",
+	"Tcp.InErrs":               "tcp.in_errors",
+	"Tcp.OutRsts":              "tcp.out_resets",
+	"TcpExt.ListenOverflows":   "tcp.listen_overflows",
+	"TcpExt.ListenDrops":       "tcp.listen_drops",
+	"TcpExt.TCPTimeouts":       "tcp.timeouts",
+	"TcpExt.TCPLostRetransmit": "tcp.lost_retransmits",
+	"TcpExt.TCPAbortOnTimeout": "tcp.aborts_on_timeout",
+	"TcpExt.SyncookiesSent":    "tcp.syncookies_sent",
+	"Udp.InDatagrams":          "udp.in_datagrams",
+	"Udp.OutDatagrams":         "udp.out_datagrams",
+	"Udp.NoPorts":              "udp.no_ports",
+	"Udp.InErrors":             "udp.in_errors",
+	"Udp.RcvbufErrors":         "udp.receive_buffer_errors",
+	"Udp.SndbufErrors":         "udp.send_buffer_errors",
+}
+
+// Network collector type
+// Collects the bytes, packets, errors and drops of network interfaces
+// and the TCP and UDP counters of the kernel
+type Network struct {
+	baseCollector
+	procPath          string
+	interfaces        *regexp.Regexp
+	excludeInterfaces *regexp.Regexp
+}
+
+func init() {
+	RegisterCollector("Network", newNetwork)
+}
+
+// newNetwork Simple constructor for Network collector
+func newNetwork(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	c := new(Network)
+	c.channel = channel
+	c.interval = initialInterval
+	c.log = log
+
+	c.name = "Network"
+	c.procPath = defaultSystemProcPath
+	c.excludeInterfaces = regexp.MustCompile(defaultNetworkExcludeInterfaces)
+	return c
+}
+
+// Configure Override default parameters
+func (c *Network) Configure(configMap map[string]interface{}) {
+	if procPath, exists := configMap["procPath"]; exists {
+		c.procPath = procPath.(string)
+	}
+	if interfaces, exists := configMap["interfaces"]; exists {
+		c.interfaces = compileCollectorRegexp(c.log, interfaces, c.interfaces)
+	}
+	if excludeInterfaces, exists := configMap["excludeInterfaces"]; exists {
+		c.excludeInterfaces = compileCollectorRegexp(c.log, excludeInterfaces, c.excludeInterfaces)
+	}
+	c.configureCommonParams(configMap)
+}
+
+// Collect emits the interface and protocol counters
+func (c *Network) Collect() {
+	metrics := c.interfaceMetrics()
+	metrics = append(metrics, c.protocolMetrics()...)
+
+	for _, m := range metrics {
+		c.Channel() <- m
+	}
+}
+
+func (c *Network) interfaceMetrics() []metric.Metric {
+	fs, err := procfs.NewFS(c.procPath)
+	if err != nil {
+		c.log.Error("Unable to open ", c.procPath, ": ", err)
+		return nil
+	}
+	netDev, err := fs.NewNetDev()
+	if err != nil {
+		c.log.Error("Unable to read the interfaces stats: ", err)
+		return nil
+	}
+
+	var metrics []metric.Metric
+	for name, stats := range netDev {
+		if !matchesFilters(name, c.interfaces, c.excludeInterfaces) {
+			continue
+		}
+
+		values := map[string]uint64{
+			"network.rx_bytes":   stats.RxBytes,
+			"network.rx_packets": stats.RxPackets,
+			"network.rx_errors":  stats.RxErrors,
+			"network.rx_dropped": stats.RxDropped,
+			"network.tx_bytes":   stats.TxBytes,
+			"network.tx_packets": stats.TxPackets,
+			"network.tx_errors":  stats.TxErrors,
+			"network.tx_dropped": stats.TxDropped,
+		}
+		for metricName, value := range values {
+			m := metric.WithValue(metricName, float64(value))
+			m.MetricType = metric.CumulativeCounter
+			m.AddDimension("interface", name)
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics
+}
+
+func (c *Network) protocolMetrics() []metric.Metric {
+	counters := make(map[string]float64)
+	for _, file := range []string{"net/snmp", "net/netstat"} {
+		if err := readProcTables(filepath.Join(c.procPath, file), counters); err != nil {
+			c.log.Error("Unable to read ", file, ": ", err)
+		}
+	}
+
+	var metrics []metric.Metric
+	for counter, name := range networkProtocolMetrics {
+		if value, exists := counters[counter]; exists {
+			m := metric.WithValue(name, value)
+			m.MetricType = metric.CumulativeCounter
+			metrics = append(metrics, m)
+		}
+	}
+	if established, exists := counters["Tcp.CurrEstab"]; exists {
+		metrics = append(metrics, metric.WithValue("tcp.current_established", established))
+	}
+	return metrics
+}
+
+// readProcTables reads the header and values line pairs of /proc/net/snmp
+// and /proc/net/netstat, counters are keyed by protocol.name
+func readProcTables(path string, counters map[string]float64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var header []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if header == nil || header[0] != fields[0] {
+			header = fields
+			continue
+		}
+
+		protocol := strings.TrimSuffix(fields[0], ":")
+		for i := 1; i < len(fields) && i < len(header); i++ {
+			if value, err := strconv.ParseFloat(fields[i], 64); err == nil {
+				counters[protocol+"."+header[i]] = value
+			}
+		}
+		header = nil
+	}
+	return scanner.Err()
+}
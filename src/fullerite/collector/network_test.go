@@ -0,0 +1,56 @@
+package collector
+
+import (
+	"fullerite/metric"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkInterfaceMetrics(t *testing.T) {
+	values := make(map[string]float64)
+	for _, m := range newTestCollector(newNetwork, map[string]interface{}{}).(*Network).interfaceMetrics() {
+		assert.Equal(t, metric.CumulativeCounter, m.MetricType)
+		values[m.Dimensions["interface"]+"."+m.Name] = m.Value
+	}
+
+	assert.Equal(t, 16, len(values))
+	assert.Equal(t, 98765432.0, values["eth0.network.rx_bytes"])
+	assert.Equal(t, 543210.0, values["eth0.network.tx_packets"])
+	assert.Equal(t, 3.0, values["eth0.network.rx_errors"])
+	assert.Equal(t, 7.0, values["eth0.network.rx_dropped"])
+	assert.Equal(t, 2.0, values["eth0.network.tx_dropped"])
+	_, exists := values["lo.network.rx_bytes"]
+	assert.False(t, exists)
+}
+
+func TestNetworkInterfaceFilters(t *testing.T) {
+	c := newTestCollector(newNetwork, map[string]interface{}{
+		"interfaces":        "^(eth|lo)",
+		"excludeInterfaces": "^eth",
+	}).(*Network)
+
+	interfaces := make(map[string]bool)
+	for _, m := range c.interfaceMetrics() {
+		interfaces[m.Dimensions["interface"]] = true
+	}
+	assert.Equal(t, map[string]bool{"lo": true}, interfaces)
+}
+
+func TestNetworkProtocolMetrics(t *testing.T) {
+	metrics := make(map[string]metric.Metric)
+	for _, m := range newTestCollector(newNetwork, map[string]interface{}{}).(*Network).protocolMetrics() {
+		metrics[m.Name] = m
+	}
+
+	assert.Equal(t, len(networkProtocolMetrics)+1, len(metrics))
+	assert.Equal(t, 1234.0, metrics["tcp.retransmitted_segments"].Value)
+	assert.Equal(t, 678.0, metrics["tcp.out_resets"].Value)
+	assert.Equal(t, 17.0, metrics["tcp.listen_overflows"].Value)
+	assert.Equal(t, 9.0, metrics["udp.in_errors"].Value)
+	assert.Equal(t, 8.0, metrics["udp.receive_buffer_errors"].Value)
+	assert.Equal(t, metric.CumulativeCounter, metrics["tcp.timeouts"].MetricType)
+	assert.Equal(t, 120.0, metrics["tcp.current_established"].Value)
+	assert.Equal(t, metric.Gauge, metrics["tcp.current_established"].MetricType)
+}
@@ -75,7 +75,7 @@ func TestNginxStatsQueryNginxStatsFailure(t *testing.T) {
 }
 
 func TestBuildNginxMetric(t *testing.T) {
-	expected := metric.Metric{"nginx.test", "gauge", 0.1, map[string]string{}}
+	expected := metric.Metric{Name: "nginx.test", MetricType: "gauge", Value: 0.1, Dimensions: map[string]string{}}
 	actual := buildNginxMetric("nginx.test", metric.Gauge, 0.1)
 	assert.Equal(t, expected, actual)
 }
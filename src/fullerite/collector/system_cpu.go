@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"strconv"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/prometheus/procfs"
+)
+
+// SystemCPU collector type
+// Collects the CPU utilisation of every core and of all of them,
+// in percent of the time elapsed since the previous collection, and
+// the context switches, interrupts, forks and runnable processes
+type SystemCPU struct {
+	baseCollector
+	procPath string
+	perCore  bool
+
+	// the jiffies of the previous collection, by core
+	previous map[string]procfs.CPUStat
+}
+
+func init() {
+	RegisterCollector("SystemCPU", newSystemCPU)
+}
+
+// newSystemCPU Simple constructor for SystemCPU collector
+func newSystemCPU(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	c := new(SystemCPU)
+	c.channel = channel
+	c.interval = initialInterval
+	c.log = log
+
+	c.name = "SystemCPU"
+	c.procPath = defaultSystemProcPath
+	c.perCore = true
+	c.previous = make(map[string]procfs.CPUStat)
+	return c
+}
+
+// Configure Override default parameters
+func (c *SystemCPU) Configure(configMap map[string]interface{}) {
+	if procPath, exists := configMap["procPath"]; exists {
+		c.procPath = procPath.(string)
+	}
+	if perCore, exists := configMap["perCore"]; exists {
+		c.perCore = config.GetAsBool(perCore, true)
+	}
+	c.configureCommonParams(configMap)
+}
+
+// Collect reads /proc/stat and emits the CPU metrics
+func (c *SystemCPU) Collect() {
+	fs, err := procfs.NewFS(c.procPath)
+	if err != nil {
+		c.log.Error("Unable to open ", c.procPath, ": ", err)
+		return
+	}
+	stat, err := fs.NewStat()
+	if err != nil {
+		c.log.Error("Unable to read the CPU stats: ", err)
+		return
+	}
+
+	for _, m := range c.systemCPUMetrics(stat) {
+		c.Channel() <- m
+	}
+}
+
+func (c *SystemCPU) systemCPUMetrics(stat procfs.Stat) []metric.Metric {
+	metrics := c.utilisation("total", stat.CPUTotal)
+	if c.perCore {
+		for i, cpu := range stat.CPU {
+			metrics = append(metrics, c.utilisation("cpu"+strconv.Itoa(i), cpu)...)
+		}
+	}
+
+	counters := map[string]uint64{
+		"cpu.context_switches": stat.ContextSwitches,
+		"cpu.interrupts":       stat.IRQTotal,
+		"cpu.forks":            stat.ProcessCreated,
+	}
+	for name, value := range counters {
+		m := metric.WithValue(name, float64(value))
+		m.MetricType = metric.CumulativeCounter
+		metrics = append(metrics, m)
+	}
+	metrics = append(metrics,
+		metric.WithValue("cpu.procs_running", float64(stat.ProcessesRunning)),
+		metric.WithValue("cpu.procs_blocked", float64(stat.ProcessesBlocked)))
+	return metrics
+}
+
+// utilisation returns the share of each CPU state since the previous
+// collection, nothing for the first one or when no time elapsed
+func (c *SystemCPU) utilisation(core string, cpu procfs.CPUStat) []metric.Metric {
+	previous, seen := c.previous[core]
+	c.previous[core] = cpu
+	if !seen {
+		return nil
+	}
+
+	// guest time is also accounted as user time
+	states := map[string]float64{
+		"user":       cpu.User - cpu.Guest - (previous.User - previous.Guest),
+		"nice":       cpu.Nice - cpu.GuestNice - (previous.Nice - previous.GuestNice),
+		"system":     cpu.System - previous.System,
+		"idle":       cpu.Idle - previous.Idle,
+		"iowait":     cpu.Iowait - previous.Iowait,
+		"irq":        cpu.IRQ - previous.IRQ,
+		"softirq":    cpu.SoftIRQ - previous.SoftIRQ,
+		"steal":      cpu.Steal - previous.Steal,
+		"guest":      cpu.Guest - previous.Guest,
+		"guest_nice": cpu.GuestNice - previous.GuestNice,
+	}
+	total := 0.0
+	for _, elapsed := range states {
+		total += elapsed
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	metrics := make([]metric.Metric, 0, len(states))
+	for state, elapsed := range states {
+		m := metric.WithValue("cpu."+state, 100*elapsed/total)
+		m.AddDimension("core", core)
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
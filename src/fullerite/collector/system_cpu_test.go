@@ -0,0 +1,74 @@
+package collector
+
+import (
+	"fullerite/metric"
+	"fullerite/test_utils"
+
+	"testing"
+
+	"github.com/prometheus/procfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemCPUConfigure(t *testing.T) {
+	c := newSystemCPU(make(chan metric.Metric), 10, test_utils.BuildLogger()).(*SystemCPU)
+	assert.Equal(t, "/proc", c.procPath)
+	assert.True(t, c.perCore)
+
+	c.Configure(map[string]interface{}{"procPath": "/host/proc", "perCore": false})
+	assert.Equal(t, "/host/proc", c.procPath)
+	assert.False(t, c.perCore)
+}
+
+func TestSystemCPUCollectCounters(t *testing.T) {
+	c := newTestCollector(newSystemCPU, map[string]interface{}{})
+
+	// the first collection has no utilisation to report
+	collected := make(map[string]float64)
+	for _, m := range collectAll(t, c) {
+		collected[m.Name] = m.Value
+		if m.Name == "cpu.forks" {
+			assert.Equal(t, metric.CumulativeCounter, m.MetricType)
+		}
+	}
+
+	assert.Equal(t, map[string]float64{
+		"cpu.context_switches": 987654,
+		"cpu.interrupts":       123456,
+		"cpu.forks":            4321,
+		"cpu.procs_running":    3,
+		"cpu.procs_blocked":    1,
+	}, collected)
+}
+
+func TestSystemCPUUtilisation(t *testing.T) {
+	c := newTestCollector(newSystemCPU, map[string]interface{}{}).(*SystemCPU)
+
+	first := procfs.Stat{
+		CPUTotal: procfs.CPUStat{User: 100, System: 50, Idle: 800, Iowait: 50},
+		CPU:      []procfs.CPUStat{{User: 100, System: 50, Idle: 800, Iowait: 50}},
+	}
+	second := procfs.Stat{
+		CPUTotal: procfs.CPUStat{User: 160, System: 70, Idle: 890, Iowait: 70, Steal: 10, Guest: 20},
+		CPU:      []procfs.CPUStat{{User: 160, System: 70, Idle: 890, Iowait: 70, Steal: 10, Guest: 20}},
+	}
+
+	assert.Equal(t, 5, len(c.systemCPUMetrics(first)))
+
+	percent := make(map[string]float64)
+	for _, m := range c.systemCPUMetrics(second) {
+		if core, ok := m.Dimensions["core"]; ok {
+			percent[core+"."+m.Name] = m.Value
+		}
+	}
+
+	assert.Equal(t, 20, len(percent))
+	assert.Equal(t, 20.0, percent["total.cpu.user"])
+	assert.Equal(t, 10.0, percent["total.cpu.guest"])
+	assert.Equal(t, 10.0, percent["total.cpu.system"])
+	assert.Equal(t, 45.0, percent["total.cpu.idle"])
+	assert.Equal(t, 10.0, percent["total.cpu.iowait"])
+	assert.Equal(t, 5.0, percent["total.cpu.steal"])
+	assert.Equal(t, 0.0, percent["total.cpu.nice"])
+	assert.Equal(t, 20.0, percent["cpu0.cpu.user"])
+}
@@ -0,0 +1,213 @@
+package collector
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// the sources of the SystemLoad metrics, all of them by default
+var systemLoadSources = []string{"loadavg", "pressure", "filenr", "entropy", "uptime"}
+
+// resources with pressure stall information, from linux 4.20
+var pressureResources = []string{"cpu", "memory", "io"}
+
+// SystemLoad collector type
+// Collects the load average, the pressure stall information, the file
+// handles, the available entropy and the uptime of the host
+type SystemLoad struct {
+	baseCollector
+	procPath string
+	sources  map[string]bool
+}
+
+func init() {
+	RegisterCollector("SystemLoad", newSystemLoad)
+}
+
+// newSystemLoad Simple constructor for SystemLoad collector
+func newSystemLoad(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	c := new(SystemLoad)
+	c.channel = channel
+	c.interval = initialInterval
+	c.log = log
+
+	c.name = "SystemLoad"
+	c.procPath = defaultSystemProcPath
+	c.sources = make(map[string]bool)
+	for _, source := range systemLoadSources {
+		c.sources[source] = true
+	}
+	return c
+}
+
+// Configure Override default parameters
+func (c *SystemLoad) Configure(configMap map[string]interface{}) {
+	if procPath, exists := configMap["procPath"]; exists {
+		c.procPath = procPath.(string)
+	}
+	if sources, exists := configMap["sources"]; exists {
+		c.sources = make(map[string]bool)
+		for _, source := range config.GetAsSlice(sources) {
+			c.sources[source] = true
+		}
+	}
+	c.configureCommonParams(configMap)
+}
+
+// Collect emits the metrics of the enabled sources
+func (c *SystemLoad) Collect() {
+	collectors := map[string]func() ([]metric.Metric, error){
+		"loadavg":  c.loadavgMetrics,
+		"pressure": c.pressureMetrics,
+		"filenr":   c.fileNrMetrics,
+		"entropy":  c.entropyMetrics,
+		"uptime":   c.uptimeMetrics,
+	}
+
+	for _, source := range systemLoadSources {
+		if !c.sources[source] {
+			continue
+		}
+		metrics, err := collectors[source]()
+		if err != nil {
+			c.log.Error("Unable to collect ", source, ": ", err)
+		}
+		for _, m := range metrics {
+			c.Channel() <- m
+		}
+	}
+}
+
+// readProcValues returns the whitespace separated values of a proc file
+func (c *SystemLoad) readProcValues(path ...string) ([]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(append([]string{c.procPath}, path...)...))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(content)), nil
+}
+
+func (c *SystemLoad) loadavgMetrics() ([]metric.Metric, error) {
+	fields, err := c.readProcValues("loadavg")
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []metric.Metric
+	for i, name := range []string{"load.1min", "load.5min", "load.15min"} {
+		if i < len(fields) {
+			if value, err := strconv.ParseFloat(fields[i], 64); err == nil {
+				metrics = append(metrics, metric.WithValue(name, value))
+			}
+		}
+	}
+
+	// runnable and total scheduling entities, as in 3/467
+	if len(fields) > 3 {
+		if processes := strings.Split(fields[3], "/"); len(processes) == 2 {
+			running, _ := strconv.ParseFloat(processes[0], 64)
+			total, _ := strconv.ParseFloat(processes[1], 64)
+			metrics = append(metrics,
+				metric.WithValue("load.processes_running", running),
+				metric.WithValue("load.processes_total", total))
+		}
+	}
+	return metrics, nil
+}
+
+// pressureMetrics reads lines such as
+// some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+// kernels without PSI have no pressure files, which is not an error
+func (c *SystemLoad) pressureMetrics() ([]metric.Metric, error) {
+	var metrics []metric.Metric
+	for _, resource := range pressureResources {
+		content, err := ioutil.ReadFile(filepath.Join(c.procPath, "pressure", resource))
+		if os.IsNotExist(err) {
+			c.log.Debug("No pressure stall information for ", resource)
+			continue
+		}
+		if err != nil {
+			return metrics, err
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			for _, field := range fields[1:] {
+				keyValue := strings.SplitN(field, "=", 2)
+				if len(keyValue) != 2 {
+					continue
+				}
+				value, err := strconv.ParseFloat(keyValue[1], 64)
+				if err != nil {
+					continue
+				}
+
+				// totals are the stalled microseconds
+				m := metric.WithValue("pressure."+keyValue[0], value)
+				if keyValue[0] == "total" {
+					m.MetricType = metric.CumulativeCounter
+				}
+				m.AddDimension("resource", resource)
+				m.AddDimension("scope", fields[0])
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// fileNrMetrics reads the allocated, unused and maximum file handles
+func (c *SystemLoad) fileNrMetrics() ([]metric.Metric, error) {
+	fields, err := c.readProcValues("sys", "fs", "file-nr")
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 3 {
+		return nil, nil
+	}
+
+	allocated, _ := strconv.ParseFloat(fields[0], 64)
+	unused, _ := strconv.ParseFloat(fields[1], 64)
+	max, _ := strconv.ParseFloat(fields[2], 64)
+	return []metric.Metric{
+		metric.WithValue("files.allocated", allocated-unused),
+		metric.WithValue("files.max", max),
+	}, nil
+}
+
+func (c *SystemLoad) entropyMetrics() ([]metric.Metric, error) {
+	fields, err := c.readProcValues("sys", "kernel", "random", "entropy_avail")
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+
+	entropy, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	return []metric.Metric{metric.WithValue("entropy.available", entropy)}, nil
+}
+
+func (c *SystemLoad) uptimeMetrics() ([]metric.Metric, error) {
+	fields, err := c.readProcValues("uptime")
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	return []metric.Metric{metric.WithValue("uptime.seconds", uptime)}, nil
+}
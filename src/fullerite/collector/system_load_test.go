@@ -0,0 +1,51 @@
+package collector
+
+import (
+	"fullerite/metric"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collectSystemLoad keys the pressure metrics by resource and scope
+func collectSystemLoad(t *testing.T, configMap map[string]interface{}) map[string]metric.Metric {
+	collected := make(map[string]metric.Metric)
+	for _, m := range collectAll(t, newTestCollector(newSystemLoad, configMap)) {
+		key := m.Name
+		if resource, ok := m.Dimensions["resource"]; ok {
+			key = resource + "." + m.Dimensions["scope"] + "." + m.Name
+		}
+		collected[key] = m
+	}
+	return collected
+}
+
+func TestSystemLoadCollect(t *testing.T) {
+	collected := collectSystemLoad(t, map[string]interface{}{})
+
+	assert.Equal(t, 0.52, collected["load.1min"].Value)
+	assert.Equal(t, 0.59, collected["load.15min"].Value)
+	assert.Equal(t, 3.0, collected["load.processes_running"].Value)
+	assert.Equal(t, 467.0, collected["load.processes_total"].Value)
+	assert.Equal(t, 2304.0, collected["files.allocated"].Value)
+	assert.Equal(t, 9223372036854775807.0, collected["files.max"].Value)
+	assert.Equal(t, 3754.0, collected["entropy.available"].Value)
+	assert.Equal(t, 354826.17, collected["uptime.seconds"].Value)
+
+	// the io pressure file is missing, like on older kernels
+	assert.Equal(t, 1.5, collected["cpu.some.pressure.avg10"].Value)
+	assert.Equal(t, 0.03, collected["memory.full.pressure.avg300"].Value)
+	assert.Equal(t, 890.0, collected["memory.full.pressure.total"].Value)
+	assert.Equal(t, metric.CumulativeCounter, collected["memory.full.pressure.total"].MetricType)
+	assert.Equal(t, 9+12, len(collected))
+}
+
+func TestSystemLoadCollectSources(t *testing.T) {
+	collected := collectSystemLoad(t, map[string]interface{}{
+		"sources": []interface{}{"entropy", "uptime"},
+	})
+
+	assert.Equal(t, 2, len(collected))
+	assert.Equal(t, 3754.0, collected["entropy.available"].Value)
+}
@@ -381,7 +381,7 @@ func TestErrorQueryStatsEndpointResponse(t *testing.T) {
 	endpoint := ts.URL + "/status/uwsgi"
 	ts.Close()
 
-	_, _, queryEndpointError := queryEndpoint(endpoint, 10)
+	_, _, queryEndpointError := queryEndpoint(endpoint, 10, nil)
 	assert.NotNil(t, queryEndpointError)
 
 	//Socket closed test
@@ -390,7 +390,7 @@ func TestErrorQueryStatsEndpointResponse(t *testing.T) {
 	}))
 	tsClosed.Close()
 	closedEndpoint := tsClosed.URL + "/status/uwsgi"
-	_, queryClosedEndpointResponse, queryClosedEndpointError := queryEndpoint(closedEndpoint, 10)
+	_, queryClosedEndpointResponse, queryClosedEndpointError := queryEndpoint(closedEndpoint, 10, nil)
 	assert.NotNil(t, queryClosedEndpointError)
 	assert.Equal(t, "", queryClosedEndpointResponse)
 }
@@ -125,10 +125,10 @@ func readFromCollector(collector collector.Collector,
 			m.Name = collector.Prefix() + m.Name
 		}
 
+		// handlers queue metrics on their own, one that is stalled
+		// drops its metrics rather than blocking the collector
 		for i := range handlers {
-			if _, exists := handlers[i].CollectorEndpoints()[c]; exists {
-				handlers[i].CollectorEndpoints()[c].Channel <- m
-			}
+			handlers[i].Enqueue(c, m)
 		}
 	}
 	// Closing the stat channel after collector loop finishes
@@ -150,7 +150,7 @@ func TestCollectorPrefix(t *testing.T) {
 	collector.Configure(c)
 
 	collectorChannel := map[string]handler.CollectorEnd{
-		"Test": handler.CollectorEnd{make(chan metric.Metric), 1},
+		"Test": handler.CollectorEnd{make(chan metric.Metric, 1), 1},
 	}
 
 	testHandler := handler.New("Log")
@@ -207,3 +207,44 @@ func TestCollectorBlacklist(t *testing.T) {
 
 	assert.Equal(t, uint64(1), collectorMetrics["Test"])
 }
+
+func TestReadFromCollectorStalledHandler(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	col := collector.New("Test")
+	col.SetInterval(1)
+	col.Configure(map[string]interface{}{"interval": 1})
+
+	// nothing reads from the stalled handler's queue
+	stalled := handler.New("Log")
+	stalled.SetCollectorEndpoints(map[string]handler.CollectorEnd{
+		"Test": handler.CollectorEnd{Channel: make(chan metric.Metric, 1), BufferSize: 1},
+	})
+	healthy := handler.New("Log")
+	healthy.SetCollectorEndpoints(map[string]handler.CollectorEnd{
+		"Test": handler.CollectorEnd{Channel: make(chan metric.Metric, 3), BufferSize: 3},
+	})
+
+	go func() {
+		for _, name := range []string{"m1", "m2", "m3"} {
+			col.Channel() <- metric.New(name)
+		}
+		close(col.Channel())
+	}()
+
+	done := make(chan bool)
+	go func() {
+		readFromCollector(col, []handler.Handler{stalled, healthy})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A stalled handler blocked the collector")
+	}
+
+	assert.Equal(t, 3, len(healthy.CollectorEndpoints()["Test"].Channel))
+	assert.Equal(t, 1, len(stalled.CollectorEndpoints()["Test"].Channel))
+	assert.Equal(t, 2.0, stalled.InternalMetrics().Counters["collectorQueueDropped.Test"])
+	_, exists := healthy.InternalMetrics().Counters["collectorQueueDropped.Test"]
+	assert.False(t, exists)
+}
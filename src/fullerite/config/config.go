@@ -165,3 +165,22 @@ func GetAsSlice(value interface{}) []string {
 
 	return result
 }
+
+// GetAsBool parses a string to a bool or returns the bool if bool is passed in
+func GetAsBool(value interface{}, defaultValue bool) (result bool) {
+	result = defaultValue
+
+	switch value.(type) {
+	case string:
+		fromString, err := strconv.ParseBool(value.(string))
+		if err == nil {
+			result = fromString
+		} else {
+			log.Warn("Failed to convert value", value, "to a bool")
+		}
+	case bool:
+		result = value.(bool)
+	}
+
+	return
+}
@@ -113,6 +113,22 @@ func TestGetFloat(t *testing.T) {
 	assert.Equal(val, 12.123)
 }
 
+func TestGetBool(t *testing.T) {
+	assert := assert.New(t)
+
+	val := config.GetAsBool("true", false)
+	assert.Equal(val, true)
+
+	val = config.GetAsBool("notabool", true)
+	assert.Equal(val, true)
+
+	val = config.GetAsBool(false, true)
+	assert.Equal(val, false)
+
+	val = config.GetAsBool(12, true)
+	assert.Equal(val, true)
+}
+
 func TestGetAsMap(t *testing.T) {
 	assert := assert.New(t)
 
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// serializedSize estimates the bytes a metric takes in a handler's
+// payload, handlers set serializedSizeFunc for a better estimate
+func (base *BaseHandler) serializedSize(m metric.Metric) int {
+	if base.serializedSizeFunc != nil {
+		return base.serializedSizeFunc(m)
+	}
+	serialized, _ := json.Marshal(m)
+	return len(serialized)
+}
+
+// splitBatch splits a flush into the batches emitted separately: none
+// is over maxBatchBytes, nor holds more datapoints than the rate limit
+// allows at once. Payload envelopes are not accounted for, so the limit
+// should leave some headroom below the backend's.
+func (base *BaseHandler) splitBatch(metrics []metric.Metric) [][]metric.Metric {
+	maxCount := 0
+	if base.rateLimiter != nil {
+		maxCount = base.rateLimiter.burst()
+	}
+	if base.maxBatchBytes <= 0 && maxCount <= 0 {
+		return [][]metric.Metric{metrics}
+	}
+
+	var batches [][]metric.Metric
+	start, size := 0, 0
+	for i, m := range metrics {
+		mSize := 0
+		if base.maxBatchBytes > 0 {
+			mSize = base.serializedSize(m)
+		}
+
+		full := maxCount > 0 && i-start >= maxCount
+		tooBig := base.maxBatchBytes > 0 && size+mSize > base.maxBatchBytes
+		if i > start && (full || tooBig) {
+			batches = append(batches, metrics[start:i])
+			start, size = i, 0
+		}
+		size += mSize
+	}
+	return append(batches, metrics[start:])
+}
+
+// throttle waits for the rate limiter to allow sending a batch until
+// deadline, it returns false and counts the batch as throttled otherwise
+func (base *BaseHandler) throttle(batch []metric.Metric, deadline time.Time) bool {
+	if base.rateLimiter == nil || base.rateLimiter.wait(len(batch), deadline) {
+		return true
+	}
+	base.log.Warn("Throttling ", len(batch), " metrics over the limit of ",
+		base.rateLimiter.burst(), " datapoints per second")
+	atomic.AddUint64(&base.metricsThrottled, uint64(len(batch)))
+	return false
+}
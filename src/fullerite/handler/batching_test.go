@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"sync"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestBatchingMetrics(n int) []metric.Metric {
+	metrics := make([]metric.Metric, 0, n)
+	for i := 0; i < n; i++ {
+		metrics = append(metrics, metric.New("metric"))
+	}
+	return metrics
+}
+
+func batchLengths(batches [][]metric.Metric) []int {
+	lengths := []int{}
+	for _, batch := range batches {
+		lengths = append(lengths, len(batch))
+	}
+	return lengths
+}
+
+func TestSplitBatchUnlimited(t *testing.T) {
+	base := BaseHandler{}
+	assert.Equal(t, []int{10}, batchLengths(base.splitBatch(getTestBatchingMetrics(10))))
+}
+
+func TestSplitBatchByBytes(t *testing.T) {
+	base := BaseHandler{}
+	base.configureCommonParams(map[string]interface{}{"maxBatchBytes": "250"})
+	base.serializedSizeFunc = func(m metric.Metric) int { return 100 }
+
+	assert.Equal(t, []int{2, 2, 1}, batchLengths(base.splitBatch(getTestBatchingMetrics(5))))
+
+	// metrics larger than the limit are still sent on their own
+	base.serializedSizeFunc = func(m metric.Metric) int { return 1000 }
+	assert.Equal(t, []int{1, 1}, batchLengths(base.splitBatch(getTestBatchingMetrics(2))))
+}
+
+func TestSplitBatchByRate(t *testing.T) {
+	base := BaseHandler{}
+	base.configureCommonParams(map[string]interface{}{"maxDatapointsPerSecond": 4})
+	assert.Equal(t, []int{4, 4, 2}, batchLengths(base.splitBatch(getTestBatchingMetrics(10))))
+}
+
+func TestSerializedSizeDefault(t *testing.T) {
+	base := BaseHandler{}
+	assert.True(t, base.serializedSize(metric.New("metric")) > len("metric"))
+}
+
+func TestDatadogPayloadSize(t *testing.T) {
+	d := getTestDataDogHandler(12, 13, 14)
+	d.Configure(map[string]interface{}{"maxBatchBytes": 500})
+	assert.True(t, d.serializedSize(metric.New("metric")) > 0)
+	assert.Equal(t, 500, d.maxBatchBytes)
+}
+
+func TestEmitAndTimeThrottles(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "batching")}
+	base.emissionTimingChannel = make(chan emissionTiming, 10)
+	base.configureCommonParams(map[string]interface{}{
+		"maxDatapointsPerSecond": 3,
+		"interval":               0,
+	})
+
+	var lock sync.Mutex
+	var emitted []int
+	emitFunc := func(metrics []metric.Metric) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		emitted = append(emitted, len(metrics))
+		return true
+	}
+
+	// only the first batch fits in the bucket before the deadline
+	base.emitAndTime(getTestBatchingMetrics(7), emitFunc)
+	assert.Equal(t, []int{3}, emitted)
+
+	internal := base.InternalMetrics()
+	assert.Equal(t, 4.0, internal.Counters["metricsThrottled"])
+	assert.Equal(t, 3.0, internal.Counters["metricsSent"])
+	assert.Equal(t, 0.0, internal.Counters["metricsDropped"])
+}
+
+func TestEmitAndTimeWaitsForTokens(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "batching")}
+	base.emissionTimingChannel = make(chan emissionTiming, 10)
+	base.configureCommonParams(map[string]interface{}{
+		"maxDatapointsPerSecond": 20,
+		"interval":               2,
+	})
+
+	batches := 0
+	start := time.Now()
+	base.emitAndTime(getTestBatchingMetrics(30), func(metrics []metric.Metric) bool {
+		batches++
+		return true
+	})
+
+	assert.Equal(t, 2, batches)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "the second batch waits for tokens")
+	assert.Equal(t, 0.0, base.InternalMetrics().Counters["metricsThrottled"])
+}
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"sync/atomic"
+)
+
+// Content-Encodings HTTP based handlers can compress their payloads with
+const (
+	compressionNone    = ""
+	compressionGzip    = "gzip"
+	compressionDeflate = "deflate"
+)
+
+// Compression returns the Content-Encoding payloads are compressed with
+func (base *BaseHandler) Compression() string {
+	return base.compression
+}
+
+// SetCompression sets the Content-Encoding payloads are compressed with,
+// it returns false and leaves payloads uncompressed for unknown encodings
+func (base *BaseHandler) SetCompression(compression string) bool {
+	switch compression {
+	case compressionGzip, compressionDeflate:
+		base.compression = compression
+		return true
+	case compressionNone, "none":
+		base.compression = compressionNone
+		return true
+	}
+	base.compression = compressionNone
+	return false
+}
+
+// compress returns the payload compressed as configured along with the
+// Content-Encoding to send it with, empty when it is left uncompressed.
+// Sizes before and after compression are accounted for in InternalMetrics.
+func (base *BaseHandler) compress(payload []byte) ([]byte, string) {
+	encoding := base.compression
+	body := payload
+	if encoding != compressionNone {
+		compressed, err := compressPayload(encoding, payload)
+		if err != nil {
+			base.log.Warn("Failed to compress the payload, sending it uncompressed: ", err)
+			encoding = compressionNone
+		} else {
+			body = compressed
+		}
+	}
+
+	atomic.AddUint64(&base.bytesUncompressed, uint64(len(payload)))
+	atomic.AddUint64(&base.bytesSent, uint64(len(body)))
+	return body, encoding
+}
+
+// compressPayload compresses payload with gzip or deflate, which
+// as a Content-Encoding is the zlib format rather than raw deflate
+func compressPayload(encoding string, payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	if encoding == compressionGzip {
+		writer = gzip.NewWriter(&buf)
+	} else {
+		writer = zlib.NewWriter(&buf)
+	}
+
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureCompression(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "compression")}
+	assert.Equal(t, "", base.Compression())
+
+	base.configureCommonParams(map[string]interface{}{"compression": "gzip"})
+	assert.Equal(t, compressionGzip, base.Compression())
+
+	base.configureCommonParams(map[string]interface{}{"compression": "deflate"})
+	assert.Equal(t, compressionDeflate, base.Compression())
+
+	base.configureCommonParams(map[string]interface{}{"compression": "none"})
+	assert.Equal(t, "", base.Compression())
+
+	base.configureCommonParams(map[string]interface{}{"compression": "brotli"})
+	assert.Equal(t, "", base.Compression())
+}
+
+func TestCompressGzip(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "compression")}
+	base.SetCompression(compressionGzip)
+
+	payload := []byte(strings.Repeat("fullerite.metric 1.0 1234567890\n", 100))
+	body, encoding := base.compress(payload)
+	assert.Equal(t, "gzip", encoding)
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	assert.Nil(t, err)
+	decompressed, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, payload, decompressed)
+
+	internal := base.InternalMetrics()
+	assert.Equal(t, float64(len(payload)), internal.Counters["bytesUncompressed"])
+	assert.Equal(t, float64(len(body)), internal.Counters["bytesSent"])
+	assert.Equal(t, float64(len(payload))/float64(len(body)), internal.Gauges["compressionRatio"])
+	assert.True(t, internal.Gauges["compressionRatio"] > 1)
+}
+
+func TestCompressDeflate(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "compression")}
+	base.SetCompression(compressionDeflate)
+
+	payload := []byte(strings.Repeat("a", 1000))
+	body, encoding := base.compress(payload)
+	assert.Equal(t, "deflate", encoding)
+
+	reader, err := zlib.NewReader(bytes.NewReader(body))
+	assert.Nil(t, err)
+	decompressed, _ := ioutil.ReadAll(reader)
+	assert.Equal(t, payload, decompressed)
+}
+
+func TestCompressNone(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "compression")}
+
+	body, encoding := base.compress([]byte("payload"))
+	assert.Equal(t, "", encoding)
+	assert.Equal(t, []byte("payload"), body)
+
+	internal := base.InternalMetrics()
+	assert.Equal(t, 7.0, internal.Counters["bytesSent"])
+	assert.Equal(t, 1.0, internal.Gauges["compressionRatio"])
+}
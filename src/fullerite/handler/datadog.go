@@ -1,14 +1,15 @@
 package handler
 
 import (
+	"fullerite/config"
 	"fullerite/metric"
 
 	"bytes"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net"
 	"net/http"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	l "github.com/Sirupsen/logrus"
@@ -18,11 +19,37 @@ func init() {
 	RegisterHandler("Datadog", newDatadog)
 }
 
+// Metric types of the v2 series API
+const (
+	datadogTypeCount = 1
+	datadogTypeRate  = 2
+	datadogTypeGauge = 3
+)
+
 // Datadog handler
 type Datadog struct {
 	BaseHandler
 	endpoint string
 	apiKey   string
+
+	// dimension holding the host reported as resource of the series
+	hostDimension string
+
+	// counters are sent as counts, or as rates per second with "rate"
+	counterType string
+
+	// metrics whose values are sent as distribution points,
+	// like the ones carrying a distribution
+	distributions []*regexp.Regexp
+
+	// last values of the cumulative counters, sent as deltas
+	countersLock sync.Mutex
+	counters     map[string]datadogCounter
+}
+
+type datadogCounter struct {
+	value float64
+	seen  time.Time
 }
 
 type datadogPayload struct {
@@ -30,14 +57,38 @@ type datadogPayload struct {
 }
 
 type datadogMetric struct {
-	Metric     string         `json:"metric"`
-	Points     []datadogPoint `json:"points"`
-	MetricType string         `json:"type"`
-	Host       string         `json:"host"`
-	Tags       []string       `json:"tags"`
+	Metric    string            `json:"metric"`
+	Points    []datadogPoint    `json:"points"`
+	Type      int               `json:"type"`
+	Interval  int64             `json:"interval,omitempty"`
+	Resources []datadogResource `json:"resources,omitempty"`
+	Tags      []string          `json:"tags"`
 }
 
-type datadogPoint [2]float64
+type datadogPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type datadogResource struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type datadogDistributionPayload struct {
+	Series []datadogDistribution `json:"series"`
+}
+
+type datadogDistribution struct {
+	Metric string                     `json:"metric"`
+	Points []datadogDistributionPoint `json:"points"`
+	Type   string                     `json:"type"`
+	Host   string                     `json:"host,omitempty"`
+	Tags   []string                   `json:"tags"`
+}
+
+// datadogDistributionPoint is serialized as [timestamp, [values...]]
+type datadogDistributionPoint [2]interface{}
 
 // newDatadog returns a new Datadog handler
 func newDatadog(
@@ -55,6 +106,11 @@ func newDatadog(
 	inst.timeout = initialTimeout
 	inst.log = log
 	inst.channel = channel
+	inst.serializedSizeFunc = inst.payloadSize
+
+	inst.hostDimension = "host"
+	inst.counterType = "count"
+	inst.counters = make(map[string]datadogCounter)
 	return inst
 }
 
@@ -70,36 +126,142 @@ func (d *Datadog) Configure(configMap map[string]interface{}) {
 	} else {
 		d.log.Error("There was no endpoint specified for the Datadog Handler, there won't be any emissions")
 	}
+	if hostDimension, exists := configMap["hostDimension"]; exists {
+		d.hostDimension = hostDimension.(string)
+	}
+	if counterType, exists := configMap["counterType"]; exists {
+		switch counterType {
+		case "count", "rate":
+			d.counterType = counterType.(string)
+		default:
+			d.log.Warn("Unknown counterType ", counterType, ", sending counters as counts")
+		}
+	}
+	if distributions, exists := configMap["distributions"]; exists {
+		d.distributions = nil
+		for _, pattern := range config.GetAsSlice(distributions) {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				d.log.Error("Invalid distribution pattern ", pattern, ": ", err)
+				continue
+			}
+			d.distributions = append(d.distributions, re)
+		}
+	}
 	d.configureCommonParams(configMap)
 }
 
 // Endpoint returns the Datadog API endpoint
-func (d Datadog) Endpoint() string {
+func (d *Datadog) Endpoint() string {
 	return d.endpoint
 }
 
+// apiURL returns the URL of an API path, endpoints
+// may or may not include the API version
+func (d *Datadog) apiURL(version, path string) string {
+	base := strings.TrimSuffix(d.endpoint, "/")
+	base = strings.TrimSuffix(base, "/api/v1")
+	base = strings.TrimSuffix(base, "/api/v2")
+	return base + "/api/" + version + "/" + path
+}
+
 // Run runs the handler main loop
 func (d *Datadog) Run() {
 	d.run(d.emitMetrics)
 }
 
-func (d *Datadog) convertToDatadog(incomingMetric metric.Metric) (datapoint datadogMetric) {
-	dog := new(datadogMetric)
-	dog.Metric = d.Prefix() + incomingMetric.Name
-	dog.Points = makeDatadogPoints(incomingMetric)
-	dog.MetricType = incomingMetric.MetricType
+func (d *Datadog) convertToDatadog(incomingMetric metric.Metric, now time.Time) datadogMetric {
+	dog := datadogMetric{
+		Metric: d.Prefix() + incomingMetric.Name,
+		Points: []datadogPoint{{now.Unix(), incomingMetric.Value}},
+		Type:   datadogTypeGauge,
+		Tags:   d.serializedDimensions(incomingMetric),
+	}
 
-	// first check the defaults
-	if host, ok := d.DefaultDimensions()["host"]; ok {
-		dog.Host = host
-	} else if host, ok := incomingMetric.GetDimensionValue("host"); ok {
-		dog.Host = host
-	} else {
-		dog.Host = "unknown"
+	// cumulative counters are sent once converted to deltas
+	switch incomingMetric.MetricType {
+	case metric.Counter, metric.CumulativeCounter:
+		dog.Type = datadogTypeCount
+		dog.Interval = int64(d.interval)
+		if d.counterType == "rate" && d.interval > 0 {
+			dog.Type = datadogTypeRate
+			dog.Points[0].Value /= float64(d.interval)
+		}
+	}
+
+	if host := d.host(incomingMetric); host != "" {
+		dog.Resources = []datadogResource{{Name: host, Type: "host"}}
+	}
+	return dog
+}
+
+// host returns the host of a metric, the default dimensions win
+func (d *Datadog) host(m metric.Metric) string {
+	if host, ok := d.DefaultDimensions()[d.hostDimension]; ok {
+		return host
 	}
+	host, _ := m.GetDimensionValue(d.hostDimension)
+	return host
+}
+
+// payloadSize is the size of a metric in the series payload
+func (d *Datadog) payloadSize(m metric.Metric) int {
+	serialized, _ := json.Marshal(d.convertToDatadog(m, time.Now()))
+	return len(serialized) + 1
+}
 
-	dog.Tags = d.serializedDimensions(incomingMetric)
-	return *dog
+// seriesKey identifies the series of a metric
+func (d *Datadog) seriesKey(m metric.Metric) string {
+	key := m.Name
+	dimensions := m.GetDimensions(d.DefaultDimensions())
+	for _, name := range sortedKeys(dimensions) {
+		key += "," + name + "=" + dimensions[name]
+	}
+	return key
+}
+
+// toDelta turns a cumulative counter into the count since its previous
+// value, it returns false for the first value of a series. Counters that
+// went down were reset, their value is counted since the reset.
+func (d *Datadog) toDelta(m *metric.Metric, now time.Time) bool {
+	d.countersLock.Lock()
+	defer d.countersLock.Unlock()
+
+	key := d.seriesKey(*m)
+	previous, seen := d.counters[key]
+	d.counters[key] = datadogCounter{value: m.Value, seen: now}
+	if !seen {
+		return false
+	}
+	if m.Value >= previous.value {
+		m.Value -= previous.value
+	}
+	return true
+}
+
+// expireCounters forgets the counters not seen for ten intervals
+func (d *Datadog) expireCounters(now time.Time) {
+	d.countersLock.Lock()
+	defer d.countersLock.Unlock()
+
+	expiry := now.Add(-10 * time.Duration(d.interval) * time.Second)
+	for key, counter := range d.counters {
+		if counter.seen.Before(expiry) {
+			delete(d.counters, key)
+		}
+	}
+}
+
+func (d *Datadog) isDistribution(m metric.Metric) bool {
+	if len(m.Distribution) > 0 {
+		return true
+	}
+	for _, re := range d.distributions {
+		if re.MatchString(m.Name) {
+			return true
+		}
+	}
+	return false
 }
 
 func (d *Datadog) emitMetrics(metrics []metric.Metric) bool {
@@ -110,65 +272,107 @@ func (d *Datadog) emitMetrics(metrics []metric.Metric) bool {
 		return false
 	}
 
+	now := time.Now()
 	series := make([]datadogMetric, 0, len(metrics))
+	var distributions []metric.Metric
 	for _, m := range metrics {
-		series = append(series, d.convertToDatadog(m))
+		if d.isDistribution(m) {
+			distributions = append(distributions, m)
+			continue
+		}
+		if m.MetricType == metric.CumulativeCounter && !d.toDelta(&m, now) {
+			continue
+		}
+		series = append(series, d.convertToDatadog(m, now))
 	}
+	d.expireCounters(now)
 
-	p := datadogPayload{Series: series}
+	result := true
+	if len(series) > 0 {
+		result = d.post(d.apiURL("v2", "series"), datadogPayload{Series: series}, len(series))
+	}
+	if len(distributions) > 0 {
+		payload := datadogDistributionPayload{Series: d.convertToDistributions(distributions, now)}
+		result = d.post(d.apiURL("v1", "distribution_points"), payload, len(payload.Series)) && result
+	}
+	return result
+}
+
+// convertToDistributions groups the values of each series in one point
+func (d *Datadog) convertToDistributions(metrics []metric.Metric, now time.Time) []datadogDistribution {
+	var keys []string
+	values := make(map[string][]float64)
+	first := make(map[string]metric.Metric)
+	for _, m := range metrics {
+		key := d.seriesKey(m)
+		if _, exists := first[key]; !exists {
+			keys = append(keys, key)
+			first[key] = m
+		}
+		if len(m.Distribution) > 0 {
+			values[key] = append(values[key], m.Distribution...)
+		} else {
+			values[key] = append(values[key], m.Value)
+		}
+	}
+
+	distributions := make([]datadogDistribution, 0, len(keys))
+	for _, key := range keys {
+		m := first[key]
+		distributions = append(distributions, datadogDistribution{
+			Metric: d.Prefix() + m.Name,
+			Points: []datadogDistributionPoint{{now.Unix(), values[key]}},
+			Type:   "distribution",
+			Host:   d.host(m),
+			Tags:   d.serializedDimensions(m),
+		})
+	}
+	return distributions
+}
+
+func (d *Datadog) post(apiURL string, p interface{}, count int) bool {
 	payload, err := json.Marshal(p)
 	if err != nil {
 		d.log.Error("Failed marshaling datapoints to Datadog format")
-		d.log.Error("Dropping Datadog datapoints ", series)
+		d.log.Error("Dropping Datadog datapoints ", p)
 		return false
 	}
 
-	apiURL := fmt.Sprintf("%s/series?api_key=%s", d.endpoint, d.apiKey)
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(payload))
-	if err != nil {
-		d.log.Error("Failed to create a request to endpoint ", d.endpoint)
+	if d.httpClient == nil {
+		d.log.Error("The http client is not initialized, dropping ", count, " datapoints")
 		return false
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	transport := http.Transport{
-		Dial: d.dialTimeout,
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		"DD-API-KEY":   d.apiKey,
 	}
-	client := &http.Client{
-		Transport: &transport,
+	compressed, encoding := d.compress(payload)
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
 	}
-	rsp, err := client.Do(req)
+
+	rsp, err := d.httpClient.MakeRequest("POST", apiURL, bytes.NewBuffer(compressed), headers)
 	if err != nil {
 		d.log.Error("Failed to complete POST ", err)
 		return false
 	}
 
-	defer rsp.Body.Close()
 	if (rsp.StatusCode == http.StatusOK) || (rsp.StatusCode == http.StatusAccepted) {
-		d.log.Info("Successfully sent ", len(series), " datapoints to Datadog")
+		d.log.Info("Successfully sent ", count, " datapoints to Datadog")
 		return true
 	}
 
-	body, _ := ioutil.ReadAll(rsp.Body)
-	d.log.Error("Failed to post to Datadog @", d.endpoint,
-		" status was ", rsp.Status,
-		" rsp body was ", string(body),
+	d.log.Error("Failed to post to Datadog @", apiURL,
+		" status was ", rsp.StatusCode,
+		" rsp body was ", string(rsp.Body),
 		" payload was ", string(payload))
 	return false
 }
 
-func (d Datadog) dialTimeout(network, addr string) (net.Conn, error) {
-	return net.DialTimeout(network, addr, d.timeout)
-}
-
-func (d Datadog) serializedDimensions(m metric.Metric) (dimensions []string) {
+func (d *Datadog) serializedDimensions(m metric.Metric) (dimensions []string) {
 	for name, value := range m.GetDimensions(d.DefaultDimensions()) {
 		dimensions = append(dimensions, name+":"+value)
 	}
 	return dimensions
 }
-
-func makeDatadogPoints(m metric.Metric) []datadogPoint {
-	point := datadogPoint{float64(time.Now().Unix()), m.Value}
-	return []datadogPoint{point}
-}
@@ -3,6 +3,10 @@ package handler
 import (
 	"fullerite/metric"
 
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -43,3 +47,139 @@ func TestDatadogConfigure(t *testing.T) {
 	assert.Equal(t, 100, d.MaxBufferSize())
 	assert.Equal(t, "datadog.server", d.Endpoint())
 }
+
+func TestDatadogEmitMetrics(t *testing.T) {
+	var apiKey, contentType, path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey = r.Header.Get("DD-API-KEY")
+		contentType = r.Header.Get("Content-Type")
+		path = r.URL.RequestURI()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	d := getTestDataDogHandler(12, 13, 1)
+	d.Configure(map[string]interface{}{
+		"apiKey":   "secret",
+		"endpoint": ts.URL,
+	})
+
+	assert.True(t, d.emitMetrics([]metric.Metric{metric.New("first")}))
+	assert.True(t, d.emitMetrics([]metric.Metric{metric.New("second")}))
+	assert.Equal(t, "secret", apiKey)
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, "/api/v2/series", path)
+
+	internal := d.InternalMetrics()
+	assert.Equal(t, 1.0, internal.Counters["httpConnectionsCreated"])
+	assert.Equal(t, 1.0, internal.Counters["httpConnectionsReused"])
+}
+
+func TestDatadogAPIURL(t *testing.T) {
+	d := getTestDataDogHandler(12, 13, 14)
+	for _, endpoint := range []string{
+		"https://api.datadoghq.com",
+		"https://api.datadoghq.com/",
+		"https://api.datadoghq.com/api/v1",
+		"https://api.datadoghq.com/api/v2/",
+	} {
+		d.endpoint = endpoint
+		assert.Equal(t, "https://api.datadoghq.com/api/v2/series", d.apiURL("v2", "series"), endpoint)
+	}
+}
+
+func TestDatadogConvertTypes(t *testing.T) {
+	d := getTestDataDogHandler(10, 13, 14)
+	d.SetDefaultDimensions(map[string]string{"region": "uswest1"})
+	now := time.Unix(1500000000, 0)
+
+	gauge := metric.WithValue("gauge", 5)
+	gauge.AddDimension("host", "web1")
+	dog := d.convertToDatadog(gauge, now)
+	assert.Equal(t, datadogTypeGauge, dog.Type)
+	assert.Equal(t, int64(0), dog.Interval)
+	assert.Equal(t, []datadogPoint{{1500000000, 5}}, dog.Points)
+	assert.Equal(t, []datadogResource{{Name: "web1", Type: "host"}}, dog.Resources)
+	assert.Contains(t, dog.Tags, "region:uswest1")
+
+	counter := metric.WithValue("counter", 20)
+	counter.MetricType = metric.Counter
+	dog = d.convertToDatadog(counter, now)
+	assert.Equal(t, datadogTypeCount, dog.Type)
+	assert.Equal(t, int64(10), dog.Interval)
+	assert.Nil(t, dog.Resources)
+
+	d.Configure(map[string]interface{}{"counterType": "rate", "hostDimension": "region"})
+	dog = d.convertToDatadog(counter, now)
+	assert.Equal(t, datadogTypeRate, dog.Type)
+	assert.Equal(t, 2.0, dog.Points[0].Value)
+	assert.Equal(t, []datadogResource{{Name: "uswest1", Type: "host"}}, dog.Resources)
+}
+
+func TestDatadogCumulativeCounterDeltas(t *testing.T) {
+	d := getTestDataDogHandler(10, 13, 14)
+	now := time.Now()
+
+	m := metric.WithValue("cumulative", 100)
+	m.MetricType = metric.CumulativeCounter
+	assert.False(t, d.toDelta(&m, now))
+
+	m.Value = 130
+	assert.True(t, d.toDelta(&m, now))
+	assert.Equal(t, 30.0, m.Value)
+
+	// counters going down were reset
+	m.Value = 12
+	assert.True(t, d.toDelta(&m, now))
+	assert.Equal(t, 12.0, m.Value)
+
+	other := metric.WithValue("cumulative", 7)
+	other.MetricType = metric.CumulativeCounter
+	other.AddDimension("shard", "2")
+	assert.False(t, d.toDelta(&other, now))
+
+	d.expireCounters(now.Add(101 * time.Second))
+	assert.Equal(t, 0, len(d.counters))
+}
+
+func TestDatadogEmitDistributions(t *testing.T) {
+	bodies := make(map[string][]byte)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodies[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	d := getTestDataDogHandler(10, 13, 1)
+	d.Configure(map[string]interface{}{
+		"apiKey":        "secret",
+		"endpoint":      ts.URL + "/api/v1",
+		"distributions": []interface{}{"^latency"},
+	})
+
+	first := metric.WithValue("latency", 1)
+	second := metric.WithValue("latency", 3)
+	cumulative := metric.WithValue("requests", 10)
+	cumulative.MetricType = metric.CumulativeCounter
+	samples := metric.New("size")
+	samples.Distribution = []float64{4, 5}
+	assert.True(t, d.emitMetrics([]metric.Metric{first, second, cumulative, samples, metric.New("gauge")}))
+
+	var series datadogPayload
+	assert.Nil(t, json.Unmarshal(bodies["/api/v2/series"], &series))
+	assert.Equal(t, 1, len(series.Series))
+	assert.Equal(t, "gauge", series.Series[0].Metric)
+
+	var distributions struct {
+		Series []struct {
+			Metric string
+			Points [][]interface{}
+		}
+	}
+	assert.Nil(t, json.Unmarshal(bodies["/api/v1/distribution_points"], &distributions))
+	assert.Equal(t, 2, len(distributions.Series))
+	assert.Equal(t, "latency", distributions.Series[0].Metric)
+	assert.Equal(t, []interface{}{1.0, 3.0}, distributions.Series[0].Points[0][1])
+	assert.Equal(t, "size", distributions.Series[1].Metric)
+	assert.Equal(t, []interface{}{4.0, 5.0}, distributions.Series[1].Points[0][1])
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"sync"
+)
+
+// What happens to a flush when a handler already has as many
+// emissions in flight and pending as it is allowed
+const (
+	emissionPolicyBlock      = "block"
+	emissionPolicyDropOldest = "dropOldest"
+	emissionPolicyDropNewest = "dropNewest"
+)
+
+type pendingEmission struct {
+	metrics  []metric.Metric
+	emitFunc func([]metric.Metric) bool
+}
+
+// emissionQueue bounds the emissions of a handler: at most maxInFlight
+// run at once, up to maxPending more wait for their turn and the policy
+// decides what happens to flushes beyond that. Blocking pushes the back
+// pressure to the collectors, dropping rejects the newest or the oldest
+// pending flush.
+type emissionQueue struct {
+	maxInFlight int
+	maxPending  int
+	policy      string
+	run         func(pendingEmission)
+
+	lock     sync.Mutex
+	changed  *sync.Cond
+	pending  []pendingEmission
+	inFlight int
+
+	emissionsRejected uint64
+	metricsRejected   uint64
+}
+
+func newEmissionQueue(maxInFlight, maxPending int, policy string, run func(pendingEmission)) *emissionQueue {
+	q := &emissionQueue{
+		maxInFlight: maxInFlight,
+		maxPending:  maxPending,
+		policy:      policy,
+		run:         run,
+	}
+	q.changed = sync.NewCond(&q.lock)
+	return q
+}
+
+// submit starts or queues an emission, it returns the
+// emission rejected to make room if any
+func (q *emissionQueue) submit(e pendingEmission) *pendingEmission {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		if q.inFlight < q.maxInFlight {
+			q.inFlight++
+			go q.runAndNext(e)
+			return nil
+		}
+		if len(q.pending) < q.maxPending {
+			q.pending = append(q.pending, e)
+			return nil
+		}
+
+		switch q.policy {
+		case emissionPolicyBlock:
+			q.changed.Wait()
+			continue
+		case emissionPolicyDropOldest:
+			// emissions already in flight cannot be dropped
+			if len(q.pending) > 0 {
+				oldest := q.pending[0]
+				q.pending = append(q.pending[1:], e)
+				q.reject(oldest)
+				return &oldest
+			}
+		}
+		q.reject(e)
+		return &e
+	}
+}
+
+func (q *emissionQueue) reject(e pendingEmission) {
+	q.emissionsRejected++
+	q.metricsRejected += uint64(len(e.metrics))
+}
+
+// runAndNext runs emissions until none is pending
+func (q *emissionQueue) runAndNext(e pendingEmission) {
+	for {
+		q.run(e)
+
+		q.lock.Lock()
+		if len(q.pending) == 0 {
+			q.inFlight--
+			q.changed.Broadcast()
+			q.lock.Unlock()
+			return
+		}
+		e = q.pending[0]
+		q.pending = q.pending[1:]
+		q.changed.Broadcast()
+		q.lock.Unlock()
+	}
+}
+
+// addInternalMetrics adds the queue depth and rejections to a handler's metrics
+func (q *emissionQueue) addInternalMetrics(internal metric.InternalMetrics) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	internal.Gauges["emissionsInFlight"] = float64(q.inFlight)
+	internal.Gauges["emissionQueueDepth"] = float64(len(q.pending))
+	internal.Counters["emissionsRejected"] = float64(q.emissionsRejected)
+	internal.Counters["metricsRejected"] = float64(q.metricsRejected)
+}
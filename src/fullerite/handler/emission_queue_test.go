@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// getTestEmissionQueue returns a queue whose emissions run until released
+func getTestEmissionQueue(maxInFlight, maxPending int, policy string) (*emissionQueue, chan bool, chan int) {
+	release := make(chan bool)
+	ran := make(chan int, 10)
+	q := newEmissionQueue(maxInFlight, maxPending, policy, func(e pendingEmission) {
+		<-release
+		ran <- len(e.metrics)
+	})
+	return q, release, ran
+}
+
+func getTestEmission(n int) pendingEmission {
+	return pendingEmission{metrics: getTestBatchingMetrics(n)}
+}
+
+func TestEmissionQueueDropNewest(t *testing.T) {
+	q, release, ran := getTestEmissionQueue(1, 1, emissionPolicyDropNewest)
+
+	assert.Nil(t, q.submit(getTestEmission(1)))
+	assert.Nil(t, q.submit(getTestEmission(2)))
+	rejected := q.submit(getTestEmission(3))
+	assert.NotNil(t, rejected)
+	assert.Equal(t, 3, len(rejected.metrics))
+
+	internal := *metric.NewInternalMetrics()
+	q.addInternalMetrics(internal)
+	assert.Equal(t, 1.0, internal.Gauges["emissionsInFlight"])
+	assert.Equal(t, 1.0, internal.Gauges["emissionQueueDepth"])
+	assert.Equal(t, 1.0, internal.Counters["emissionsRejected"])
+	assert.Equal(t, 3.0, internal.Counters["metricsRejected"])
+
+	release <- true
+	release <- true
+	assert.Equal(t, 1, <-ran)
+	assert.Equal(t, 2, <-ran, "pending emissions run in order")
+}
+
+func TestEmissionQueueDropOldest(t *testing.T) {
+	q, release, ran := getTestEmissionQueue(1, 1, emissionPolicyDropOldest)
+
+	assert.Nil(t, q.submit(getTestEmission(1)))
+	assert.Nil(t, q.submit(getTestEmission(2)))
+	rejected := q.submit(getTestEmission(3))
+	assert.NotNil(t, rejected)
+	assert.Equal(t, 2, len(rejected.metrics))
+
+	release <- true
+	release <- true
+	assert.Equal(t, 1, <-ran)
+	assert.Equal(t, 3, <-ran)
+}
+
+func TestEmissionQueueDropOldestWithoutPending(t *testing.T) {
+	q, release, _ := getTestEmissionQueue(1, 0, emissionPolicyDropOldest)
+	defer close(release)
+
+	assert.Nil(t, q.submit(getTestEmission(1)))
+	rejected := q.submit(getTestEmission(2))
+	assert.NotNil(t, rejected, "in flight emissions cannot be dropped")
+	assert.Equal(t, 2, len(rejected.metrics))
+}
+
+func TestEmissionQueueBlock(t *testing.T) {
+	q, release, ran := getTestEmissionQueue(1, 0, emissionPolicyBlock)
+
+	assert.Nil(t, q.submit(getTestEmission(1)))
+
+	submitted := make(chan bool)
+	go func() {
+		q.submit(getTestEmission(2))
+		submitted <- true
+	}()
+
+	select {
+	case <-submitted:
+		t.Fatal("the submission should block while an emission is in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release <- true
+	assert.Equal(t, 1, <-ran)
+	<-submitted
+	release <- true
+	assert.Equal(t, 2, <-ran)
+}
+
+func TestConfigureEmissions(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "emissions")}
+	base.configureCommonParams(map[string]interface{}{})
+	assert.Nil(t, base.emissions)
+
+	base.configureCommonParams(map[string]interface{}{
+		"maxConcurrentEmissions": "2",
+		"emissionOverflowPolicy": "dropNewest",
+	})
+	assert.Equal(t, 2, base.emissions.maxInFlight)
+	assert.Equal(t, 2, base.emissions.maxPending)
+	assert.Equal(t, emissionPolicyDropNewest, base.emissions.policy)
+
+	base.configureCommonParams(map[string]interface{}{
+		"maxConcurrentEmissions": 1,
+		"maxPendingEmissions":    0,
+		"emissionOverflowPolicy": "whatever",
+	})
+	assert.Equal(t, 0, base.emissions.maxPending)
+	assert.Equal(t, emissionPolicyBlock, base.emissions.policy)
+
+	internal := base.InternalMetrics()
+	assert.Equal(t, 0.0, internal.Gauges["emissionQueueDepth"])
+	assert.Equal(t, 0.0, internal.Counters["emissionsRejected"])
+}
+
+func TestSubmitEmissionBounded(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "emissions")}
+	base.emissionTimingChannel = make(chan emissionTiming, 10)
+	base.configureCommonParams(map[string]interface{}{
+		"maxConcurrentEmissions": 1,
+		"maxPendingEmissions":    0,
+		"emissionOverflowPolicy": "dropNewest",
+	})
+
+	release := make(chan bool)
+	emitFunc := func(metrics []metric.Metric) bool {
+		<-release
+		return true
+	}
+
+	base.submitEmission(getTestBatchingMetrics(1), emitFunc)
+	base.submitEmission(getTestBatchingMetrics(5), emitFunc)
+	release <- true
+
+	internal := base.InternalMetrics()
+	assert.Equal(t, 1.0, internal.Counters["emissionsRejected"])
+	assert.Equal(t, 5.0, internal.Counters["metricsRejected"])
+}
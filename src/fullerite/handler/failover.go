@@ -0,0 +1,204 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Some sane values to default failover to
+const (
+	DefaultFailoverThreshold     = 1
+	DefaultFailoverRetryInterval = 60
+)
+
+// handlers of the same failover group, by group name
+var failoverGroups = make(map[string]*failoverGroup)
+var failoverGroupsLock sync.Mutex
+
+// failoverMember is the circuit of a handler in a failover group: it
+// opens after threshold consecutive failed emissions and stays open for
+// retryInterval, the next emission then closes it again or reopens it.
+type failoverMember struct {
+	handler  *BaseHandler
+	name     string
+	priority int
+
+	// the settings the handler was configured with
+	threshold     int
+	retryInterval time.Duration
+
+	failures  int
+	openUntil time.Time
+	active    bool
+}
+
+func (member *failoverMember) open(now time.Time, threshold int) bool {
+	return member.failures >= threshold && now.Before(member.openUntil)
+}
+
+// failoverGroup sends metrics to one handler at a time: the one with the
+// lowest priority whose circuit is closed, or the primary when all of
+// them are open. Flushes that failed are not sent to the other handlers.
+// The threshold and retryInterval of all the circuits are the primary's.
+type failoverGroup struct {
+	name          string
+	threshold     int
+	retryInterval time.Duration
+
+	lock     sync.Mutex
+	members  []*failoverMember
+	current  *failoverMember
+	switches uint64
+
+	// the last failoverElection, checked without the lock
+	elected atomic.Value
+}
+
+// failoverElection is the handler elected until a circuit may close again
+type failoverElection struct {
+	handler *BaseHandler
+	until   time.Time
+}
+
+// joinFailoverGroup makes the handler a member of the named group,
+// whatever the order handlers join in the group takes the settings
+// of its primary and warns about the members configured differently
+func (base *BaseHandler) joinFailoverGroup(name string, priority, threshold int, retryInterval time.Duration) {
+	failoverGroupsLock.Lock()
+	group, exists := failoverGroups[name]
+	if !exists {
+		group = &failoverGroup{name: name}
+		failoverGroups[name] = group
+	}
+	failoverGroupsLock.Unlock()
+
+	memberName := base.name
+	if handlerName, exists := base.log.Data["handler"]; exists {
+		memberName = fmt.Sprint(handlerName)
+	}
+
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	for _, member := range group.members {
+		if member.handler == base {
+			return
+		}
+		if member.priority == priority {
+			base.log.Warn("Handlers ", member.name, " and ", memberName, " of failover group ",
+				name, " have the same priority ", priority, ", the first to join is preferred")
+		}
+	}
+	group.members = append(group.members, &failoverMember{
+		handler:       base,
+		name:          memberName,
+		priority:      priority,
+		threshold:     threshold,
+		retryInterval: retryInterval,
+	})
+	sort.SliceStable(group.members, func(i, j int) bool {
+		return group.members[i].priority < group.members[j].priority
+	})
+
+	primary := group.members[0]
+	group.threshold = primary.threshold
+	group.retryInterval = primary.retryInterval
+	for _, member := range group.members {
+		if member.threshold != group.threshold || member.retryInterval != group.retryInterval {
+			base.log.Warn("Handler ", member.name, " of failover group ", name, " sets failoverThreshold ",
+				member.threshold, " and failoverRetryInterval ", member.retryInterval, ", the group uses the ones of ",
+				primary.name, ": ", group.threshold, " and ", group.retryInterval)
+		}
+	}
+	base.failover = group
+	group.elected.Store(failoverElection{})
+}
+
+// isActive returns true if the handler should receive metrics, the
+// group only elects again once the last election may have expired
+func (group *failoverGroup) isActive(base *BaseHandler) bool {
+	now := time.Now()
+	if election, ok := group.elected.Load().(failoverElection); ok && now.Before(election.until) {
+		return election.handler == base
+	}
+
+	group.lock.Lock()
+	defer group.lock.Unlock()
+	return group.elect(now).handler == base
+}
+
+// elect picks the member receiving metrics, switching from the current one
+func (group *failoverGroup) elect(now time.Time) *failoverMember {
+	elected := group.members[0]
+	for _, member := range group.members {
+		if !member.open(now, group.threshold) {
+			elected = member
+			break
+		}
+	}
+
+	if group.current != elected {
+		if group.current != nil {
+			group.switches++
+			group.current.active = false
+			elected.handler.log.Warn("Failover group ", group.name, " switched from ",
+				group.current.name, " to ", elected.name)
+		}
+		elected.active = true
+		group.current = elected
+	}
+
+	// the election holds until the first open circuit may close
+	until := now.Add(group.retryInterval)
+	for _, member := range group.members {
+		if member.open(now, group.threshold) && member.openUntil.Before(until) {
+			until = member.openUntil
+		}
+	}
+	group.elected.Store(failoverElection{handler: elected.handler, until: until})
+	return elected
+}
+
+// report updates the circuit of the handler with the result of an emission
+func (group *failoverGroup) report(base *BaseHandler, emissionResult bool) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	now := time.Now()
+	for _, member := range group.members {
+		if member.handler != base {
+			continue
+		}
+		if emissionResult {
+			member.failures = 0
+		} else {
+			member.failures++
+			if member.failures >= group.threshold {
+				member.openUntil = now.Add(group.retryInterval)
+			}
+		}
+	}
+	group.elect(now)
+}
+
+// addInternalMetrics adds whether the handler receives metrics and
+// how many times the group switched handlers to the handler's metrics
+func (group *failoverGroup) addInternalMetrics(base *BaseHandler, internal metric.InternalMetrics) {
+	group.lock.Lock()
+	defer group.lock.Unlock()
+
+	internal.Counters["failoverSwitches"] = float64(group.switches)
+	for _, member := range group.members {
+		if member.handler == base {
+			active := 0.0
+			if member.active {
+				active = 1.0
+			}
+			internal.Gauges["failoverActive"] = active
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestFailoverMember(name string, configMap map[string]interface{}) *BaseHandler {
+	base := &BaseHandler{name: "Test", log: l.WithField("handler", name)}
+	base.SetCollectorEndpoints(map[string]CollectorEnd{
+		"collector1": CollectorEnd{make(chan metric.Metric, 10), 10},
+	})
+	base.configureCommonParams(configMap)
+	return base
+}
+
+func TestConfigureFailover(t *testing.T) {
+	primary := getTestFailoverMember("Test primary", map[string]interface{}{
+		"failoverGroup":         "configure",
+		"failoverThreshold":     "3",
+		"failoverRetryInterval": 5,
+	})
+	secondary := getTestFailoverMember("Test secondary", map[string]interface{}{
+		"failoverGroup":    "configure",
+		"failoverPriority": 1,
+	})
+	alone := getTestFailoverMember("Test alone", map[string]interface{}{})
+
+	assert.Nil(t, alone.failover)
+	assert.Equal(t, primary.failover, secondary.failover)
+	assert.Equal(t, 3, primary.failover.threshold)
+	assert.Equal(t, 5*time.Second, primary.failover.retryInterval)
+	assert.Equal(t, 2, len(primary.failover.members))
+	assert.Equal(t, "Test primary", primary.failover.members[0].name)
+	assert.Equal(t, "Test secondary", primary.failover.members[1].name)
+}
+
+func TestFailoverSettingsAreThePrimarys(t *testing.T) {
+	secondary := getTestFailoverMember("Test secondary", map[string]interface{}{
+		"failoverGroup":         "settings",
+		"failoverPriority":      1,
+		"failoverThreshold":     5,
+		"failoverRetryInterval": 30,
+	})
+	primary := getTestFailoverMember("Test primary", map[string]interface{}{
+		"failoverGroup":     "settings",
+		"failoverThreshold": 2,
+	})
+
+	assert.Equal(t, primary.failover, secondary.failover)
+	assert.Equal(t, 2, primary.failover.threshold)
+	assert.Equal(t, time.Duration(DefaultFailoverRetryInterval)*time.Second, primary.failover.retryInterval)
+}
+
+func TestFailoverOnFailedEmission(t *testing.T) {
+	// the secondary joins first but has a lower priority
+	secondary := getTestFailoverMember("Test secondary", map[string]interface{}{
+		"failoverGroup":    "emission",
+		"failoverPriority": 1,
+	})
+	primary := getTestFailoverMember("Test primary", map[string]interface{}{
+		"failoverGroup":         "emission",
+		"failoverPriority":      0,
+		"failoverRetryInterval": 1,
+	})
+
+	assert.True(t, primary.Enqueue("collector1", metric.New("m1")))
+	assert.False(t, secondary.Enqueue("collector1", metric.New("m1")))
+
+	primary.failover.report(primary, false)
+	assert.False(t, primary.Enqueue("collector1", metric.New("m2")))
+	assert.True(t, secondary.Enqueue("collector1", metric.New("m2")))
+
+	primaryMetrics := primary.InternalMetrics()
+	secondaryMetrics := secondary.InternalMetrics()
+	assert.Equal(t, 1.0, primaryMetrics.Counters["failoverSwitches"])
+	assert.Equal(t, 0.0, primaryMetrics.Gauges["failoverActive"])
+	assert.Equal(t, 1.0, secondaryMetrics.Counters["failoverSwitches"])
+	assert.Equal(t, 1.0, secondaryMetrics.Gauges["failoverActive"])
+
+	// metrics go back to the primary once its circuit may close again
+	primary.failover.members[0].openUntil = time.Now()
+	primary.failover.elected.Store(failoverElection{until: time.Now()})
+	assert.True(t, primary.Enqueue("collector1", metric.New("m3")))
+	assert.False(t, secondary.Enqueue("collector1", metric.New("m3")))
+	assert.Equal(t, 2.0, primary.InternalMetrics().Counters["failoverSwitches"])
+
+	primary.failover.report(primary, true)
+	assert.Equal(t, 0, primary.failover.members[0].failures)
+}
+
+func TestFailoverThreshold(t *testing.T) {
+	primary := getTestFailoverMember("Test primary", map[string]interface{}{
+		"failoverGroup":     "threshold",
+		"failoverThreshold": 2,
+	})
+	secondary := getTestFailoverMember("Test secondary", map[string]interface{}{
+		"failoverGroup":    "threshold",
+		"failoverPriority": 1,
+	})
+
+	primary.failover.report(primary, false)
+	assert.True(t, primary.failover.isActive(primary))
+
+	primary.failover.report(primary, true)
+	primary.failover.report(primary, false)
+	assert.True(t, primary.failover.isActive(primary))
+
+	primary.failover.report(primary, false)
+	assert.True(t, primary.failover.isActive(secondary))
+}
+
+func TestFailoverAllCircuitsOpen(t *testing.T) {
+	primary := getTestFailoverMember("Test primary", map[string]interface{}{
+		"failoverGroup": "all-open",
+	})
+	secondary := getTestFailoverMember("Test secondary", map[string]interface{}{
+		"failoverGroup":    "all-open",
+		"failoverPriority": 1,
+	})
+
+	assert.True(t, primary.failover.isActive(primary))
+	primary.failover.report(primary, false)
+	assert.True(t, primary.failover.isActive(secondary))
+
+	primary.failover.report(secondary, false)
+	assert.True(t, primary.failover.isActive(primary))
+	assert.Equal(t, 2.0, secondary.InternalMetrics().Counters["failoverSwitches"])
+}
+
+func TestFailoverReportedEmissions(t *testing.T) {
+	primary := getTestFailoverMember("Test primary", map[string]interface{}{
+		"failoverGroup": "reported",
+	})
+	secondary := getTestFailoverMember("Test secondary", map[string]interface{}{
+		"failoverGroup":    "reported",
+		"failoverPriority": 1,
+	})
+	primary.emissionTimingChannel = make(chan emissionTiming, 1)
+
+	primary.emitBatchAndTime([]metric.Metric{metric.New("m1")}, func([]metric.Metric) bool {
+		return false
+	})
+	assert.True(t, primary.failover.isActive(secondary))
+}
+
+func TestFailoverChannelMetrics(t *testing.T) {
+	primary := getTestFailoverMember("Test primary", map[string]interface{}{
+		"failoverGroup": "channel",
+	})
+	secondary := getTestFailoverMember("Test secondary", map[string]interface{}{
+		"failoverGroup":    "channel",
+		"failoverPriority": 1,
+	})
+
+	emitted := make(chan string, 2)
+	for _, member := range []*BaseHandler{primary, secondary} {
+		member.channel = make(chan metric.Metric)
+		member.interval = 10
+		member.emissionTimingChannel = make(chan emissionTiming, 2)
+		go member.listenForMetrics(func(metrics []metric.Metric) bool {
+			for _, m := range metrics {
+				emitted <- m.Name
+			}
+			return true
+		}, CollectorEnd{member.Channel(), 1}, "")
+	}
+
+	// the internal metrics are written to Channel() of every handler
+	secondary.Channel() <- metric.New("secondary")
+	primary.Channel() <- metric.New("primary")
+	close(secondary.channel)
+	close(primary.channel)
+
+	select {
+	case name := <-emitted:
+		assert.Equal(t, "primary", name)
+	case <-time.After(2 * time.Second):
+		t.Fatal("The active handler did not emit")
+	}
+	select {
+	case name := <-emitted:
+		t.Fatal("The inactive handler emitted ", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterHandler("File", newFile)
+}
+
+const (
+	defaultFilePath            = "/var/log/fullerite/metrics.log"
+	defaultFileFormat          = "ndjson"
+	defaultFileMaxRotatedFiles = 5
+)
+
+var influxMeasurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+var influxTagEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+
+// File handler writes metrics to a local file which is rotated by size
+// and/or age. Each line is either a JSON document (ndjson), a graphite
+// plaintext datapoint (graphite) or an influx line protocol point (influx).
+type File struct {
+	BaseHandler
+	path            string
+	format          string
+	maxFileSizeMB   int
+	rotateInterval  int
+	maxRotatedFiles int
+	compressRotated bool
+
+	writer io.WriteCloser
+}
+
+// newFile returns a new File handler.
+func newFile(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(File)
+	inst.name = "File"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.log = log
+	inst.channel = channel
+
+	inst.path = defaultFilePath
+	inst.format = defaultFileFormat
+	inst.maxRotatedFiles = defaultFileMaxRotatedFiles
+
+	return inst
+}
+
+// Configure accepts the different configuration options for the File handler
+func (f *File) Configure(configMap map[string]interface{}) {
+	if path, exists := configMap["path"]; exists {
+		f.path = path.(string)
+	}
+
+	if format, exists := configMap["format"]; exists {
+		switch format {
+		case "ndjson", "graphite", "influx":
+			f.format = format.(string)
+		default:
+			f.log.Warn("Unknown format ", format, ", using ", defaultFileFormat)
+		}
+	}
+
+	if maxFileSize, exists := configMap["maxFileSizeMB"]; exists {
+		f.maxFileSizeMB = config.GetAsInt(maxFileSize, 0)
+	}
+
+	if rotateInterval, exists := configMap["rotateInterval"]; exists {
+		f.rotateInterval = config.GetAsInt(rotateInterval, 0)
+	}
+
+	if maxRotatedFiles, exists := configMap["maxRotatedFiles"]; exists {
+		f.maxRotatedFiles = config.GetAsInt(maxRotatedFiles, defaultFileMaxRotatedFiles)
+	}
+
+	if compressRotated, exists := configMap["compressRotated"]; exists {
+		f.compressRotated = config.GetAsBool(compressRotated, false)
+	}
+
+	f.configureCommonParams(configMap)
+
+	f.writer = util.NewRotatingFile(
+		f.path,
+		int64(f.maxFileSizeMB)*1024*1024,
+		time.Duration(f.rotateInterval)*time.Second,
+		f.maxRotatedFiles,
+		f.compressRotated,
+	)
+}
+
+// Path returns the path of the file metrics are written to
+func (f File) Path() string {
+	return f.path
+}
+
+// Format returns the format of the lines written to the file
+func (f File) Format() string {
+	return f.format
+}
+
+// Run runs the handler main loop
+func (f *File) Run() {
+	f.run(f.emitMetrics)
+}
+
+func (f *File) emitMetrics(metrics []metric.Metric) bool {
+	f.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if len(metrics) == 0 {
+		f.log.Warn("Skipping send because of an empty payload")
+		return false
+	}
+
+	if f.writer == nil {
+		f.log.Error("The File handler was not configured, skipping write")
+		return false
+	}
+
+	now := time.Now()
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		line, err := f.convertToLine(m, now)
+		if err != nil {
+			f.log.Error(fmt.Sprintf("Cannot convert metric %s: %s", m.Name, err))
+			continue
+		}
+		buf.WriteString(line)
+	}
+
+	// the whole batch is written at once so that concurrent
+	// emissions never interleave and a batch is never split
+	// across two rotated files
+	if _, err := f.writer.Write(buf.Bytes()); err != nil {
+		f.log.Error("Failed to write metrics to ", f.path, ": ", err)
+		return false
+	}
+	return true
+}
+
+func (f File) convertToLine(m metric.Metric, now time.Time) (string, error) {
+	switch f.format {
+	case "graphite":
+		path := graphitePath(f.Prefix(), m, f.DefaultDimensions())
+		return graphiteLine(path, m.Value, now.Unix()), nil
+	case "influx":
+		return f.convertToInflux(m, now), nil
+	}
+
+	sm := newScribeMetric(m, f.DefaultDimensions())
+	sm.Name = f.Prefix() + sm.Name
+	sm.Timestamp = now.Unix()
+	jsonOut, err := json.Marshal(sm)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonOut) + "\n", nil
+}
+
+// convertToInflux formats a metric following the influx line protocol,
+// the value is stored in the "value" field
+func (f File) convertToInflux(m metric.Metric, now time.Time) string {
+	line := influxMeasurementEscaper.Replace(f.Prefix() + m.Name)
+
+	dimensions := m.GetDimensions(f.DefaultDimensions())
+	for _, key := range sortedKeys(dimensions) {
+		if key == "" || dimensions[key] == "" {
+			continue
+		}
+		line += fmt.Sprintf(",%s=%s",
+			influxTagEscaper.Replace(key), influxTagEscaper.Replace(dimensions[key]))
+	}
+
+	return fmt.Sprintf("%s value=%v %d\n", line, m.Value, now.UnixNano())
+}
@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestFileHandler(interval, buffsize, timeoutsec int) *File {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "file_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newFile(testChannel, interval, buffsize, timeout, testLog).(*File)
+}
+
+func TestFileConfigureEmptyConfig(t *testing.T) {
+	config := make(map[string]interface{})
+
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(config)
+
+	assert.Equal(t, 12, f.Interval())
+	assert.Equal(t, 13, f.MaxBufferSize())
+	assert.Equal(t, defaultFilePath, f.Path())
+	assert.Equal(t, defaultFileFormat, f.Format())
+	assert.Equal(t, defaultFileMaxRotatedFiles, f.maxRotatedFiles)
+	assert.False(t, f.compressRotated)
+}
+
+func TestFileConfigure(t *testing.T) {
+	config := map[string]interface{}{
+		"interval":        "10",
+		"max_buffer_size": "100",
+		"path":            "/tmp/fullerite.metrics",
+		"format":          "influx",
+		"maxFileSizeMB":   "64",
+		"rotateInterval":  3600,
+		"maxRotatedFiles": 2,
+		"compressRotated": true,
+	}
+
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(config)
+
+	assert.Equal(t, 10, f.Interval())
+	assert.Equal(t, 100, f.MaxBufferSize())
+	assert.Equal(t, "/tmp/fullerite.metrics", f.Path())
+	assert.Equal(t, "influx", f.Format())
+	assert.Equal(t, 64, f.maxFileSizeMB)
+	assert.Equal(t, 3600, f.rotateInterval)
+	assert.Equal(t, 2, f.maxRotatedFiles)
+	assert.True(t, f.compressRotated)
+}
+
+func TestFileConfigureUnknownFormat(t *testing.T) {
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{"format": "csv"})
+
+	assert.Equal(t, defaultFileFormat, f.Format())
+}
+
+func TestFileConvertToGraphite(t *testing.T) {
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{
+		"format":            "graphite",
+		"defaultDimensions": map[string]string{"host": "myhost"},
+	})
+	f.SetPrefix("prefix.")
+
+	m := metric.New("test")
+	m.Value = 1.5
+	m.AddDimension("a", "b")
+
+	line, err := f.convertToLine(m, time.Unix(1234, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, "prefix.test.a.b.host.myhost 1.500000 1234\n", line)
+}
+
+func TestFileConvertToInflux(t *testing.T) {
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{
+		"format": "influx",
+	})
+
+	m := metric.New("cpu usage")
+	m.Value = 42
+	m.AddDimension("host", "my host")
+	m.AddDimension("tag", "a,b=c")
+
+	line, err := f.convertToLine(m, time.Unix(1, 5))
+	assert.Nil(t, err)
+	assert.Equal(t, "cpu\\ usage,host=my\\ host,tag=a\\,b\\=c value=42 1000000005\n", line)
+}
+
+func TestFileConvertToNDJSON(t *testing.T) {
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{})
+	f.SetPrefix("prefix.")
+
+	m := metric.New("test")
+	m.MetricType = metric.Counter
+	m.Value = 3
+	m.AddDimension("a", "b")
+
+	line, err := f.convertToLine(m, time.Unix(1234, 0))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(line, "\n"))
+
+	var sm scribeMetric
+	assert.Nil(t, json.Unmarshal([]byte(line), &sm))
+	assert.Equal(t, "prefix.test", sm.Name)
+	assert.Equal(t, metric.Counter, sm.MetricType)
+	assert.Equal(t, 3.0, sm.Value)
+	assert.Equal(t, int64(1234), sm.Timestamp)
+	assert.Equal(t, map[string]string{"a": "b"}, sm.Dimensions)
+}
+
+func TestFileEmitMetrics(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file_handler")
+	defer os.RemoveAll(dir)
+
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{
+		"path":   path.Join(dir, "metrics.log"),
+		"format": "graphite",
+	})
+
+	assert.False(t, f.emitMetrics([]metric.Metric{}))
+	assert.True(t, f.emitMetrics([]metric.Metric{metric.New("one"), metric.New("two")}))
+	assert.Nil(t, f.writer.Close())
+
+	content, err := ioutil.ReadFile(f.Path())
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.True(t, strings.HasPrefix(lines[0], "one 0.000000 "))
+	assert.True(t, strings.HasPrefix(lines[1], "two 0.000000 "))
+}
+
+func TestFileEmitMetricsWriteFailure(t *testing.T) {
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{
+		"path": "/dev/null/metrics.log",
+	})
+
+	assert.False(t, f.emitMetrics([]metric.Metric{metric.New("one")}))
+}
@@ -1,11 +1,17 @@
 package handler
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"fullerite/config"
 	"fullerite/metric"
 	"fullerite/util"
+	"math"
 	"net"
+	"regexp"
 	"sort"
+	"strings"
 	"time"
 
 	l "github.com/Sirupsen/logrus"
@@ -15,11 +21,49 @@ func init() {
 	RegisterHandler("Graphite", newGraphite)
 }
 
+const (
+	graphiteProtocolPlaintext = "plaintext"
+	graphiteProtocolPickle    = "pickle"
+	graphiteProtocolUDP       = "udp"
+
+	// keeps datagrams below the usual ethernet MTU
+	graphiteMaxDatagramSize = 1400
+
+	graphitePathFlat     = "flat"
+	graphitePathTagged   = "tagged"
+	graphitePathTemplate = "template"
+
+	// replaces the template placeholders of dimensions a metric doesn't have
+	graphiteMissingDimension = "unknown"
+)
+
+// graphiteTemplatePlaceholder matches the {dimension} placeholders of path templates
+var graphiteTemplatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// graphiteTagSanitizer removes the characters graphite doesn't allow in tags
+var graphiteTagSanitizer = strings.NewReplacer(";", "_", "!", "_", "^", "_", "=", "-", "~", "_")
+
 // Graphite type
 type Graphite struct {
 	BaseHandler
-	server string
-	port   string
+	server       string
+	port         string
+	protocol     string
+	pathFormat   string
+	pathTemplate string
+
+	// host:port[:instance] of the carbon daemons series are sharded across
+	destinations  []string
+	retryInterval int
+
+	shards *shards
+	pools  map[string]*util.ConnPool
+}
+
+type graphiteDatapoint struct {
+	path      string
+	value     float64
+	timestamp int64
 }
 
 // allowedPunctation: taken here https://github.com/dropwizard/metrics/issues/637
@@ -42,6 +86,10 @@ func newGraphite(
 	inst.log = log
 	inst.channel = channel
 
+	inst.protocol = graphiteProtocolPlaintext
+	inst.pathFormat = graphitePathFlat
+	inst.retryInterval = defaultDestinationRetryInterval
+
 	return inst
 }
 
@@ -55,20 +103,135 @@ func (g Graphite) Port() string {
 	return g.port
 }
 
+// Protocol returns the protocol used to send metrics, plaintext, pickle or udp
+func (g Graphite) Protocol() string {
+	return g.protocol
+}
+
+// PathFormat returns how metric paths are built, flat, tagged or template
+func (g Graphite) PathFormat() string {
+	return g.pathFormat
+}
+
+// Destinations returns the carbon daemons metrics are sharded across
+func (g Graphite) Destinations() []string {
+	return g.destinations
+}
+
 // Configure accepts the different configuration options for the Graphite handler
 func (g *Graphite) Configure(configMap map[string]interface{}) {
-	if server, exists := configMap["server"]; exists {
-		g.server = server.(string)
+	if destinations, exists := configMap["destinations"]; exists {
+		g.destinations = config.GetAsSlice(destinations)
 	} else {
-		g.log.Error("There was no server specified for the Graphite Handler, there won't be any emissions")
+		if server, exists := configMap["server"]; exists {
+			g.server = server.(string)
+		} else {
+			g.log.Error("There was no server specified for the Graphite Handler, there won't be any emissions")
+		}
+
+		if port, exists := configMap["port"]; exists {
+			g.port = fmt.Sprint(port)
+		} else {
+			g.log.Error("There was no port specified for the Graphite Handler, there won't be any emissions")
+		}
+
+		if g.server != "" && g.port != "" {
+			g.destinations = []string{net.JoinHostPort(g.server, g.port)}
+		}
 	}
 
-	if port, exists := configMap["port"]; exists {
-		g.port = fmt.Sprint(port)
-	} else {
-		g.log.Error("There was no port specified for the Graphite Handler, there won't be any emissions")
+	if retryInterval, exists := configMap["destinationRetryInterval"]; exists {
+		g.retryInterval = config.GetAsInt(retryInterval, defaultDestinationRetryInterval)
+	}
+
+	if protocol, exists := configMap["protocol"]; exists {
+		switch protocol {
+		case graphiteProtocolPlaintext, graphiteProtocolPickle, graphiteProtocolUDP:
+			g.protocol = protocol.(string)
+		default:
+			g.log.Warn("Unknown protocol ", protocol, ", using ", graphiteProtocolPlaintext)
+		}
+	}
+
+	if pathTemplate, exists := configMap["pathTemplate"]; exists {
+		g.pathTemplate = pathTemplate.(string)
+		g.pathFormat = graphitePathTemplate
+	}
+
+	if pathFormat, exists := configMap["pathFormat"]; exists {
+		switch pathFormat {
+		case graphitePathFlat, graphitePathTagged, graphitePathTemplate:
+			g.pathFormat = pathFormat.(string)
+		default:
+			g.log.Warn("Unknown pathFormat ", pathFormat, ", using ", graphitePathFlat)
+		}
+	}
+
+	if g.pathFormat == graphitePathTemplate && g.pathTemplate == "" {
+		g.log.Error("There was no pathTemplate specified for the Graphite Handler, using ", graphitePathFlat, " paths")
+		g.pathFormat = graphitePathFlat
 	}
 	g.configureCommonParams(configMap)
+	g.configureDestinations()
+}
+
+// configureDestinations sets up a connection pool per destination and the
+// ring series are sharded with, which places destinations the way carbon
+// relays do: they are identified by their (host, instance) tuple.
+func (g *Graphite) configureDestinations() {
+	network := "tcp"
+	if g.protocol == graphiteProtocolUDP {
+		network = "udp"
+	}
+
+	if network == "udp" && g.tlsConfig != nil {
+		g.log.Warn("TLS is not supported over udp, sending plaintext datagrams")
+	}
+
+	var addrs, ringKeys []string
+	g.pools = make(map[string]*util.ConnPool)
+	for _, dest := range g.destinations {
+		host, port, instance, err := parseGraphiteDestination(dest)
+		if err != nil {
+			g.log.Error("Ignoring invalid Graphite destination ", dest, ": ", err)
+			continue
+		}
+
+		addr := net.JoinHostPort(host, port)
+		instanceKey := "None"
+		if instance != "" {
+			instanceKey = fmt.Sprintf("'%s'", instance)
+		}
+		addrs = append(addrs, addr)
+		ringKeys = append(ringKeys, fmt.Sprintf("('%s', %s)", host, instanceKey))
+		g.pools[addr] = util.NewConnPool(network, addr, g.MaxIdleConnectionsPerHost(), g.timeout)
+		if network == "tcp" {
+			g.pools[addr].SetTLSConfig(g.tlsConfig)
+		}
+	}
+
+	g.shards = nil
+	if len(addrs) > 0 {
+		g.shards = newShards(addrs, ringKeys, time.Duration(g.retryInterval)*time.Second)
+	}
+}
+
+// parseGraphiteDestination splits host:port[:instance] destinations
+func parseGraphiteDestination(dest string) (host, port, instance string, err error) {
+	if parts := strings.Split(dest, ":"); len(parts) == 3 {
+		return parts[0], parts[1], parts[2], nil
+	}
+	host, port, err = net.SplitHostPort(dest)
+	return host, port, "", err
+}
+
+// InternalMetrics adds the per destination counters to the handler metrics
+func (g *Graphite) InternalMetrics() metric.InternalMetrics {
+	internal := g.BaseHandler.InternalMetrics()
+	if g.shards != nil {
+		g.shards.addInternalMetrics(internal)
+	}
+	return internal
 }
 
 // Run runs the handler main loop
@@ -77,25 +240,78 @@ func (g *Graphite) Run() {
 }
 
 func (g Graphite) convertToGraphite(incomingMetric metric.Metric) (datapoint string) {
+	return graphiteLine(g.path(incomingMetric), incomingMetric.Value, time.Now().Unix())
+}
+
+func (g Graphite) path(incomingMetric metric.Metric) string {
+	switch g.pathFormat {
+	case graphitePathTagged:
+		return graphiteTaggedPath(g.Prefix(), incomingMetric, g.DefaultDimensions())
+	case graphitePathTemplate:
+		return graphiteTemplatePath(g.Prefix(), g.pathTemplate, incomingMetric, g.DefaultDimensions())
+	}
+	return graphitePath(g.Prefix(), incomingMetric, g.DefaultDimensions())
+}
+
+// graphiteLine formats a datapoint following the graphite plaintext protocol
+func graphiteLine(path string, value float64, timestamp int64) string {
+	return fmt.Sprintf("%s %f %d\n", path, value, timestamp)
+}
+
+// graphitePath flattens the dimensions in the path as .key.value segments
+func graphitePath(prefix string, incomingMetric metric.Metric, defaultDimensions map[string]string) (path string) {
 	//orders dimensions so datapoint keeps consistent name
 	var keys []string
-	dimensions := g.getSanitizedDimensions(incomingMetric)
+	dimensions := graphiteSanitizedDimensions(incomingMetric, defaultDimensions)
 	for k := range dimensions {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
 
-	datapoint = g.Prefix() + graphiteSanitize(incomingMetric.Name)
+	path = prefix + graphiteSanitize(incomingMetric.Name)
 	for _, key := range keys {
-		datapoint = fmt.Sprintf("%s.%s.%s", datapoint, key, dimensions[key])
+		path = fmt.Sprintf("%s.%s.%s", path, key, dimensions[key])
+	}
+	return path
+}
+
+// graphiteTaggedPath builds a graphite 1.1 tagged series, name;key=value;...
+// the dimensions with an empty value are left out
+func graphiteTaggedPath(prefix string, incomingMetric metric.Metric, defaultDimensions map[string]string) string {
+	path := prefix + strings.Replace(graphiteSanitize(incomingMetric.Name), ";", "_", -1)
+
+	dimensions := incomingMetric.GetDimensions(defaultDimensions)
+	for _, key := range sortedKeys(dimensions) {
+		if strings.TrimSpace(dimensions[key]) == "" {
+			continue
+		}
+		tagKey := graphiteTagSanitizer.Replace(graphiteSanitize(key))
+		tagValue := graphiteTagSanitizer.Replace(graphiteSanitize(dimensions[key]))
+		path = fmt.Sprintf("%s;%s=%s", path, tagKey, tagValue)
 	}
-	datapoint = fmt.Sprintf("%s %f %d\n", datapoint, incomingMetric.Value, time.Now().Unix())
-	return datapoint
+	return path
 }
 
-func (g Graphite) getSanitizedDimensions(incomingMetric metric.Metric) map[string]string {
+// graphiteTemplatePath fills a path template such as servers.{host}.{name},
+// only the dimensions the template refers to end up in the path
+func graphiteTemplatePath(prefix, template string, incomingMetric metric.Metric, defaultDimensions map[string]string) string {
+	dimensions := incomingMetric.GetDimensions(defaultDimensions)
+	path := graphiteTemplatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		key := placeholder[1 : len(placeholder)-1]
+		if key == "name" {
+			return graphiteSanitize(incomingMetric.Name)
+		}
+		if value, exists := dimensions[key]; exists && value != "" {
+			return graphiteSanitize(value)
+		}
+		return graphiteMissingDimension
+	})
+	return prefix + path
+}
+
+func graphiteSanitizedDimensions(incomingMetric metric.Metric, defaultDimensions map[string]string) map[string]string {
 	dimSanitized := make(map[string]string)
-	dimensions := incomingMetric.GetDimensions(g.DefaultDimensions())
+	dimensions := incomingMetric.GetDimensions(defaultDimensions)
 	for key, value := range dimensions {
 		dimSanitized[graphiteSanitize(key)] = graphiteSanitize(value)
 	}
@@ -110,17 +326,119 @@ func (g *Graphite) emitMetrics(metrics []metric.Metric) bool {
 		return false
 	}
 
-	addr := fmt.Sprintf("%s:%s", g.server, g.port)
-	conn, err := net.DialTimeout("tcp", addr, g.timeout)
-	if err != nil {
-		g.log.Error("Failed to connect ", addr)
+	if g.shards == nil {
+		g.log.Error("There is no Graphite server to send to, dropping ", len(metrics), " metrics")
 		return false
 	}
 
+	timestamp := time.Now().Unix()
+	return g.shards.emit(metrics, g.path, func(addr string, metrics []metric.Metric) bool {
+		if err := g.send(g.pools[addr], g.serialize(metrics, timestamp)); err != nil {
+			g.log.Error("Failed to send ", len(metrics), " metrics to ", addr, ": ", err)
+			return false
+		}
+		g.log.Info("Successfully sent ", len(metrics), " datapoints to Graphite @", addr)
+		return true
+	})
+}
+
+// serialize returns the payloads to write for a batch of metrics, a single
+// one for TCP and as many datagrams as needed for UDP
+func (g Graphite) serialize(metrics []metric.Metric, timestamp int64) [][]byte {
+	if g.protocol == graphiteProtocolPickle {
+		datapoints := make([]graphiteDatapoint, 0, len(metrics))
+		for _, m := range metrics {
+			datapoints = append(datapoints, graphiteDatapoint{
+				path:      g.path(m),
+				value:     m.Value,
+				timestamp: timestamp,
+			})
+		}
+		return [][]byte{graphitePickle(datapoints)}
+	}
+
+	var payloads [][]byte
+	var buf bytes.Buffer
 	for _, m := range metrics {
-		fmt.Fprintf(conn, g.convertToGraphite(m))
+		line := graphiteLine(g.path(m), m.Value, timestamp)
+		if g.protocol == graphiteProtocolUDP && buf.Len() > 0 && buf.Len()+len(line) > graphiteMaxDatagramSize {
+			payloads = append(payloads, buf.Bytes())
+			buf = bytes.Buffer{}
+		}
+		buf.WriteString(line)
+	}
+	return append(payloads, buf.Bytes())
+}
+
+// send writes the payloads on a pooled connection. Idle connections may
+// have been closed by the server since their last use, so a failed write
+// is retried once on a new connection before giving up.
+func (g *Graphite) send(pool *util.ConnPool, payloads [][]byte) error {
+	conn, err := pool.Get()
+	if err != nil {
+		return err
+	}
+
+	if err = g.write(conn, payloads); err != nil {
+		conn.Close()
+		g.log.Warn("Failed to write to ", pool.Addr(), ", reconnecting: ", err)
+
+		if conn, err = pool.Dial(); err != nil {
+			return err
+		}
+		if err = g.write(conn, payloads); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	pool.Put(conn)
+	return nil
+}
+
+func (g Graphite) write(conn net.Conn, payloads [][]byte) error {
+	conn.SetWriteDeadline(time.Now().Add(g.timeout))
+	for _, payload := range payloads {
+		if _, err := conn.Write(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// graphitePickle serializes datapoints the way carbon's pickle receiver
+// expects them: a protocol 2 pickle of [(path, (timestamp, value)), ...]
+// prefixed by its length as a big endian uint32
+func graphitePickle(datapoints []graphiteDatapoint) []byte {
+	var pickle bytes.Buffer
+	pickle.Write([]byte{0x80, 2}) // PROTO 2
+	pickle.WriteByte(']')         // EMPTY_LIST
+	pickle.WriteByte('(')         // MARK
+	for _, dp := range datapoints {
+		pickle.WriteByte('X') // BINUNICODE
+		binary.Write(&pickle, binary.LittleEndian, uint32(len(dp.path)))
+		pickle.WriteString(dp.path)
+
+		if dp.timestamp >= math.MinInt32 && dp.timestamp <= math.MaxInt32 {
+			pickle.WriteByte('J') // BININT
+			binary.Write(&pickle, binary.LittleEndian, int32(dp.timestamp))
+		} else {
+			pickle.Write([]byte{0x8a, 8}) // LONG1
+			binary.Write(&pickle, binary.LittleEndian, dp.timestamp)
+		}
+
+		pickle.WriteByte('G') // BINFLOAT
+		binary.Write(&pickle, binary.BigEndian, dp.value)
+
+		pickle.WriteByte(0x86) // TUPLE2 (timestamp, value)
+		pickle.WriteByte(0x86) // TUPLE2 (path, (timestamp, value))
 	}
-	return true
+	pickle.WriteByte('e') // APPENDS
+	pickle.WriteByte('.') // STOP
+
+	payload := make([]byte, 4, 4+pickle.Len())
+	binary.BigEndian.PutUint32(payload, uint32(pickle.Len()))
+	return append(payload, pickle.Bytes()...)
 }
 
 func graphiteSanitize(value string) string {
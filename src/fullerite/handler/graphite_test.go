@@ -3,6 +3,8 @@ package handler
 import (
 	"fullerite/metric"
 
+	"bufio"
+	"net"
 	"strings"
 	"testing"
 	"time"
@@ -90,3 +92,286 @@ func TestGraphiteSanitation(t *testing.T) {
 
 	assert.Equal(t, strings.Split(datapoint1, " ")[0], datapoint2, "the two metrics should be the same")
 }
+
+func TestGraphiteConfigureProtocol(t *testing.T) {
+	g := getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{})
+	assert.Equal(t, graphiteProtocolPlaintext, g.Protocol())
+	assert.Nil(t, g.shards, "there are no shards without a server")
+
+	g.Configure(map[string]interface{}{
+		"server":   "test_server",
+		"port":     "2004",
+		"protocol": "pickle",
+	})
+	assert.Equal(t, graphiteProtocolPickle, g.Protocol())
+	assert.Equal(t, []string{"test_server:2004"}, g.Destinations())
+	assert.Equal(t, "test_server:2004", g.pools["test_server:2004"].Addr())
+
+	g.Configure(map[string]interface{}{"protocol": "carrier-pigeon"})
+	assert.Equal(t, graphiteProtocolPickle, g.Protocol())
+}
+
+func TestGraphitePickle(t *testing.T) {
+	payload := graphitePickle([]graphiteDatapoint{
+		{path: "a.b", value: 1.5, timestamp: 1},
+	})
+
+	expected := []byte{
+		0x80, 0x02, ']', '(',
+		'X', 0x03, 0x00, 0x00, 0x00, 'a', '.', 'b',
+		'J', 0x01, 0x00, 0x00, 0x00,
+		'G', 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x86, 0x86, 'e', '.',
+	}
+	assert.Equal(t, append([]byte{0, 0, 0, byte(len(expected))}, expected...), payload)
+}
+
+func TestGraphiteSerializeUDPDatagrams(t *testing.T) {
+	g := getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{"protocol": "udp"})
+
+	metrics := make([]metric.Metric, 0, 100)
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, metric.New("some.rather.long.metric.name.to.fill.datagrams"))
+	}
+
+	payloads := g.serialize(metrics, 1)
+	assert.True(t, len(payloads) > 1)
+	lines := 0
+	for _, payload := range payloads {
+		assert.True(t, len(payload) <= graphiteMaxDatagramSize)
+		assert.True(t, strings.HasSuffix(string(payload), "\n"))
+		lines += strings.Count(string(payload), "\n")
+	}
+	assert.Equal(t, 100, lines)
+}
+
+func TestGraphiteEmitMetricsNoServer(t *testing.T) {
+	g := getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{})
+
+	assert.False(t, g.emitMetrics([]metric.Metric{metric.New("test")}))
+}
+
+func TestGraphiteEmitMetricsConnectionRefused(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	g := getTestGraphiteHandler(12, 13, 1)
+	g.Configure(map[string]interface{}{"server": host, "port": port})
+
+	assert.False(t, g.emitMetrics([]metric.Metric{metric.New("test")}))
+}
+
+func TestGraphiteEmitMetricsReusesConnection(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+
+	lines := make(chan string, 10)
+	connections := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connections <- conn
+			go func(conn net.Conn) {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}(conn)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	g := getTestGraphiteHandler(12, 13, 1)
+	g.Configure(map[string]interface{}{"server": host, "port": port})
+
+	assert.True(t, g.emitMetrics([]metric.Metric{metric.New("first")}))
+	assert.True(t, strings.HasPrefix(<-lines, "first 0.000000 "))
+	assert.True(t, g.emitMetrics([]metric.Metric{metric.New("second")}))
+	assert.True(t, strings.HasPrefix(<-lines, "second 0.000000 "))
+	assert.Equal(t, 1, len(connections), "the connection should be reused")
+
+	// the server going away must be noticed and the next
+	// emission sent over a new connection
+	(<-connections).Close()
+	for i := 0; i < 3; i++ {
+		if !g.emitMetrics([]metric.Metric{metric.New("third")}) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-connections:
+	case <-time.After(time.Second):
+		t.Error("the handler should have reconnected")
+	}
+}
+
+func TestGraphiteEmitMetricsUDP(t *testing.T) {
+	server, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(server.LocalAddr().String())
+	g := getTestGraphiteHandler(12, 13, 1)
+	g.Configure(map[string]interface{}{"server": host, "port": port, "protocol": "udp"})
+
+	assert.True(t, g.emitMetrics([]metric.Metric{metric.New("test")}))
+
+	buf := make([]byte, graphiteMaxDatagramSize)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := server.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "test 0.000000 "))
+}
+
+func TestGraphiteConfigurePathFormat(t *testing.T) {
+	g := getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{})
+	assert.Equal(t, graphitePathFlat, g.PathFormat())
+
+	g.Configure(map[string]interface{}{"pathFormat": "tagged"})
+	assert.Equal(t, graphitePathTagged, g.PathFormat())
+
+	g.Configure(map[string]interface{}{"pathTemplate": "servers.{host}.{name}"})
+	assert.Equal(t, graphitePathTemplate, g.PathFormat())
+
+	g = getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{"pathFormat": "template"})
+	assert.Equal(t, graphitePathFlat, g.PathFormat(), "a template format needs a pathTemplate")
+}
+
+func TestGraphiteTaggedPath(t *testing.T) {
+	g := getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{
+		"pathFormat":        "tagged",
+		"defaultDimensions": map[string]string{"host": "my.host"},
+	})
+	g.SetPrefix("prefix.")
+
+	m := metric.New("cpu.user;evil=1")
+	m.AddDimension("core", "0")
+	m.AddDimension("weird", "a;b=c")
+	m.AddDimension("empty", "")
+	m.AddDimension("blank", "  ")
+
+	datapoint := g.convertToGraphite(m)
+	assert.Equal(t, "prefix.cpu_user_evil-1;core=0;host=my_host;weird=a_b-c", strings.Split(datapoint, " ")[0])
+}
+
+func TestGraphiteTemplatePath(t *testing.T) {
+	g := getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{
+		"pathTemplate":      "servers.{host}.{collector}.{name}",
+		"defaultDimensions": map[string]string{"host": "my.host"},
+	})
+
+	m := metric.New("cpu.user")
+	m.AddDimension("collector", "ProcStatus")
+	m.AddDimension("dropped", "value")
+
+	datapoint := g.convertToGraphite(m)
+	assert.Equal(t, "servers.my_host.ProcStatus.cpu_user", strings.Split(datapoint, " ")[0])
+
+	m.RemoveDimension("collector")
+	datapoint = g.convertToGraphite(m)
+	assert.Equal(t, "servers.my_host.unknown.cpu_user", strings.Split(datapoint, " ")[0])
+}
+
+func TestGraphitePickleUsesPathFormat(t *testing.T) {
+	g := getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{
+		"protocol":   "pickle",
+		"pathFormat": "tagged",
+	})
+
+	m := metric.New("test")
+	m.AddDimension("a", "b")
+	payloads := g.serialize([]metric.Metric{m}, 1)
+	assert.Equal(t, 1, len(payloads))
+	assert.True(t, strings.Contains(string(payloads[0]), "test;a=b"))
+}
+
+func TestGraphiteConfigureDestinations(t *testing.T) {
+	g := getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{
+		"destinations":             []interface{}{"carbon1:2003:a", "carbon2:2003", "bad"},
+		"destinationRetryInterval": "10",
+	})
+
+	assert.Equal(t, []string{"carbon1:2003:a", "carbon2:2003", "bad"}, g.Destinations())
+	assert.Equal(t, 10, g.retryInterval)
+	assert.Equal(t, 2, len(g.shards.destinations), "invalid destinations should be ignored")
+	assert.Equal(t, "carbon1:2003", g.shards.destinations[0].addr)
+	assert.NotNil(t, g.pools["carbon2:2003"])
+
+	internal := g.InternalMetrics()
+	assert.Equal(t, 0.0, internal.Counters["metricsSent.carbon1:2003"])
+	assert.Equal(t, 0.0, internal.Counters["metricsDropped.carbon2:2003"])
+}
+
+func TestParseGraphiteDestination(t *testing.T) {
+	host, port, instance, err := parseGraphiteDestination("carbon:2004:b")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"carbon", "2004", "b"}, []string{host, port, instance})
+
+	host, port, instance, err = parseGraphiteDestination("[::1]:2003")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"::1", "2003", ""}, []string{host, port, instance})
+
+	_, _, _, err = parseGraphiteDestination("carbon")
+	assert.NotNil(t, err)
+}
+
+func TestGraphiteEmitMetricsFailover(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}(conn)
+		}
+	}()
+
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	downAddr := down.Addr().String()
+	down.Close()
+
+	g := getTestGraphiteHandler(12, 13, 1)
+	g.Configure(map[string]interface{}{
+		"destinations": []interface{}{listener.Addr().String(), downAddr},
+	})
+
+	metrics := []metric.Metric{metric.New("a"), metric.New("b"), metric.New("c")}
+	assert.True(t, g.emitMetrics(metrics))
+
+	received := make(map[string]bool)
+	for range metrics {
+		select {
+		case line := <-lines:
+			received[strings.Fields(line)[0]] = true
+		case <-time.After(time.Second):
+			t.Fatal("every metric should be sent to the destination left")
+		}
+	}
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true}, received)
+
+	internal := g.InternalMetrics()
+	assert.Equal(t, 3.0, internal.Counters["metricsSent."+listener.Addr().String()])
+	assert.Equal(t, 0.0, internal.Counters["metricsSent."+downAddr])
+}
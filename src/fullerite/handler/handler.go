@@ -3,11 +3,16 @@ package handler
 import (
 	"fullerite/config"
 	"fullerite/metric"
+	"fullerite/util"
 	"sync"
 	"sync/atomic"
 
 	"container/list"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -80,6 +85,10 @@ type Handler interface {
 	CollectorEndpoints() map[string]CollectorEnd
 	SetCollectorEndpoints(map[string]CollectorEnd)
 
+	// Enqueue hands a metric read from a collector to the handler without
+	// blocking, it returns false if the metric was dropped or not taken
+	Enqueue(string, metric.Metric) bool
+
 	Interval() int
 	SetInterval(int)
 
@@ -135,10 +144,29 @@ type BaseHandler struct {
 	maxBufferSize int
 	timeout       time.Duration
 
+	// metrics queued per collector endpoint, defaults to the collector's
+	// batch size. Metrics are dropped while a queue is full so that a
+	// stalled handler doesn't block the collectors.
+	collectorQueueSize    int
+	collectorQueueDropped map[string]*uint64
+
 	// for keepalive
 	maxIdleConnectionsPerHost int
 	keepAliveInterval         int
 
+	// Content-Encoding of HTTP payloads, empty when uncompressed
+	compression string
+
+	// keep-alive client shared by all the emissions of HTTP based handlers
+	httpClient *util.HTTPAlive
+
+	// outbound connections settings, see util.TLSSettings and util.ParseProxy,
+	// emissions are disabled while settingsErr reports an invalid one
+	tlsConfig       *tls.Config
+	proxy           func(*http.Request) (*url.URL, error)
+	proxyConfigured bool
+	settingsErr     error
+
 	// Emission timings are reported on to this channel.
 	// There is one instance of this per handler instance
 	emissionTimingChannel chan emissionTiming
@@ -158,6 +186,23 @@ type BaseHandler struct {
 	metricsSent    uint64
 	metricsDropped uint64
 
+	// batches are split to stay under maxBatchBytes, as estimated by
+	// serializedSizeFunc, and datapoints are sent at the pace rateLimiter allows
+	maxBatchBytes      int
+	serializedSizeFunc func(metric.Metric) int
+	rateLimiter        *tokenBucket
+	metricsThrottled   uint64
+
+	// bounds the emissions running at once, unlimited when nil
+	emissions *emissionQueue
+
+	// only the active handler of a failover group receives metrics
+	failover *failoverGroup
+
+	// payload sizes before and after compression
+	bytesUncompressed uint64
+	bytesSent         uint64
+
 	// List of blacklisted collectors
 	// the handler won't accept metrics from
 	blackListedCollectors map[string]bool
@@ -204,9 +249,39 @@ func (base *BaseHandler) CollectorEndpoints() map[string]CollectorEnd {
 // SetCollectorEndpoints : the channels to handler listens for metrics on
 func (base *BaseHandler) SetCollectorEndpoints(c map[string]CollectorEnd) {
 	base.collectorEndpoints = make(map[string]CollectorEnd)
+	base.collectorQueueDropped = make(map[string]*uint64)
 	for name, colInfo := range c {
 		base.collectorEndpoints[name] = colInfo
+		base.collectorQueueDropped[name] = new(uint64)
+	}
+}
+
+// Enqueue queues a metric on the endpoint of collectorName, it is dropped
+// and counted if the handler doesn't keep up and the queue is full. Inactive
+// handlers of a failover group don't take metrics.
+func (base *BaseHandler) Enqueue(collectorName string, m metric.Metric) bool {
+	collectorEnd, exists := base.collectorEndpoints[collectorName]
+	if !exists {
+		return false
+	}
+	if base.failoverInactive() {
+		return false
 	}
+
+	select {
+	case collectorEnd.Channel <- m:
+		return true
+	default:
+		base.log.Debug("Queue of collector ", collectorName, " is full, dropping ", m.Name)
+		atomic.AddUint64(base.collectorQueueDropped[collectorName], 1)
+		return false
+	}
+}
+
+// failoverInactive returns true if the handler is a member of a failover
+// group which currently sends metrics to another handler
+func (base *BaseHandler) failoverInactive() bool {
+	return base.failover != nil && !base.failover.isActive(base)
 }
 
 // OverrideBaseEmissionMetricsReporter : Do not report emissionTiming metrics in the base handler
@@ -320,9 +395,14 @@ func (base *BaseHandler) InitListeners(globalConfig config.Config) {
 				continue
 			}
 		}
+		batchSize := getCollectorBatchSize(c, globalConfig, base.MaxBufferSize())
+		queueSize := base.collectorQueueSize
+		if queueSize <= 0 {
+			queueSize = batchSize
+		}
 		collectorEndpoints[c] = CollectorEnd{
-			make(chan metric.Metric, 1),
-			getCollectorBatchSize(c, globalConfig, base.MaxBufferSize()),
+			make(chan metric.Metric, queueSize),
+			batchSize,
 		}
 	}
 	fmt.Println(collectorEndpoints)
@@ -366,9 +446,9 @@ func (base *BaseHandler) InternalMetrics() metric.InternalMetrics {
 	mu.Lock()
 	defer mu.Unlock()
 	counters := map[string]float64{
-		"totalEmissions": float64(base.totalEmissions),
-		"metricsDropped": float64(base.metricsDropped),
-		"metricsSent":    float64(base.metricsSent),
+		"totalEmissions": float64(atomic.LoadUint64(&base.totalEmissions)),
+		"metricsDropped": float64(atomic.LoadUint64(&base.metricsDropped)),
+		"metricsSent":    float64(atomic.LoadUint64(&base.metricsSent)),
 	}
 	gauges := map[string]float64{
 		"intervalLength":    float64(base.interval),
@@ -393,6 +473,40 @@ func (base *BaseHandler) InternalMetrics() metric.InternalMetrics {
 		gauges["maxEmissionTiming"] = max
 	}
 
+	if base.emissions != nil {
+		base.emissions.addInternalMetrics(metric.InternalMetrics{Counters: counters, Gauges: gauges})
+	}
+
+	for collectorName, dropped := range base.collectorQueueDropped {
+		if count := atomic.LoadUint64(dropped); count > 0 {
+			counters["collectorQueueDropped."+collectorName] = float64(count)
+		}
+	}
+
+	if base.failover != nil {
+		base.failover.addInternalMetrics(base, metric.InternalMetrics{Counters: counters, Gauges: gauges})
+	}
+
+	if base.rateLimiter != nil {
+		counters["metricsThrottled"] = float64(atomic.LoadUint64(&base.metricsThrottled))
+	}
+
+	// only handlers sending payloads through compress report their sizes
+	if bytesSent := atomic.LoadUint64(&base.bytesSent); bytesSent > 0 {
+		bytesUncompressed := atomic.LoadUint64(&base.bytesUncompressed)
+		counters["bytesSent"] = float64(bytesSent)
+		counters["bytesUncompressed"] = float64(bytesUncompressed)
+		gauges["compressionRatio"] = float64(bytesUncompressed) / float64(bytesSent)
+	}
+
+	if base.httpClient != nil {
+		if stats := base.httpClient.Stats(); stats.Requests > 0 {
+			counters["httpRequests"] = float64(stats.Requests)
+			counters["httpConnectionsReused"] = float64(stats.ConnectionsReused)
+			counters["httpConnectionsCreated"] = float64(stats.ConnectionsCreated)
+		}
+	}
+
 	return metric.InternalMetrics{
 		Counters: counters,
 		Gauges:   gauges,
@@ -410,6 +524,10 @@ func (base *BaseHandler) configureCommonParams(configMap map[string]interface{})
 		base.maxBufferSize = config.GetAsInt(asInterface, DefaultBufferSize)
 	}
 
+	if asInterface, exists := configMap["collectorQueueSize"]; exists {
+		base.collectorQueueSize = config.GetAsInt(asInterface, 0)
+	}
+
 	if asInterface, exists := configMap["interval"]; exists {
 		base.interval = config.GetAsInt(asInterface, DefaultInterval)
 	}
@@ -431,6 +549,28 @@ func (base *BaseHandler) configureCommonParams(configMap map[string]interface{})
 		base.SetMaxIdleConnectionsPerHost(maxIdleConnectionsPerHost)
 	}
 
+	if asInterface, exists := configMap["maxBatchBytes"]; exists {
+		base.maxBatchBytes = config.GetAsInt(asInterface, 0)
+	}
+
+	if asInterface, exists := configMap["maxDatapointsPerSecond"]; exists {
+		base.rateLimiter = nil
+		if rate := config.GetAsInt(asInterface, 0); rate > 0 {
+			base.rateLimiter = newTokenBucket(rate)
+		}
+	}
+
+	base.configureEmissions(configMap)
+	base.configureFailover(configMap)
+
+	// other values are codecs of handlers compressing
+	// on their own, such as Kafka, rather than HTTP encodings
+	if asInterface, exists := configMap["compression"]; exists {
+		if !base.SetCompression(fmt.Sprint(asInterface)) {
+			base.log.Debug("Not compressing HTTP payloads with ", asInterface)
+		}
+	}
+
 	if asInterface, exists := configMap["collectorBlackList"]; exists {
 		blackList := config.GetAsSlice(asInterface)
 		base.SetCollectorBlackList(blackList)
@@ -440,6 +580,139 @@ func (base *BaseHandler) configureCommonParams(configMap map[string]interface{})
 		whiteList := config.GetAsSlice(asInterface)
 		base.SetCollectorWhiteList(whiteList)
 	}
+
+	// invalid tls or proxy settings never fall back to plaintext
+	// or direct connections
+	if asInterface, exists := configMap["tls"]; exists {
+		tlsConfig, err := util.ParseTLSSettings(asInterface).Config()
+		if err != nil {
+			base.log.Error("Invalid tls settings, emissions are disabled: ", err)
+		}
+		base.tlsConfig = tlsConfig
+		base.settingsErr = err
+	}
+
+	if asInterface, exists := configMap["proxy"]; exists {
+		proxy, err := util.ParseProxy(asInterface)
+		if err != nil {
+			base.log.Error("Invalid proxy ", asInterface, ", emissions are disabled: ", err)
+			base.settingsErr = err
+		}
+		base.proxy = proxy
+		base.proxyConfigured = true
+	}
+
+	base.httpClient = base.newHTTPClient()
+}
+
+// configureEmissions bounds the emissions running at once to
+// maxConcurrentEmissions, emissions are unlimited by default
+func (base *BaseHandler) configureEmissions(configMap map[string]interface{}) {
+	asInterface, exists := configMap["maxConcurrentEmissions"]
+	if !exists {
+		return
+	}
+	maxInFlight := config.GetAsInt(asInterface, 0)
+	if maxInFlight <= 0 {
+		base.emissions = nil
+		return
+	}
+
+	maxPending := maxInFlight
+	if asInterface, exists := configMap["maxPendingEmissions"]; exists {
+		maxPending = config.GetAsInt(asInterface, maxInFlight)
+	}
+
+	policy := emissionPolicyBlock
+	if asInterface, exists := configMap["emissionOverflowPolicy"]; exists {
+		switch asInterface {
+		case emissionPolicyBlock, emissionPolicyDropOldest, emissionPolicyDropNewest:
+			policy = asInterface.(string)
+		default:
+			base.log.Warn("Unknown emissionOverflowPolicy ", asInterface, ", using ", emissionPolicyBlock)
+		}
+	}
+
+	base.emissions = newEmissionQueue(maxInFlight, maxPending, policy, func(e pendingEmission) {
+		base.emitAndTime(e.metrics, e.emitFunc)
+	})
+}
+
+// configureFailover adds the handler to its failoverGroup, handlers with
+// a lower failoverPriority receive metrics while their circuit is closed
+func (base *BaseHandler) configureFailover(configMap map[string]interface{}) {
+	asInterface, exists := configMap["failoverGroup"]
+	if !exists {
+		return
+	}
+
+	priority := 0
+	if asInterface, exists := configMap["failoverPriority"]; exists {
+		priority = config.GetAsInt(asInterface, 0)
+	}
+
+	threshold := DefaultFailoverThreshold
+	if asInterface, exists := configMap["failoverThreshold"]; exists {
+		threshold = config.GetAsInt(asInterface, DefaultFailoverThreshold)
+	}
+
+	retryInterval := DefaultFailoverRetryInterval
+	if asInterface, exists := configMap["failoverRetryInterval"]; exists {
+		retryInterval = config.GetAsInt(asInterface, DefaultFailoverRetryInterval)
+	}
+
+	base.joinFailoverGroup(fmt.Sprint(asInterface), priority, threshold,
+		time.Duration(retryInterval)*time.Second)
+}
+
+// submitEmission emits a flush in the background, within
+// the limits of the handler's concurrent emissions
+func (base *BaseHandler) submitEmission(metrics []metric.Metric, emitFunc func([]metric.Metric) bool) {
+	if base.emissions == nil {
+		go base.emitAndTime(metrics, emitFunc)
+		return
+	}
+
+	if rejected := base.emissions.submit(pendingEmission{metrics, emitFunc}); rejected != nil {
+		base.log.Warn("Rejecting an emission of ", len(rejected.metrics), " metrics, ",
+			base.emissions.maxInFlight, " emissions are already in flight")
+	}
+}
+
+// TLSConfig returns the TLS configuration of outbound connections, nil without TLS
+func (base *BaseHandler) TLSConfig() *tls.Config {
+	return base.tlsConfig
+}
+
+// dial connects to addr within the handler timeout, over TLS when configured
+func (base *BaseHandler) dial(network, addr string) (net.Conn, error) {
+	if base.settingsErr != nil {
+		return nil, base.settingsErr
+	}
+	return util.DialTimeout(network, addr, base.timeout, base.tlsConfig)
+}
+
+// newHTTPClient returns a keep-alive client built from the handler's
+// timeout, keepAliveInterval and maxIdleConnectionsPerHost
+func (base *BaseHandler) newHTTPClient() *util.HTTPAlive {
+	keepAliveInterval := base.keepAliveInterval
+	if keepAliveInterval <= 0 {
+		keepAliveInterval = DefaultKeepAliveInterval
+	}
+	maxIdleConnectionsPerHost := base.maxIdleConnectionsPerHost
+	if maxIdleConnectionsPerHost <= 0 {
+		maxIdleConnectionsPerHost = DefaultMaxIdleConnectionsPerHost
+	}
+
+	client := new(util.HTTPAlive)
+	client.Configure(base.timeout,
+		time.Duration(keepAliveInterval)*time.Second,
+		maxIdleConnectionsPerHost)
+	client.SetTLSConfig(base.tlsConfig)
+	if base.proxyConfigured {
+		client.SetProxy(base.proxy)
+	}
+	return client
 }
 
 func (base *BaseHandler) run(emitFunc func([]metric.Metric) bool) {
@@ -468,7 +741,7 @@ func (base *BaseHandler) listenForMetrics(
 	flusher := ticker.C
 
 	flushFunction := func() {
-		go base.emitAndTime(metrics, emitFunc)
+		base.submitEmission(metrics, emitFunc)
 
 		// will get copied into this call, meaning it's ok to clear it
 		metrics = make([]metric.Metric, 0, collectorEnd.BufferSize)
@@ -492,6 +765,12 @@ stopReading:
 				continue
 			}
 
+			// the collector queues are gated by Enqueue, the metrics
+			// written to Channel() directly are dropped here
+			if collectorName == "" && base.failoverInactive() {
+				continue
+			}
+
 			base.log.Debug(base.Name(), " metric: ", incomingMetric)
 			metrics = append(metrics, incomingMetric)
 			currentBufferSize++
@@ -553,11 +832,31 @@ func (base *BaseHandler) reportEmissionMetrics(emissionResult bool, timing emiss
 	} else {
 		atomic.AddUint64(&base.metricsDropped, uint64(timing.metricsSent))
 	}
+
+	if base.failover != nil {
+		base.failover.report(base, emissionResult)
+	}
 }
 
+// emitAndTime emits a flush in batches small enough for the backend,
+// batches still throttled when the next flush is due are not sent
 func (base *BaseHandler) emitAndTime(metrics []metric.Metric, emitFunc func([]metric.Metric) bool) {
+	deadline := time.Now().Add(time.Duration(base.interval) * time.Second)
+	for _, batch := range base.splitBatch(metrics) {
+		if base.throttle(batch, deadline) {
+			base.emitBatchAndTime(batch, emitFunc)
+		}
+	}
+}
+
+func (base *BaseHandler) emitBatchAndTime(metrics []metric.Metric, emitFunc func([]metric.Metric) bool) {
 	start := time.Now()
-	result := emitFunc(metrics)
+	result := false
+	if base.settingsErr != nil {
+		base.log.Error("Dropping ", len(metrics), " metrics, the connection settings are invalid: ", base.settingsErr)
+	} else {
+		result = emitFunc(metrics)
+	}
 	elapsed := time.Since(start)
 	if !base.useCustomEmissionMetricsReporter {
 		timing := emissionTiming{
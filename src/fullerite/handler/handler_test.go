@@ -1,9 +1,13 @@
 package handler
 
 import (
+	"fullerite/config"
 	"fullerite/metric"
 
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -21,7 +25,7 @@ func assertEmpty(t *testing.T, channel chan metric.Metric) {
 }
 
 func TestNewHandler(t *testing.T) {
-	names := []string{"Wavefront", "Graphite", "Kairos", "SignalFx", "Datadog", "Log"}
+	names := []string{"Wavefront", "Graphite", "Kairos", "SignalFx", "Datadog", "Log", "Kafka", "File", "HTTPJSON", "OTLP"}
 	for _, name := range names {
 		h := New(name)
 		assert.NotNil(t, h, "should create a Handler for "+name)
@@ -347,3 +351,126 @@ func TestKeepAliveConfig(t *testing.T) {
 	assert.Equal(t, 0, base.KeepAliveInterval())
 	assert.Equal(t, 0, base.MaxIdleConnectionsPerHost())
 }
+
+func TestConfigureTLSAndProxy(t *testing.T) {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.URL.Host
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+
+	base := BaseHandler{log: l.WithField("testing", "basehandler_tls")}
+	base.configureCommonParams(map[string]interface{}{
+		"tls":   map[string]interface{}{"serverName": "metrics.invalid", "insecureSkipVerify": true},
+		"proxy": proxy.URL,
+	})
+
+	assert.NotNil(t, base.TLSConfig())
+	assert.Equal(t, "metrics.invalid", base.TLSConfig().ServerName)
+	assert.True(t, base.TLSConfig().InsecureSkipVerify)
+
+	rsp, err := base.httpClient.MakeRequest("POST", "http://metrics.invalid/api", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	assert.Equal(t, "metrics.invalid", proxiedHost)
+}
+
+func TestConfigureInvalidTLS(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "basehandler_tls")}
+	base.configureCommonParams(map[string]interface{}{
+		"tls": map[string]interface{}{"caFile": "/does/not/exist"},
+	})
+	assert.Nil(t, base.TLSConfig())
+	assert.NotNil(t, base.httpClient)
+}
+
+func TestInvalidTLSPreventsConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	base := BaseHandler{log: l.WithField("testing", "basehandler_tls"), timeout: time.Second}
+	base.configureCommonParams(map[string]interface{}{
+		"tls": map[string]interface{}{"caFile": "/does/not/exist"},
+	})
+	base.emissionTimingChannel = make(chan emissionTiming, 1)
+
+	_, err = base.dial("tcp", listener.Addr().String())
+	assert.NotNil(t, err)
+
+	emitted := false
+	base.emitBatchAndTime([]metric.Metric{metric.New("m1")}, func([]metric.Metric) bool {
+		emitted = true
+		return true
+	})
+	assert.False(t, emitted)
+	assert.Equal(t, 1.0, base.InternalMetrics().Counters["metricsDropped"])
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&accepted))
+}
+
+func TestInvalidProxyPreventsEmissions(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "basehandler_proxy"), timeout: time.Second}
+	base.configureCommonParams(map[string]interface{}{"proxy": "not-a-url"})
+	base.emissionTimingChannel = make(chan emissionTiming, 1)
+
+	emitted := false
+	base.emitBatchAndTime([]metric.Metric{metric.New("m1")}, func([]metric.Metric) bool {
+		emitted = true
+		return true
+	})
+	assert.False(t, emitted)
+	assert.Equal(t, 1.0, base.InternalMetrics().Counters["metricsDropped"])
+}
+
+func TestEnqueueDropsWhenQueueIsFull(t *testing.T) {
+	base := BaseHandler{log: l.WithField("testing", "basehandler_enqueue")}
+	base.SetCollectorEndpoints(map[string]CollectorEnd{
+		"collector1": CollectorEnd{make(chan metric.Metric, 2), 10},
+		"collector2": CollectorEnd{make(chan metric.Metric, 2), 10},
+	})
+
+	assert.True(t, base.Enqueue("collector1", metric.New("m1")))
+	assert.True(t, base.Enqueue("collector1", metric.New("m2")))
+	assert.False(t, base.Enqueue("collector1", metric.New("m3")))
+	assert.False(t, base.Enqueue("collector1", metric.New("m4")))
+	assert.False(t, base.Enqueue("collector1", metric.Sentinel()), "flushes are dropped like any metric")
+	assert.True(t, base.Enqueue("collector2", metric.New("m1")))
+	assert.False(t, base.Enqueue("unknown", metric.New("m1")))
+
+	counters := base.InternalMetrics().Counters
+	assert.Equal(t, 3.0, counters["collectorQueueDropped.collector1"])
+	_, exists := counters["collectorQueueDropped.collector2"]
+	assert.False(t, exists)
+
+	// room is made as soon as the handler reads from the queue
+	<-base.CollectorEndpoints()["collector1"].Channel
+	assert.True(t, base.Enqueue("collector1", metric.New("m5")))
+}
+
+func TestInitListenersQueueSize(t *testing.T) {
+	base := BaseHandler{maxBufferSize: 50}
+	c := config.Config{Collectors: []string{"collector1"}}
+
+	base.InitListeners(c)
+	assert.Equal(t, 50, cap(base.CollectorEndpoints()["collector1"].Channel))
+
+	base.configureCommonParams(map[string]interface{}{"collectorQueueSize": 500})
+	base.InitListeners(c)
+	assert.Equal(t, 500, cap(base.CollectorEndpoints()["collector1"].Channel))
+	assert.Equal(t, 50, base.CollectorEndpoints()["collector1"].BufferSize)
+}
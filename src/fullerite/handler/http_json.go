@@ -0,0 +1,330 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterHandler("HTTPJSON", newHTTPJSON)
+}
+
+const (
+	defaultHTTPJSONMethod      = "POST"
+	defaultHTTPJSONContentType = "application/json"
+	defaultHTTPJSONTemplate    = "{{json .Metrics}}"
+)
+
+// httpJSONMetric is the representation of a metric handed to the
+// body template
+type httpJSONMetric struct {
+	Name       string            `json:"name"`
+	MetricType string            `json:"type"`
+	Value      float64           `json:"value"`
+	Timestamp  int64             `json:"timestamp"`
+	Dimensions map[string]string `json:"dimensions"`
+}
+
+// httpJSONPayload is the data the body template is rendered with,
+// once per batch
+type httpJSONPayload struct {
+	Metrics   []httpJSONMetric
+	Timestamp int64
+}
+
+var httpJSONTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+	"last": func(index int, metrics []httpJSONMetric) bool {
+		return index == len(metrics)-1
+	},
+	"join": strings.Join,
+}
+
+// HTTPJSON handler posts batches of metrics to an arbitrary HTTP
+// endpoint, the body of each request is rendered from a Go template
+type HTTPJSON struct {
+	BaseHandler
+	url          string
+	method       string
+	headers      map[string]string
+	successCodes []int
+
+	authType       string
+	username       string
+	password       string
+	bearerToken    string
+	authHeader     string
+	authHeaderFile string
+
+	bodyTemplate *template.Template
+}
+
+// newHTTPJSON returns a new HTTPJSON handler
+func newHTTPJSON(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(HTTPJSON)
+	inst.name = "HTTPJSON"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.log = log
+	inst.channel = channel
+
+	inst.method = defaultHTTPJSONMethod
+	inst.headers = map[string]string{"Content-Type": defaultHTTPJSONContentType}
+	inst.bodyTemplate = template.Must(
+		template.New("body").Funcs(httpJSONTemplateFuncs).Parse(defaultHTTPJSONTemplate))
+
+	return inst
+}
+
+// Configure accepts the different configuration options for the HTTPJSON handler
+func (h *HTTPJSON) Configure(configMap map[string]interface{}) {
+	if url, exists := configMap["url"]; exists {
+		h.url = url.(string)
+	} else {
+		h.log.Error("There was no url specified for the HTTPJSON Handler, there won't be any emissions")
+	}
+
+	if method, exists := configMap["method"]; exists {
+		h.method = strings.ToUpper(method.(string))
+	}
+
+	if headers, exists := configMap["headers"]; exists {
+		for key, value := range config.GetAsMap(headers) {
+			h.headers[key] = value
+		}
+	}
+
+	if successCodes, exists := configMap["successCodes"]; exists {
+		h.successCodes = getAsIntSlice(successCodes)
+	}
+
+	h.configureAuth(configMap)
+
+	if body, exists := configMap["template"]; exists {
+		h.parseTemplate(body.(string))
+	} else if templateFile, exists := configMap["templateFile"]; exists {
+		body, err := ioutil.ReadFile(templateFile.(string))
+		if err != nil {
+			h.log.Error("Failed to read template file ", templateFile, ": ", err)
+		} else {
+			h.parseTemplate(string(body))
+		}
+	}
+
+	h.configureCommonParams(configMap)
+}
+
+func (h *HTTPJSON) configureAuth(configMap map[string]interface{}) {
+	authType, exists := configMap["authType"]
+	if !exists {
+		return
+	}
+
+	switch authType {
+	case "basic":
+		if username, exists := configMap["username"]; exists {
+			h.username = username.(string)
+		}
+		if password, exists := configMap["password"]; exists {
+			h.password = password.(string)
+		}
+	case "bearer":
+		if token, exists := configMap["bearerToken"]; exists {
+			h.bearerToken = token.(string)
+		} else {
+			h.log.Error("There was no bearerToken specified for the HTTPJSON Handler bearer auth")
+		}
+	case "headerFromFile":
+		if header, exists := configMap["authHeader"]; exists {
+			h.authHeader = header.(string)
+		}
+		if headerFile, exists := configMap["authHeaderFile"]; exists {
+			h.authHeaderFile = headerFile.(string)
+		}
+		if h.authHeader == "" || h.authHeaderFile == "" {
+			h.log.Error("authHeader and authHeaderFile are required for the HTTPJSON Handler headerFromFile auth")
+		}
+	default:
+		h.log.Warn("Unknown authType ", authType, ", requests won't be authenticated")
+		return
+	}
+	h.authType = authType.(string)
+}
+
+func (h *HTTPJSON) parseTemplate(body string) {
+	tmpl, err := template.New("body").Funcs(httpJSONTemplateFuncs).Parse(body)
+	if err != nil {
+		h.log.Error("Failed to parse the HTTPJSON body template, using the default: ", err)
+		return
+	}
+	h.bodyTemplate = tmpl
+}
+
+// URL returns the endpoint metrics are sent to
+func (h HTTPJSON) URL() string {
+	return h.url
+}
+
+// Method returns the HTTP method used to send metrics
+func (h HTTPJSON) Method() string {
+	return h.method
+}
+
+// Run runs the handler main loop
+func (h *HTTPJSON) Run() {
+	h.run(h.emitMetrics)
+}
+
+func (h HTTPJSON) convertToHTTPJSON(incomingMetric metric.Metric, timestamp int64) httpJSONMetric {
+	return httpJSONMetric{
+		Name:       h.Prefix() + incomingMetric.Name,
+		MetricType: incomingMetric.MetricType,
+		Value:      incomingMetric.Value,
+		Timestamp:  timestamp,
+		Dimensions: incomingMetric.GetDimensions(h.DefaultDimensions()),
+	}
+}
+
+func (h HTTPJSON) renderBody(metrics []metric.Metric) ([]byte, error) {
+	payload := httpJSONPayload{
+		Metrics:   make([]httpJSONMetric, 0, len(metrics)),
+		Timestamp: time.Now().Unix(),
+	}
+	for _, m := range metrics {
+		payload.Metrics = append(payload.Metrics, h.convertToHTTPJSON(m, payload.Timestamp))
+	}
+
+	var body bytes.Buffer
+	if err := h.bodyTemplate.Execute(&body, payload); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+func (h HTTPJSON) requestHeaders() (map[string]string, error) {
+	headers := make(map[string]string, len(h.headers)+1)
+	for key, value := range h.headers {
+		headers[key] = value
+	}
+
+	switch h.authType {
+	case "basic":
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.username + ":" + h.password))
+		headers["Authorization"] = "Basic " + credentials
+	case "bearer":
+		headers["Authorization"] = "Bearer " + h.bearerToken
+	case "headerFromFile":
+		// the file is read on every emission so that rotated
+		// credentials are picked up without a restart
+		value, err := ioutil.ReadFile(h.authHeaderFile)
+		if err != nil {
+			return nil, err
+		}
+		headers[h.authHeader] = strings.TrimSpace(string(value))
+	}
+	return headers, nil
+}
+
+func (h HTTPJSON) isSuccess(statusCode int) bool {
+	if len(h.successCodes) == 0 {
+		return statusCode/100 == 2
+	}
+	for _, code := range h.successCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HTTPJSON) emitMetrics(metrics []metric.Metric) bool {
+	h.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if len(metrics) == 0 {
+		h.log.Warn("Skipping send because of an empty payload")
+		return false
+	}
+
+	if h.url == "" || h.httpClient == nil {
+		h.log.Error("The HTTPJSON handler has no endpoint to send to, dropping metrics")
+		return false
+	}
+
+	body, err := h.renderBody(metrics)
+	if err != nil {
+		h.log.Error("Failed to render the HTTPJSON body template: ", err)
+		return false
+	}
+
+	headers, err := h.requestHeaders()
+	if err != nil {
+		h.log.Error("Failed to read the auth header from ", h.authHeaderFile, ": ", err)
+		return false
+	}
+
+	compressed, encoding := h.compress(body)
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+
+	rsp, err := h.httpClient.MakeRequest(h.method, h.url, bytes.NewBuffer(compressed), headers)
+	if err != nil {
+		h.log.Error("Failed to make request ", err, " to endpoint ", h.url)
+		return false
+	}
+
+	if !h.isSuccess(rsp.StatusCode) {
+		h.log.Error("Failed to ", h.method, " to ", h.url,
+			" status was ", rsp.StatusCode,
+			" rsp body was ", string(rsp.Body))
+		return false
+	}
+
+	h.log.Info("Successfully sent ", len(metrics), " datapoints to ", h.url)
+	return true
+}
+
+// getAsIntSlice converts a configuration list of numbers or
+// numeric strings to a []int, invalid entries are skipped
+func getAsIntSlice(value interface{}) []int {
+	result := []int{}
+
+	switch realValue := value.(type) {
+	case []int:
+		result = realValue
+	case []interface{}:
+		for _, v := range realValue {
+			if i := config.GetAsInt(v, -1); i != -1 {
+				result = append(result, i)
+			}
+		}
+	default:
+		for _, v := range config.GetAsSlice(value) {
+			if i := config.GetAsInt(v, -1); i != -1 {
+				result = append(result, i)
+			}
+		}
+	}
+	return result
+}
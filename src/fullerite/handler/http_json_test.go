@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"fullerite/metric"
+	"fullerite/util"
+
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestHTTPJSONHandler(interval, buffsize, timeoutsec int) *HTTPJSON {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "httpjson_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	h := newHTTPJSON(testChannel, interval, buffsize, timeout, testLog).(*HTTPJSON)
+	h.httpClient = new(util.HTTPAlive)
+	h.httpClient.Configure(timeout, timeout, 1)
+	return h
+}
+
+func TestHTTPJSONConfigureEmptyConfig(t *testing.T) {
+	config := make(map[string]interface{})
+
+	h := getTestHTTPJSONHandler(12, 13, 14)
+	h.Configure(config)
+
+	assert.Equal(t, 12, h.Interval())
+	assert.Equal(t, 13, h.MaxBufferSize())
+	assert.Equal(t, "", h.URL())
+	assert.Equal(t, defaultHTTPJSONMethod, h.Method())
+	assert.Equal(t, map[string]string{"Content-Type": defaultHTTPJSONContentType}, h.headers)
+	assert.Equal(t, "", h.authType)
+}
+
+func TestHTTPJSONConfigure(t *testing.T) {
+	config := map[string]interface{}{
+		"interval":        "10",
+		"max_buffer_size": "100",
+		"url":             "http://ingest.local/metrics",
+		"method":          "put",
+		"headers":         map[string]interface{}{"X-Source": "fullerite"},
+		"successCodes":    []interface{}{float64(200), "202"},
+		"authType":        "basic",
+		"username":        "user",
+		"password":        "pass",
+	}
+
+	h := getTestHTTPJSONHandler(12, 13, 14)
+	h.Configure(config)
+
+	assert.Equal(t, 10, h.Interval())
+	assert.Equal(t, 100, h.MaxBufferSize())
+	assert.Equal(t, "http://ingest.local/metrics", h.URL())
+	assert.Equal(t, "PUT", h.Method())
+	assert.Equal(t, "fullerite", h.headers["X-Source"])
+	assert.Equal(t, []int{200, 202}, h.successCodes)
+	assert.Equal(t, "basic", h.authType)
+
+	headers, err := h.requestHeaders()
+	assert.Nil(t, err)
+	assert.Equal(t, "Basic dXNlcjpwYXNz", headers["Authorization"])
+}
+
+func TestHTTPJSONConfigureBadTemplate(t *testing.T) {
+	h := getTestHTTPJSONHandler(12, 13, 14)
+	h.Configure(map[string]interface{}{
+		"template": "{{ .Metrics",
+	})
+
+	body, err := h.renderBody([]metric.Metric{metric.New("test")})
+	assert.Nil(t, err)
+
+	var metrics []httpJSONMetric
+	assert.Nil(t, json.Unmarshal(body, &metrics), "should fall back to the default template")
+	assert.Equal(t, "test", metrics[0].Name)
+}
+
+func TestHTTPJSONRenderTemplate(t *testing.T) {
+	h := getTestHTTPJSONHandler(12, 13, 14)
+	h.Configure(map[string]interface{}{
+		"template":          `[{{range $i, $m := .Metrics}}{"metric":"{{$m.Name}}","v":{{$m.Value}}}{{if not (last $i $.Metrics)}},{{end}}{{end}}]`,
+		"defaultDimensions": map[string]string{"host": "myhost"},
+	})
+
+	m1 := metric.New("one")
+	m1.Value = 1
+	m2 := metric.New("two")
+	m2.Value = 2.5
+
+	body, err := h.renderBody([]metric.Metric{m1, m2})
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"metric":"one","v":1},{"metric":"two","v":2.5}]`, string(body))
+}
+
+func TestHTTPJSONBearerAuth(t *testing.T) {
+	h := getTestHTTPJSONHandler(12, 13, 14)
+	h.Configure(map[string]interface{}{
+		"authType":    "bearer",
+		"bearerToken": "secret",
+	})
+
+	headers, err := h.requestHeaders()
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer secret", headers["Authorization"])
+}
+
+func TestHTTPJSONHeaderFromFileAuth(t *testing.T) {
+	file, _ := ioutil.TempFile("", "httpjson_token")
+	defer os.Remove(file.Name())
+	file.Write([]byte("secret\n"))
+	file.Close()
+
+	h := getTestHTTPJSONHandler(12, 13, 14)
+	h.Configure(map[string]interface{}{
+		"authType":       "headerFromFile",
+		"authHeader":     "X-Api-Key",
+		"authHeaderFile": file.Name(),
+	})
+
+	headers, err := h.requestHeaders()
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", headers["X-Api-Key"])
+
+	os.Remove(file.Name())
+	_, err = h.requestHeaders()
+	assert.NotNil(t, err)
+}
+
+func TestHTTPJSONEmitMetrics(t *testing.T) {
+	var received []httpJSONMetric
+	var request *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	h := getTestHTTPJSONHandler(12, 13, 14)
+	h.Configure(map[string]interface{}{
+		"url":     ts.URL,
+		"headers": map[string]interface{}{"X-Source": "fullerite"},
+	})
+
+	m := metric.New("test")
+	m.AddDimension("a", "b")
+	assert.True(t, h.emitMetrics([]metric.Metric{m}))
+
+	assert.Equal(t, "POST", request.Method)
+	assert.Equal(t, "fullerite", request.Header.Get("X-Source"))
+	assert.Equal(t, defaultHTTPJSONContentType, request.Header.Get("Content-Type"))
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, "test", received[0].Name)
+	assert.Equal(t, map[string]string{"a": "b"}, received[0].Dimensions)
+}
+
+func TestHTTPJSONEmitMetricsSuccessCodes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	h := getTestHTTPJSONHandler(12, 13, 14)
+	h.Configure(map[string]interface{}{
+		"url":          ts.URL,
+		"successCodes": []interface{}{float64(200)},
+	})
+
+	assert.False(t, h.emitMetrics([]metric.Metric{metric.New("test")}))
+	assert.False(t, h.emitMetrics([]metric.Metric{}))
+}
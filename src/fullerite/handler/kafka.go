@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	l "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+)
+
+func init() {
+	RegisterHandler("Kafka", newKafka)
+}
+
+const (
+	defaultKafkaTopic              = "fullerite"
+	defaultKafkaEncoding           = "json"
+	defaultKafkaMaxBufferedMetrics = 10000
+)
+
+// kafkaAvroSchema is the writer schema of the records produced when
+// the handler is configured with the "avro" encoding. Consumers need it
+// to decode the messages, the messages themselves are schemaless.
+const kafkaAvroSchema = `{
+  "type": "record",
+  "name": "Metric",
+  "namespace": "fullerite",
+  "fields": [
+    {"name": "name", "type": "string"},
+    {"name": "type", "type": "string"},
+    {"name": "value", "type": "double"},
+    {"name": "timestamp", "type": "long"},
+    {"name": "dimensions", "type": {"type": "map", "values": "string"}}
+  ]
+}`
+
+var kafkaAcks = map[string]sarama.RequiredAcks{
+	"none":   sarama.NoResponse,
+	"leader": sarama.WaitForLocal,
+	"all":    sarama.WaitForAll,
+}
+
+var kafkaCompressions = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+}
+
+type fulleriteKafkaProducer interface {
+	SendMessages(msgs []*sarama.ProducerMessage) error
+	Close() error
+}
+
+// Kafka handler
+type Kafka struct {
+	BaseHandler
+	brokers            []string
+	topic              string
+	partitionDimension string
+	acks               sarama.RequiredAcks
+	compression        sarama.CompressionCodec
+	encoding           string
+	maxBufferedMetrics int
+
+	// number of metrics handed to the producer
+	// and not yet acknowledged by the brokers
+	bufferedMetrics int64
+
+	producer fulleriteKafkaProducer
+}
+
+// newKafka returns a new Kafka handler.
+func newKafka(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(Kafka)
+	inst.name = "Kafka"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.log = log
+	inst.channel = channel
+
+	inst.topic = defaultKafkaTopic
+	inst.acks = sarama.WaitForLocal
+	inst.compression = sarama.CompressionNone
+	inst.encoding = defaultKafkaEncoding
+	inst.maxBufferedMetrics = defaultKafkaMaxBufferedMetrics
+
+	return inst
+}
+
+// Configure accepts the different configuration options for the Kafka handler
+func (k *Kafka) Configure(configMap map[string]interface{}) {
+	if brokers, exists := configMap["brokers"]; exists {
+		k.brokers = config.GetAsSlice(brokers)
+	} else {
+		k.log.Error("There were no brokers specified for the Kafka Handler, there won't be any emissions")
+	}
+
+	if topic, exists := configMap["topic"]; exists {
+		k.topic = topic.(string)
+	}
+
+	if partitionDimension, exists := configMap["partitionDimension"]; exists {
+		k.partitionDimension = partitionDimension.(string)
+	}
+
+	if acks, exists := configMap["acks"]; exists {
+		if value, ok := kafkaAcks[fmt.Sprint(acks)]; ok {
+			k.acks = value
+		} else {
+			k.log.Warn("Unknown acks level ", acks, ", using the default")
+		}
+	}
+
+	if compression, exists := configMap["compression"]; exists {
+		if value, ok := kafkaCompressions[fmt.Sprint(compression)]; ok {
+			k.compression = value
+		} else {
+			k.log.Warn("Unknown compression codec ", compression, ", using the default")
+		}
+	}
+
+	if encoding, exists := configMap["encoding"]; exists {
+		switch encoding {
+		case "json", "avro", "protobuf":
+			k.encoding = encoding.(string)
+		default:
+			k.log.Warn("Unknown encoding ", encoding, ", using ", defaultKafkaEncoding)
+		}
+	}
+
+	if maxBuffered, exists := configMap["maxBufferedMetrics"]; exists {
+		k.maxBufferedMetrics = config.GetAsInt(maxBuffered, defaultKafkaMaxBufferedMetrics)
+	}
+
+	k.configureCommonParams(configMap)
+}
+
+// Brokers returns the list of Kafka brokers
+func (k Kafka) Brokers() []string {
+	return k.brokers
+}
+
+// Topic returns the Kafka topic metrics are produced to
+func (k Kafka) Topic() string {
+	return k.topic
+}
+
+// Run runs the handler main loop
+func (k *Kafka) Run() {
+	k.connectToKafka()
+
+	k.run(k.emitMetrics)
+}
+
+func (k *Kafka) producerConfig() *sarama.Config {
+	conf := sarama.NewConfig()
+	conf.ClientID = "fullerite"
+	conf.Net.DialTimeout = k.timeout
+	conf.Producer.Timeout = k.timeout
+	conf.Producer.RequiredAcks = k.acks
+	conf.Producer.Compression = k.compression
+	conf.Producer.Partitioner = sarama.NewHashPartitioner
+	conf.Producer.Return.Successes = true
+	conf.ChannelBufferSize = k.maxBufferedMetrics
+	if k.tlsConfig != nil {
+		conf.Net.TLS.Enable = true
+		conf.Net.TLS.Config = k.tlsConfig
+	}
+	return conf
+}
+
+func (k *Kafka) connectToKafka() {
+	if len(k.brokers) == 0 || k.settingsErr != nil {
+		return
+	}
+
+	producer, err := sarama.NewSyncProducer(k.brokers, k.producerConfig())
+	if err != nil {
+		k.log.Errorf("Failed to connect to %s. Error: %s", strings.Join(k.brokers, ","), err.Error())
+		return
+	}
+	k.producer = producer
+}
+
+func (k *Kafka) emitMetrics(metrics []metric.Metric) bool {
+	k.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if k.producer == nil {
+		k.log.Warn("Cannot connect to kafka brokers. Skipping send.")
+		k.connectToKafka()
+		return false
+	}
+
+	if len(metrics) == 0 {
+		k.log.Warn("Skipping send because of an empty payload")
+		return false
+	}
+
+	buffered := atomic.AddInt64(&k.bufferedMetrics, int64(len(metrics)))
+	defer atomic.AddInt64(&k.bufferedMetrics, -int64(len(metrics)))
+	if buffered > int64(k.maxBufferedMetrics) {
+		k.log.Warn("Too many metrics waiting for kafka acknowledgement (", buffered,
+			"), dropping ", len(metrics), " metrics")
+		return false
+	}
+
+	messages := make([]*sarama.ProducerMessage, 0, len(metrics))
+	for _, m := range metrics {
+		msg, err := k.createKafkaMessage(m)
+		if err != nil {
+			k.log.Warnf("Failed to encode metric %s: %s", m.Name, err.Error())
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	if len(messages) == 0 {
+		return false
+	}
+
+	if err := k.producer.SendMessages(messages); err != nil {
+		if errs, ok := err.(sarama.ProducerErrors); ok {
+			k.log.Errorf("Failed to produce %d of %d messages to kafka. First error: %s",
+				len(errs), len(messages), errs[0].Err.Error())
+		} else {
+			k.log.Errorf("Failed to produce to kafka. Error: %s", err.Error())
+		}
+		return false
+	}
+
+	k.log.Info("Successfully produced ", len(messages), " datapoints to Kafka")
+	return true
+}
+
+func (k Kafka) createKafkaMessage(m metric.Metric) (*sarama.ProducerMessage, error) {
+	sm := newScribeMetric(m, k.DefaultDimensions())
+
+	var value []byte
+	var err error
+	switch k.encoding {
+	case "avro":
+		value = encodeAvroMetric(sm)
+	case "protobuf":
+		value, err = proto.Marshal(encodeProtoMetric(sm))
+	default:
+		value, err = json.Marshal(sm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: k.topic,
+		Value: sarama.ByteEncoder(value),
+	}
+	if k.partitionDimension != "" {
+		if key, ok := sm.Dimensions[k.partitionDimension]; ok {
+			msg.Key = sarama.StringEncoder(key)
+		}
+	}
+	return msg, nil
+}
+
+// encodeProtoMetric reuses the SignalFx DataPoint message so that
+// consumers can decode the payload with the already published schema
+func encodeProtoMetric(sm scribeMetric) *DataPoint {
+	name := sm.Name
+	value := sm.Value
+	timestamp := sm.Timestamp * 1000
+	source := "fullerite"
+
+	datapoint := &DataPoint{
+		Source:    &source,
+		Metric:    &name,
+		Timestamp: &timestamp,
+		Value:     &Datum{DoubleValue: &value},
+	}
+
+	switch sm.MetricType {
+	case metric.Counter:
+		datapoint.MetricType = MetricType_COUNTER.Enum()
+	case metric.CumulativeCounter:
+		datapoint.MetricType = MetricType_CUMULATIVE_COUNTER.Enum()
+	default:
+		datapoint.MetricType = MetricType_GAUGE.Enum()
+	}
+
+	for _, key := range sortedKeys(sm.Dimensions) {
+		dimKey := key
+		dimValue := sm.Dimensions[key]
+		datapoint.Dimensions = append(datapoint.Dimensions, &Dimension{
+			Key:   &dimKey,
+			Value: &dimValue,
+		})
+	}
+	return datapoint
+}
+
+// encodeAvroMetric writes the binary Avro encoding of a metric
+// following kafkaAvroSchema
+func encodeAvroMetric(sm scribeMetric) []byte {
+	var buf bytes.Buffer
+
+	writeAvroString(&buf, sm.Name)
+	writeAvroString(&buf, sm.MetricType)
+
+	var value [8]byte
+	binary.LittleEndian.PutUint64(value[:], math.Float64bits(sm.Value))
+	buf.Write(value[:])
+
+	writeAvroLong(&buf, sm.Timestamp)
+
+	if len(sm.Dimensions) > 0 {
+		writeAvroLong(&buf, int64(len(sm.Dimensions)))
+		for _, key := range sortedKeys(sm.Dimensions) {
+			writeAvroString(&buf, key)
+			writeAvroString(&buf, sm.Dimensions[key])
+		}
+	}
+	// a zero length block terminates the map
+	writeAvroLong(&buf, 0)
+
+	return buf.Bytes()
+}
+
+func writeAvroLong(buf *bytes.Buffer, value int64) {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(varint[:], value)
+	buf.Write(varint[:n])
+}
+
+func writeAvroString(buf *bytes.Buffer, value string) {
+	writeAvroLong(buf, int64(len(value)))
+	buf.WriteString(value)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
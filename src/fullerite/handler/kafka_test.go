@@ -0,0 +1,253 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	l "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestKafkaHandler(interval, buffsize, timeoutsec int) *Kafka {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "kafka_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newKafka(testChannel, interval, buffsize, timeout, testLog).(*Kafka)
+}
+
+func getTestKafkaMetrics() []metric.Metric {
+	return []metric.Metric{
+		metric.Metric{
+			Name:       "test1",
+			MetricType: metric.Gauge,
+			Value:      1,
+			Dimensions: map[string]string{"service": "foo"},
+		},
+		metric.Metric{
+			Name:       "test2",
+			MetricType: metric.Counter,
+			Value:      2,
+			Dimensions: map[string]string{"service": "bar"},
+		},
+	}
+}
+
+func TestKafkaConfigureEmptyConfig(t *testing.T) {
+	config := make(map[string]interface{})
+
+	k := getTestKafkaHandler(12, 13, 14)
+	k.Configure(config)
+
+	assert.Equal(t, 12, k.Interval())
+	assert.Equal(t, 13, k.MaxBufferSize())
+	assert.Equal(t, defaultKafkaTopic, k.Topic())
+	assert.Equal(t, sarama.WaitForLocal, k.acks)
+	assert.Equal(t, sarama.CompressionNone, k.compression)
+	assert.Equal(t, defaultKafkaEncoding, k.encoding)
+	assert.Nil(t, k.producer)
+}
+
+func TestKafkaConfigure(t *testing.T) {
+	config := map[string]interface{}{
+		"interval":           "10",
+		"timeout":            "10",
+		"max_buffer_size":    "100",
+		"brokers":            []interface{}{"kafka1:9092", "kafka2:9092"},
+		"topic":              "metrics",
+		"partitionDimension": "service",
+		"acks":               "all",
+		"compression":        "snappy",
+		"encoding":           "avro",
+		"maxBufferedMetrics": 50,
+	}
+
+	k := getTestKafkaHandler(12, 13, 14)
+	k.Configure(config)
+
+	assert.Equal(t, 10, k.Interval())
+	assert.Equal(t, 100, k.MaxBufferSize())
+	assert.Equal(t, []string{"kafka1:9092", "kafka2:9092"}, k.Brokers())
+	assert.Equal(t, "metrics", k.Topic())
+	assert.Equal(t, "service", k.partitionDimension)
+	assert.Equal(t, sarama.WaitForAll, k.acks)
+	assert.Equal(t, sarama.CompressionSnappy, k.compression)
+	assert.Equal(t, "avro", k.encoding)
+	assert.Equal(t, 50, k.maxBufferedMetrics)
+}
+
+func TestKafkaConfigureUnknownValues(t *testing.T) {
+	config := map[string]interface{}{
+		"acks":        "some",
+		"compression": "zip",
+		"encoding":    "xml",
+	}
+
+	k := getTestKafkaHandler(12, 13, 14)
+	k.Configure(config)
+
+	assert.Equal(t, sarama.WaitForLocal, k.acks)
+	assert.Equal(t, sarama.CompressionNone, k.compression)
+	assert.Equal(t, defaultKafkaEncoding, k.encoding)
+}
+
+func TestKafkaEmitMetricsNoProducer(t *testing.T) {
+	k := getTestKafkaHandler(40, 50, 60)
+
+	res := k.emitMetrics(getTestKafkaMetrics())
+	assert.False(t, res, "Should not emit metrics if the producer is nil")
+}
+
+func TestKafkaEmitMetricsZeroMetrics(t *testing.T) {
+	k := getTestKafkaHandler(40, 50, 60)
+	k.producer = mocks.NewSyncProducer(t, nil)
+
+	res := k.emitMetrics([]metric.Metric{})
+	assert.False(t, res, "Should not emit anything if there are no metrics")
+}
+
+func TestKafkaEmitMetricsJSON(t *testing.T) {
+	k := getTestKafkaHandler(40, 50, 60)
+	k.Configure(map[string]interface{}{
+		"topic":              "metrics",
+		"partitionDimension": "service",
+	})
+
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+		var sm scribeMetric
+		assert.Nil(t, json.Unmarshal(val, &sm))
+		assert.Equal(t, "test1", sm.Name)
+		assert.Equal(t, metric.Gauge, sm.MetricType)
+		assert.Equal(t, 1.0, sm.Value)
+		assert.Equal(t, map[string]string{"service": "foo"}, sm.Dimensions)
+		return nil
+	})
+	producer.ExpectSendMessageAndSucceed()
+	k.producer = producer
+
+	res := k.emitMetrics(getTestKafkaMetrics())
+	assert.True(t, res)
+	assert.Nil(t, producer.Close())
+}
+
+func TestKafkaEmitMetricsFailure(t *testing.T) {
+	k := getTestKafkaHandler(40, 50, 60)
+
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+	producer.ExpectSendMessageAndSucceed()
+	k.producer = producer
+
+	res := k.emitMetrics(getTestKafkaMetrics())
+	assert.False(t, res)
+}
+
+func TestKafkaEmitMetricsBufferFull(t *testing.T) {
+	k := getTestKafkaHandler(40, 50, 60)
+	k.Configure(map[string]interface{}{
+		"maxBufferedMetrics": 1,
+	})
+	k.producer = mocks.NewSyncProducer(t, nil)
+
+	res := k.emitMetrics(getTestKafkaMetrics())
+	assert.False(t, res, "Should drop metrics above the buffering limit")
+	assert.Equal(t, int64(0), k.bufferedMetrics)
+}
+
+func TestKafkaMessagePartitionKey(t *testing.T) {
+	k := getTestKafkaHandler(40, 50, 60)
+	k.Configure(map[string]interface{}{
+		"partitionDimension": "service",
+		"defaultDimensions":  map[string]string{"region": "uswest1"},
+	})
+
+	m := getTestKafkaMetrics()[1]
+	msg, err := k.createKafkaMessage(m)
+	assert.Nil(t, err)
+	assert.Equal(t, sarama.StringEncoder("bar"), msg.Key)
+
+	m.RemoveDimension("service")
+	msg, err = k.createKafkaMessage(m)
+	assert.Nil(t, err)
+	assert.Nil(t, msg.Key)
+}
+
+func TestKafkaProtobufEncoding(t *testing.T) {
+	k := getTestKafkaHandler(40, 50, 60)
+	k.Configure(map[string]interface{}{
+		"encoding": "protobuf",
+	})
+
+	msg, err := k.createKafkaMessage(getTestKafkaMetrics()[1])
+	assert.Nil(t, err)
+
+	value, _ := msg.Value.Encode()
+	datapoint := new(DataPoint)
+	assert.Nil(t, proto.Unmarshal(value, datapoint))
+	assert.Equal(t, "test2", datapoint.GetMetric())
+	assert.Equal(t, 2.0, datapoint.GetValue().GetDoubleValue())
+	assert.Equal(t, MetricType_COUNTER, datapoint.GetMetricType())
+	assert.Equal(t, "service", datapoint.GetDimensions()[0].GetKey())
+	assert.Equal(t, "bar", datapoint.GetDimensions()[0].GetValue())
+}
+
+func TestKafkaAvroEncoding(t *testing.T) {
+	sm := scribeMetric{
+		Name:       "a",
+		MetricType: "gauge",
+		Value:      1.0,
+		Timestamp:  1,
+		Dimensions: map[string]string{"k": "v"},
+	}
+
+	expected := []byte{
+		0x02, 'a',
+		0x0a, 'g', 'a', 'u', 'g', 'e',
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f,
+		0x02,
+		0x02, 0x02, 'k', 0x02, 'v', 0x00,
+	}
+	assert.Equal(t, expected, encodeAvroMetric(sm))
+
+	sm.Dimensions = map[string]string{}
+	assert.Equal(t, append(expected[:17:17], 0x00), encodeAvroMetric(sm))
+}
+
+func TestKafkaMockBroker(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("metrics", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+
+	k := getTestKafkaHandler(40, 50, 5)
+	k.Configure(map[string]interface{}{
+		"brokers": []string{broker.Addr()},
+		"topic":   "metrics",
+	})
+	k.connectToKafka()
+	assert.NotNil(t, k.producer)
+
+	res := k.emitMetrics(getTestKafkaMetrics())
+	assert.True(t, res)
+
+	produceRequests := 0
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produceRequests++
+		}
+	}
+	assert.True(t, produceRequests > 0, "the mock broker should have received the metrics")
+	assert.Nil(t, k.producer.Close())
+}
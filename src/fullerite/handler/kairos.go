@@ -1,17 +1,20 @@
 package handler
 
 import (
+	"fullerite/config"
 	"fullerite/metric"
 	"fullerite/util"
 
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	l "github.com/Sirupsen/logrus"
@@ -26,17 +29,49 @@ type Kairos struct {
 	BaseHandler
 	server string
 	port   string
+
+	// host:port of the Kairos servers series are sharded across
+	destinations  []string
+	retryInterval int
+
+	shards *shards
+
+	// http or https, with basic authentication when username is set
+	scheme   string
+	username string
+	password string
+
+	// datapoints TTL in seconds, by metric name pattern, by
+	// collector or for all of them, unlimited when 0
+	ttl            int
+	collectorTTLs  map[string]int
+	metricTTLs     []kairosTTL
+	pointsRejected uint64
 }
 
-// KairosMetric structure
+type kairosTTL struct {
+	pattern *regexp.Regexp
+	ttl     int
+}
+
+// KairosMetric structure, the value of histograms is a KairosHistogram
 type KairosMetric struct {
 	Name       string            `json:"name"`
 	Timestamp  int64             `json:"timestamp"`
 	MetricType string            `json:"type"`
-	Value      float64           `json:"value"`
+	Value      interface{}       `json:"value"`
+	TTL        int               `json:"ttl,omitempty"`
 	Tags       map[string]string `json:"tags"`
 }
 
+// KairosHistogram is the value of the kairos_histogram datatype
+type KairosHistogram struct {
+	Bins map[string]int `json:"bins"`
+	Min  float64        `json:"min"`
+	Max  float64        `json:"max"`
+	Sum  float64        `json:"sum"`
+}
+
 var allowedPuncts = []rune{'.', '/', '-', '_'}
 
 // newKairos returns a new Kairos handler
@@ -55,24 +90,123 @@ func newKairos(
 	inst.timeout = initialTimeout
 	inst.log = log
 	inst.channel = channel
+	inst.serializedSizeFunc = inst.payloadSize
+
+	inst.retryInterval = defaultDestinationRetryInterval
+	inst.scheme = "http"
 
 	return inst
 }
 
 // Configure the Kairos handler
 func (k *Kairos) Configure(configMap map[string]interface{}) {
-	if server, exists := configMap["server"]; exists {
-		k.server = server.(string)
+	if destinations, exists := configMap["destinations"]; exists {
+		k.destinations = config.GetAsSlice(destinations)
 	} else {
-		k.log.Error("There was no server specified for the Kairos Handler, there won't be any emissions")
+		if server, exists := configMap["server"]; exists {
+			k.server = server.(string)
+		} else {
+			k.log.Error("There was no server specified for the Kairos Handler, there won't be any emissions")
+		}
+
+		if port, exists := configMap["port"]; exists {
+			k.port = fmt.Sprint(port)
+		} else {
+			k.log.Error("There was no port specified for the Kairos Handler, there won't be any emissions")
+		}
+
+		if k.server != "" && k.port != "" {
+			k.destinations = []string{net.JoinHostPort(k.server, k.port)}
+		}
 	}
 
-	if port, exists := configMap["port"]; exists {
-		k.port = fmt.Sprint(port)
-	} else {
-		k.log.Error("There was no port specified for the Kairos Handler, there won't be any emissions")
+	if retryInterval, exists := configMap["destinationRetryInterval"]; exists {
+		k.retryInterval = config.GetAsInt(retryInterval, defaultDestinationRetryInterval)
+	}
+
+	if scheme, exists := configMap["scheme"]; exists {
+		switch scheme {
+		case "http", "https":
+			k.scheme = scheme.(string)
+		default:
+			k.log.Warn("Unknown scheme ", scheme, ", using ", k.scheme)
+		}
+	}
+	if username, exists := configMap["username"]; exists {
+		k.username = fmt.Sprint(username)
+	}
+	if password, exists := configMap["password"]; exists {
+		k.password = fmt.Sprint(password)
 	}
+
+	k.configureTTLs(configMap)
 	k.configureCommonParams(configMap)
+
+	k.shards = nil
+	if len(k.destinations) > 0 {
+		k.shards = newShards(k.destinations, nil, time.Duration(k.retryInterval)*time.Second)
+	}
+}
+
+// configureTTLs reads the default "ttl" and the ones of
+// "collectorTTLs" and "metricTTLs", which take precedence
+func (k *Kairos) configureTTLs(configMap map[string]interface{}) {
+	if ttl, exists := configMap["ttl"]; exists {
+		k.ttl = config.GetAsInt(ttl, 0)
+	}
+
+	if collectorTTLs, exists := configMap["collectorTTLs"]; exists {
+		k.collectorTTLs = getTTLs(collectorTTLs)
+	}
+
+	// patterns are matched in sorted order, so that the first match is stable
+	if metricTTLs, exists := configMap["metricTTLs"]; exists {
+		k.metricTTLs = nil
+		ttls := getTTLs(metricTTLs)
+		patterns := make([]string, 0, len(ttls))
+		for pattern := range ttls {
+			patterns = append(patterns, pattern)
+		}
+		sort.Strings(patterns)
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				k.log.Error("Invalid TTL pattern ", pattern, ": ", err)
+				continue
+			}
+			k.metricTTLs = append(k.metricTTLs, kairosTTL{re, ttls[pattern]})
+		}
+	}
+}
+
+// getTTLs reads a map of TTLs, which may be numbers or strings
+func getTTLs(value interface{}) map[string]int {
+	ttls := make(map[string]int)
+	if asMap, ok := value.(map[string]interface{}); ok {
+		for key, ttl := range asMap {
+			ttls[key] = config.GetAsInt(ttl, 0)
+		}
+		return ttls
+	}
+	for key, ttl := range config.GetAsMap(value) {
+		ttls[key] = config.GetAsInt(ttl, 0)
+	}
+	return ttls
+}
+
+// ttlFor returns the TTL of a metric's datapoint
+func (k Kairos) ttlFor(m metric.Metric) int {
+	for _, metricTTL := range k.metricTTLs {
+		if metricTTL.pattern.MatchString(m.Name) {
+			return metricTTL.ttl
+		}
+	}
+	if collector, exists := m.GetDimensionValue("collector"); exists {
+		if ttl, exists := k.collectorTTLs[collector]; exists {
+			return ttl
+		}
+	}
+	return k.ttl
 }
 
 // Server returns the Kairos server's hostname or IP address
@@ -85,6 +219,21 @@ func (k Kairos) Port() string {
 	return k.port
 }
 
+// Destinations returns the Kairos servers metrics are sharded across
+func (k Kairos) Destinations() []string {
+	return k.destinations
+}
+
+// InternalMetrics adds the per destination counters to the handler metrics
+func (k *Kairos) InternalMetrics() metric.InternalMetrics {
+	internal := k.BaseHandler.InternalMetrics()
+	if k.shards != nil {
+		k.shards.addInternalMetrics(internal)
+	}
+	internal.Counters["pointsRejected"] = float64(atomic.LoadUint64(&k.pointsRejected))
+	return internal
+}
+
 // Run runs the handler main loop
 func (k *Kairos) Run() {
 	k.run(k.emitMetrics)
@@ -95,6 +244,11 @@ func (k Kairos) convertToKairos(incomingMetric metric.Metric) (datapoint KairosM
 	km.Name = k.Prefix() + kairosSanitize(incomingMetric.Name)
 	km.Value = incomingMetric.Value
 	km.MetricType = "double"
+	if len(incomingMetric.Distribution) > 0 {
+		km.Value = newKairosHistogram(incomingMetric.Distribution)
+		km.MetricType = "kairos_histogram"
+	}
+	km.TTL = k.ttlFor(incomingMetric)
 	km.Timestamp = time.Now().Unix() * 1000 // Kairos require timestamps to be milliseconds
 	km.Tags = make(map[string]string)
 	for key, value := range incomingMetric.GetDimensions(k.DefaultDimensions()) {
@@ -103,6 +257,32 @@ func (k Kairos) convertToKairos(incomingMetric metric.Metric) (datapoint KairosM
 	return *km
 }
 
+// newKairosHistogram counts the samples of a distribution by value
+func newKairosHistogram(samples []float64) KairosHistogram {
+	histogram := KairosHistogram{
+		Bins: make(map[string]int),
+		Min:  samples[0],
+		Max:  samples[0],
+	}
+	for _, sample := range samples {
+		histogram.Bins[strconv.FormatFloat(sample, 'f', -1, 64)]++
+		histogram.Sum += sample
+		if sample < histogram.Min {
+			histogram.Min = sample
+		}
+		if sample > histogram.Max {
+			histogram.Max = sample
+		}
+	}
+	return histogram
+}
+
+// payloadSize is the size of a metric in the datapoints payload
+func (k *Kairos) payloadSize(m metric.Metric) int {
+	serialized, _ := json.Marshal(k.convertToKairos(m))
+	return len(serialized) + 1
+}
+
 func (k *Kairos) emitMetrics(metrics []metric.Metric) bool {
 	k.log.Info("Starting to emit ", len(metrics), " metrics")
 
@@ -111,70 +291,195 @@ func (k *Kairos) emitMetrics(metrics []metric.Metric) bool {
 		return false
 	}
 
+	if k.shards == nil {
+		k.log.Error("There is no Kairos server to send to, dropping ", len(metrics), " metrics")
+		return false
+	}
+
+	return k.shards.emitPartial(metrics, k.seriesKey, k.post)
+}
+
+// seriesKey identifies a series, all its datapoints go to the same server
+func (k Kairos) seriesKey(incomingMetric metric.Metric) string {
+	key := incomingMetric.Name
+	dimensions := incomingMetric.GetDimensions(k.DefaultDimensions())
+	for _, name := range sortedKeys(dimensions) {
+		key += "," + name + "=" + dimensions[name]
+	}
+	return key
+}
+
+// post returns the metrics that were not sent to the Kairos server
+func (k *Kairos) post(addr string, metrics []metric.Metric) []metric.Metric {
 	series := make([]KairosMetric, 0, len(metrics))
 	for _, m := range metrics {
 		series = append(series, k.convertToKairos(m))
 	}
 
+	unsent := k.postSeries(addr, series)
+	failed := make([]metric.Metric, 0, len(unsent))
+	for _, i := range unsent {
+		failed = append(failed, metrics[i])
+	}
+	return failed
+}
+
+// kairosMaxRequests bounds the requests sent to isolate the malformed
+// datapoints of a batch
+const kairosMaxRequests = 32
+
+// kairosPostResult holds the indexes of the datapoints Kairos rejected and
+// of the ones that were not sent because any other error occurred
+type kairosPostResult struct {
+	sent     int
+	rejected []int
+	unsent   []int
+}
+
+// postSeries sends datapoints to a Kairos server and returns the indexes of
+// the ones that were not sent. The datapoints Kairos rejects are dropped and
+// the others are sent again, when it does not name them the batch is bisected
+// to isolate them. A batch none of whose datapoints got through was rejected
+// as a whole and is not sent at all.
+func (k *Kairos) postSeries(addr string, series []KairosMetric) []int {
+	indexes := make([]int, len(series))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	budget := kairosMaxRequests
+	result := k.postSplitting(addr, series, indexes, &budget)
+	if result.sent == 0 {
+		return indexes
+	}
+	if len(result.rejected) > 0 {
+		k.log.Warn("Dropped ", len(result.rejected), " malformed datapoints")
+		atomic.AddUint64(&k.pointsRejected, uint64(len(result.rejected)))
+	}
+	return result.unsent
+}
+
+// postSplitting sends the datapoints of series at indexes, the indexes of
+// the result never share the backing array of the ones passed in
+func (k *Kairos) postSplitting(addr string, series []KairosMetric, indexes []int, budget *int) kairosPostResult {
+	if *budget <= 0 {
+		k.log.Error("Giving up on isolating malformed datapoints after ", kairosMaxRequests, " requests")
+		return kairosPostResult{unsent: append([]int(nil), indexes...)}
+	}
+	*budget--
+
+	batch := make([]KairosMetric, 0, len(indexes))
+	for _, i := range indexes {
+		batch = append(batch, series[i])
+	}
+	status, body := k.postOnce(addr, batch)
+	switch {
+	case status == http.StatusNoContent:
+		return kairosPostResult{sent: len(indexes)}
+	case status != http.StatusBadRequest:
+		return kairosPostResult{unsent: append([]int(nil), indexes...)}
+	}
+
+	malformed := k.malformedIndexes(body, batch)
+	if len(malformed) > 0 {
+		var rejected, remaining []int
+		for i, index := range indexes {
+			if malformed[i] {
+				rejected = append(rejected, index)
+			} else {
+				remaining = append(remaining, index)
+			}
+		}
+		k.log.Warn("Kairos named ", len(rejected), " malformed datapoints, sending the others again")
+		var result kairosPostResult
+		if len(remaining) > 0 {
+			result = k.postSplitting(addr, series, remaining, budget)
+		}
+		result.rejected = append(result.rejected, rejected...)
+		return result
+	}
+
+	if len(indexes) == 1 {
+		return kairosPostResult{rejected: []int{indexes[0]}}
+	}
+	half := len(indexes) / 2
+	first := k.postSplitting(addr, series, indexes[:half], budget)
+	if len(first.unsent) > 0 {
+		first.unsent = append(first.unsent, indexes[half:]...)
+		return first
+	}
+	second := k.postSplitting(addr, series, indexes[half:], budget)
+	return kairosPostResult{
+		sent:     first.sent + second.sent,
+		rejected: append(first.rejected, second.rejected...),
+		unsent:   second.unsent,
+	}
+}
+
+// postOnce sends datapoints in one request, it returns the status and body of the
+// response or 0 when there was none
+func (k *Kairos) postOnce(addr string, series []KairosMetric) (int, string) {
 	payload, err := json.Marshal(series)
 	if err != nil {
 		k.log.Error("Failed marshaling datapoints to Kairos format")
 		k.log.Error("Dropping Kairos datapoints ", series)
-		return false
+		return 0, ""
 	}
 
-	apiURL := fmt.Sprintf("http://%s:%s/api/v1/datapoints", k.server, k.port)
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(payload))
-	if err != nil {
-		k.log.Error("Failed to create a request to API url ", apiURL)
-		return false
+	apiURL := fmt.Sprintf("%s://%s/api/v1/datapoints", k.scheme, addr)
+	if k.httpClient == nil {
+		k.log.Error("The http client is not initialized, dropping ", len(series), " datapoints")
+		return 0, ""
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	transport := http.Transport{
-		Dial: k.dialTimeout,
+	headers := map[string]string{"Content-Type": "application/json"}
+	if k.username != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(k.username+":"+k.password))
 	}
-	client := &http.Client{
-		Transport: &transport,
+	compressed, encoding := k.compress(payload)
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
 	}
-	rsp, err := client.Do(req)
+
+	rsp, err := k.httpClient.MakeRequest("POST", apiURL, bytes.NewBuffer(compressed), headers)
 	if err != nil {
 		k.log.Error("Failed to complete POST ", err)
-		return false
+		return 0, ""
 	}
 
-	defer rsp.Body.Close()
 	if rsp.StatusCode == http.StatusNoContent {
 		k.log.Info("Successfully sent ", len(series), " datapoints to Kairos")
-		return true
+		return rsp.StatusCode, ""
 	}
 
-	body, _ := ioutil.ReadAll(rsp.Body)
-	if (rsp.StatusCode / 100) == 4 {
+	if rsp.StatusCode == http.StatusBadRequest {
 		k.log.Error("Failed to post to Kairos @", apiURL,
-			" status was ", rsp.Status,
-			" rsp body was ", string(body),
-			" malformed metrics are ", k.parseServerError(string(body), series))
+			" status was ", rsp.StatusCode,
+			" rsp body was ", string(rsp.Body),
+			" malformed metrics are ", k.parseServerError(string(rsp.Body), series))
 	} else {
 		k.log.Error("Failed to post to Kairos @", apiURL,
-			" status was ", rsp.Status,
-			" rsp body was ", string(body))
+			" status was ", rsp.StatusCode,
+			" rsp body was ", string(rsp.Body))
 	}
-
-	return false
+	return rsp.StatusCode, string(rsp.Body)
 }
 
-func (k Kairos) dialTimeout(network, addr string) (net.Conn, error) {
-	return net.DialTimeout(network, addr, k.timeout)
+// malformedIndexes returns the datapoints named in a Kairos error
+func (k Kairos) malformedIndexes(errMsg string, metrics []KairosMetric) map[int]bool {
+	malformed := make(map[int]bool)
+	for _, match := range kairosErrorIndex.FindAllStringSubmatch(errMsg, -1) {
+		if i, err := strconv.Atoi(match[1]); err == nil && i < len(metrics) {
+			malformed[i] = true
+		}
+	}
+	return malformed
 }
 
-func (k Kairos) parseServerError(errMsg string, metrics []KairosMetric) string {
-	re, err := regexp.Compile(`metric\[([0-9]+)\]`)
-	if err != nil {
-		return ""
-	}
+var kairosErrorIndex = regexp.MustCompile(`metric\[([0-9]+)\]`)
 
-	result := re.FindAllStringSubmatch(errMsg, -1)
+func (k Kairos) parseServerError(errMsg string, metrics []KairosMetric) string {
+	result := kairosErrorIndex.FindAllStringSubmatch(errMsg, -1)
 	if len(result) == 0 {
 		return ""
 	}
@@ -182,7 +487,7 @@ func (k Kairos) parseServerError(errMsg string, metrics []KairosMetric) string {
 	errMetrics := make([]KairosMetric, 0, len(result))
 	for i := range result {
 		v, err := strconv.Atoi(result[i][1])
-		if err == nil {
+		if err == nil && v < len(metrics) {
 			errMetrics = append(errMetrics, metrics[v])
 		}
 	}
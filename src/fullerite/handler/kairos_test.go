@@ -3,11 +3,13 @@ package handler
 import (
 	"fullerite/metric"
 
+	"compress/gzip"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -219,3 +221,312 @@ func TestKairosDimensionsOverwriting(t *testing.T) {
 
 	assert.Equal(t, len(datapoint.Tags), 1, "the two metrics should be the same")
 }
+
+func TestKairosConfigureDestinations(t *testing.T) {
+	k := getTestKairosHandler(12, 13, 14)
+	k.Configure(map[string]interface{}{
+		"destinations":             []interface{}{"kairos1:8080", "kairos2:8080"},
+		"destinationRetryInterval": "10",
+	})
+
+	assert.Equal(t, []string{"kairos1:8080", "kairos2:8080"}, k.Destinations())
+	assert.Equal(t, 2, len(k.shards.destinations))
+
+	internal := k.InternalMetrics()
+	assert.Equal(t, 0.0, internal.Counters["metricsSent.kairos1:8080"])
+	assert.Equal(t, 0.0, internal.Counters["metricsFailedOver.kairos2:8080"])
+}
+
+func TestKairosEmitMetricsSharded(t *testing.T) {
+	received := make(chan string, 10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var kairosMetrics []KairosMetric
+		json.Unmarshal(body, &kairosMetrics)
+		for _, km := range kairosMetrics {
+			received <- r.Host + " " + km.Name
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	k := getTestKairosHandler(12, 13, 1)
+	k.Configure(map[string]interface{}{
+		"destinations": []interface{}{firstURL.Host, secondURL.Host},
+	})
+
+	var metrics []metric.Metric
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		metrics = append(metrics, metric.New(name))
+	}
+	assert.True(t, k.emitMetrics(metrics))
+	close(received)
+
+	hosts := make(map[string]string)
+	for line := range received {
+		parts := strings.Fields(line)
+		hosts[parts[1]] = parts[0]
+	}
+	assert.Equal(t, len(metrics), len(hosts))
+
+	internal := k.InternalMetrics()
+	assert.Equal(t, float64(len(metrics)),
+		internal.Counters["metricsSent."+firstURL.Host]+internal.Counters["metricsSent."+secondURL.Host])
+
+	// the same series always go to the same server
+	for _, m := range metrics {
+		assert.Equal(t, k.shards.destinations[k.shards.ring.getNodes(k.seriesKey(m))[0]].addr, hosts[m.Name])
+	}
+}
+
+func TestKairosEmitMetricsCompressed(t *testing.T) {
+	var encoding string
+	var kairosMetrics []KairosMetric
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		reader, err := gzip.NewReader(r.Body)
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(reader)
+		json.Unmarshal(body, &kairosMetrics)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	tsURL, _ := url.Parse(ts.URL)
+	k := getTestKairosHandler(12, 13, 1)
+	k.Configure(map[string]interface{}{
+		"destinations": []interface{}{tsURL.Host},
+		"compression":  "gzip",
+	})
+
+	assert.True(t, k.emitMetrics([]metric.Metric{metric.New("Test")}))
+	assert.Equal(t, "gzip", encoding)
+	assert.Equal(t, 1, len(kairosMetrics))
+	assert.Equal(t, "Test", kairosMetrics[0].Name)
+
+	internal := k.InternalMetrics()
+	assert.True(t, internal.Counters["bytesSent"] > 0)
+	assert.True(t, internal.Counters["bytesUncompressed"] > 0)
+}
+
+func TestKairosEmitMetricsReusesConnections(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	tsURL, _ := url.Parse(ts.URL)
+	k := getTestKairosHandler(12, 13, 1)
+	k.Configure(map[string]interface{}{"destinations": []interface{}{tsURL.Host}})
+
+	assert.True(t, k.emitMetrics([]metric.Metric{metric.New("first")}))
+	assert.True(t, k.emitMetrics([]metric.Metric{metric.New("second")}))
+
+	internal := k.InternalMetrics()
+	assert.Equal(t, 2.0, internal.Counters["httpRequests"])
+	assert.Equal(t, 1.0, internal.Counters["httpConnectionsCreated"])
+	assert.Equal(t, 1.0, internal.Counters["httpConnectionsReused"])
+}
+
+func TestKairosConfigureSchemeAndAuth(t *testing.T) {
+	var authorization string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	tsURL, _ := url.Parse(ts.URL)
+	k := getTestKairosHandler(12, 13, 1)
+	k.Configure(map[string]interface{}{
+		"destinations": []interface{}{tsURL.Host},
+		"scheme":       "https",
+		"username":     "user",
+		"password":     "secret",
+		"tls":          map[string]interface{}{"insecureSkipVerify": true},
+	})
+
+	assert.Equal(t, "https", k.scheme)
+	assert.True(t, k.emitMetrics([]metric.Metric{metric.New("Test")}))
+	assert.Equal(t, "Basic dXNlcjpzZWNyZXQ=", authorization)
+}
+
+func TestKairosTTL(t *testing.T) {
+	k := getTestKairosHandler(12, 13, 14)
+	k.Configure(map[string]interface{}{
+		"ttl":           3600,
+		"collectorTTLs": map[string]interface{}{"Diamond": "86400"},
+		"metricTTLs":    map[string]interface{}{"^debug\\.": 60},
+	})
+
+	diamond := metric.New("cpu")
+	diamond.AddDimension("collector", "Diamond")
+	debug := metric.New("debug.cpu")
+	debug.AddDimension("collector", "Diamond")
+
+	assert.Equal(t, 3600, k.convertToKairos(metric.New("cpu")).TTL)
+	assert.Equal(t, 86400, k.convertToKairos(diamond).TTL)
+	assert.Equal(t, 60, k.convertToKairos(debug).TTL)
+}
+
+func TestKairosHistogram(t *testing.T) {
+	k := getTestKairosHandler(12, 13, 14)
+
+	m := metric.New("latency")
+	m.Distribution = []float64{3, 1.5, 1.5}
+	km := k.convertToKairos(m)
+
+	assert.Equal(t, "kairos_histogram", km.MetricType)
+	assert.Equal(t, KairosHistogram{
+		Bins: map[string]int{"1.5": 2, "3": 1},
+		Min:  1.5,
+		Max:  3,
+		Sum:  6,
+	}, km.Value)
+	assert.Equal(t, "double", k.convertToKairos(metric.New("load")).MetricType)
+}
+
+func TestKairosEmitMetricsDropsMalformedPoints(t *testing.T) {
+	var requests int
+	var sent []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		var kairosMetrics []KairosMetric
+		json.Unmarshal(body, &kairosMetrics)
+		for _, km := range kairosMetrics {
+			if strings.HasPrefix(km.Name, "bad") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["value may not be empty."]}`))
+				return
+			}
+		}
+		for _, km := range kairosMetrics {
+			sent = append(sent, km.Name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	tsURL, _ := url.Parse(ts.URL)
+	k := getTestKairosHandler(12, 13, 1)
+	k.Configure(map[string]interface{}{"destinations": []interface{}{tsURL.Host}})
+
+	var metrics []metric.Metric
+	for _, name := range []string{"a", "b", "bad", "c"} {
+		metrics = append(metrics, metric.New(name))
+	}
+	assert.True(t, k.emitMetrics(metrics))
+	assert.Equal(t, []string{"a", "b", "c"}, sent)
+	assert.Equal(t, 1.0, k.InternalMetrics().Counters["pointsRejected"])
+	assert.True(t, requests > 1)
+}
+
+func TestKairosEmitMetricsDropsIndexedMalformedPoints(t *testing.T) {
+	var bodies [][]KairosMetric
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var kairosMetrics []KairosMetric
+		json.Unmarshal(body, &kairosMetrics)
+		bodies = append(bodies, kairosMetrics)
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["metric[1](name=b).tag[somedim].value may not be empty."]}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	tsURL, _ := url.Parse(ts.URL)
+	k := getTestKairosHandler(12, 13, 1)
+	k.Configure(map[string]interface{}{"destinations": []interface{}{tsURL.Host}})
+
+	metrics := []metric.Metric{metric.New("a"), metric.New("b"), metric.New("c")}
+	assert.True(t, k.emitMetrics(metrics))
+	assert.Equal(t, 2, len(bodies))
+	assert.Equal(t, 2, len(bodies[1]))
+	assert.Equal(t, "a", bodies[1][0].Name)
+	assert.Equal(t, "c", bodies[1][1].Name)
+	assert.Equal(t, 1.0, k.InternalMetrics().Counters["pointsRejected"])
+}
+
+func TestKairosEmitMetricsBatchRejectedAsAWhole(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errors":["Unsupported Content-Encoding"]}`))
+	}))
+	defer ts.Close()
+
+	tsURL, _ := url.Parse(ts.URL)
+	k := getTestKairosHandler(12, 13, 1)
+	k.Configure(map[string]interface{}{"destinations": []interface{}{tsURL.Host}})
+
+	var metrics []metric.Metric
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, metric.New("m"+strconv.Itoa(i)))
+	}
+	assert.False(t, k.emitMetrics(metrics))
+	assert.True(t, requests <= kairosMaxRequests, "%d requests", requests)
+	assert.Equal(t, 0.0, k.InternalMetrics().Counters["pointsRejected"])
+}
+
+func TestKairosEmitMetricsAllPointsNamedMalformed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"errors":["metric[0](name=a).value may not be empty.","metric[1](name=b).value may not be empty."]}`))
+	}))
+	defer ts.Close()
+
+	tsURL, _ := url.Parse(ts.URL)
+	k := getTestKairosHandler(12, 13, 1)
+	k.Configure(map[string]interface{}{"destinations": []interface{}{tsURL.Host}})
+
+	assert.False(t, k.emitMetrics([]metric.Metric{metric.New("a"), metric.New("b")}))
+	assert.Equal(t, 0.0, k.InternalMetrics().Counters["pointsRejected"])
+}
+
+func TestKairosPostSeriesReturnsUnsentPoints(t *testing.T) {
+	var sent []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var kairosMetrics []KairosMetric
+		json.Unmarshal(body, &kairosMetrics)
+		for _, km := range kairosMetrics {
+			if km.Name == "bad" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		for _, km := range kairosMetrics {
+			if km.Name == "down" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		for _, km := range kairosMetrics {
+			sent = append(sent, km.Name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	tsURL, _ := url.Parse(ts.URL)
+	k := getTestKairosHandler(12, 13, 1)
+	k.Configure(map[string]interface{}{"destinations": []interface{}{tsURL.Host}})
+
+	var series []KairosMetric
+	for _, name := range []string{"a", "bad", "down", "c"} {
+		series = append(series, k.convertToKairos(metric.New(name)))
+	}
+	assert.Equal(t, []int{2, 3}, k.postSeries(tsURL.Host, series))
+	assert.Equal(t, []string{"a"}, sent)
+	assert.Equal(t, 1.0, k.InternalMetrics().Counters["pointsRejected"])
+}
@@ -0,0 +1,362 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/handler/otlp"
+	"fullerite/metric"
+
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/http2"
+)
+
+func init() {
+	RegisterHandler("OTLP", newOTLP)
+}
+
+const (
+	otlpProtocolHTTP = "http/protobuf"
+	otlpProtocolGRPC = "grpc"
+
+	defaultOTLPHTTPEndpoint = "http://localhost:4318/v1/metrics"
+	defaultOTLPGRPCEndpoint = "http://localhost:4317"
+
+	otlpGRPCExportPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+	otlpScopeName      = "fullerite"
+	otlpServiceNameKey = "service.name"
+)
+
+// OTLP handler sends metrics to an OpenTelemetry collector
+type OTLP struct {
+	BaseHandler
+	endpoint string
+	protocol string
+	headers  map[string]string
+
+	// start of the cumulative counters, reported
+	// as start_time_unix_nano of their datapoints
+	startTime time.Time
+
+	grpcClient *http.Client
+}
+
+// newOTLP returns a new OTLP handler
+func newOTLP(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(OTLP)
+	inst.name = "OTLP"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.log = log
+	inst.channel = channel
+
+	inst.protocol = otlpProtocolHTTP
+	inst.headers = make(map[string]string)
+	inst.startTime = time.Now()
+
+	return inst
+}
+
+// Configure accepts the different configuration options for the OTLP handler
+func (o *OTLP) Configure(configMap map[string]interface{}) {
+	if protocol, exists := configMap["protocol"]; exists {
+		switch protocol {
+		case otlpProtocolHTTP, otlpProtocolGRPC:
+			o.protocol = protocol.(string)
+		default:
+			o.log.Warn("Unknown protocol ", protocol, ", using ", otlpProtocolHTTP)
+		}
+	}
+
+	if endpoint, exists := configMap["endpoint"]; exists {
+		o.endpoint = endpoint.(string)
+	} else if o.protocol == otlpProtocolGRPC {
+		o.endpoint = defaultOTLPGRPCEndpoint
+	} else {
+		o.endpoint = defaultOTLPHTTPEndpoint
+	}
+
+	if headers, exists := configMap["headers"]; exists {
+		o.headers = config.GetAsMap(headers)
+	}
+
+	o.configureCommonParams(configMap)
+
+	// gRPC servers only have gzip registered by default
+	if o.protocol == otlpProtocolGRPC && o.Compression() == compressionDeflate {
+		o.log.Warn("The OTLP gRPC exporter does not support deflate, using gzip")
+		o.SetCompression(compressionGzip)
+	}
+}
+
+// Endpoint returns the OTLP receiver's endpoint
+func (o OTLP) Endpoint() string {
+	return o.endpoint
+}
+
+// Protocol returns the OTLP transport, http/protobuf or grpc
+func (o OTLP) Protocol() string {
+	return o.protocol
+}
+
+// Run runs the handler main loop
+func (o *OTLP) Run() {
+	if o.protocol == otlpProtocolGRPC {
+		o.grpcClient = o.newGRPCClient()
+	}
+
+	o.run(o.emitMetrics)
+}
+
+// newGRPCClient returns an HTTP/2 client, plaintext endpoints
+// are reached with prior knowledge (h2c) as gRPC servers expect
+func (o OTLP) newGRPCClient() *http.Client {
+	// http2.Transport has no proxy support, gRPC exports always connect directly
+	transport := &http2.Transport{TLSClientConfig: o.tlsConfig}
+	if strings.HasPrefix(o.endpoint, "http://") {
+		transport.AllowHTTP = true
+		transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, o.timeout)
+		}
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   o.timeout,
+	}
+}
+
+func (o OTLP) convertToOTLP(metrics []metric.Metric, now time.Time) *otlp.ExportMetricsServiceRequest {
+	defaultDimensions := o.DefaultDimensions()
+
+	resource := &otlp.Resource{}
+	if _, exists := defaultDimensions[otlpServiceNameKey]; !exists {
+		resource.Attributes = append(resource.Attributes, otlpAttribute(otlpServiceNameKey, "fullerite"))
+	}
+	for _, key := range sortedKeys(defaultDimensions) {
+		resource.Attributes = append(resource.Attributes, otlpAttribute(key, defaultDimensions[key]))
+	}
+
+	// datapoints of metrics sharing a name and a type are
+	// grouped under the same OTLP metric
+	var otlpMetrics []*otlp.Metric
+	byName := make(map[string]*otlp.Metric)
+	for _, m := range metrics {
+		key := m.MetricType + "|" + m.Name
+		om, exists := byName[key]
+		if !exists {
+			om = newOTLPMetric(o.Prefix()+m.Name, m.MetricType)
+			byName[key] = om
+			otlpMetrics = append(otlpMetrics, om)
+		}
+
+		datapoint := o.convertToOTLPDataPoint(m, now, defaultDimensions)
+		if om.Sum != nil {
+			om.Sum.DataPoints = append(om.Sum.DataPoints, datapoint)
+		} else {
+			om.Gauge.DataPoints = append(om.Gauge.DataPoints, datapoint)
+		}
+	}
+
+	return &otlp.ExportMetricsServiceRequest{
+		ResourceMetrics: []*otlp.ResourceMetrics{
+			&otlp.ResourceMetrics{
+				Resource: resource,
+				ScopeMetrics: []*otlp.ScopeMetrics{
+					&otlp.ScopeMetrics{
+						Scope:   &otlp.InstrumentationScope{Name: proto.String(otlpScopeName)},
+						Metrics: otlpMetrics,
+					},
+				},
+			},
+		},
+	}
+}
+
+func newOTLPMetric(name string, metricType string) *otlp.Metric {
+	om := &otlp.Metric{Name: proto.String(name)}
+	switch metricType {
+	case metric.CumulativeCounter:
+		om.Sum = &otlp.Sum{
+			AggregationTemporality: otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE.Enum(),
+			IsMonotonic:            proto.Bool(true),
+		}
+	case metric.Counter:
+		om.Sum = &otlp.Sum{
+			AggregationTemporality: otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA.Enum(),
+			IsMonotonic:            proto.Bool(true),
+		}
+	default:
+		om.Gauge = &otlp.Gauge{}
+	}
+	return om
+}
+
+func (o OTLP) convertToOTLPDataPoint(m metric.Metric, now time.Time, defaultDimensions map[string]string) *otlp.NumberDataPoint {
+	datapoint := &otlp.NumberDataPoint{
+		TimeUnixNano: proto.Uint64(uint64(now.UnixNano())),
+		AsDouble:     proto.Float64(m.Value),
+	}
+
+	switch m.MetricType {
+	case metric.CumulativeCounter:
+		datapoint.StartTimeUnixNano = proto.Uint64(uint64(o.startTime.UnixNano()))
+	case metric.Counter:
+		start := now.Add(-time.Duration(o.interval) * time.Second)
+		datapoint.StartTimeUnixNano = proto.Uint64(uint64(start.UnixNano()))
+	}
+
+	// default dimensions are already reported as resource attributes
+	for _, key := range sortedKeys(m.Dimensions) {
+		if _, exists := defaultDimensions[key]; exists {
+			continue
+		}
+		datapoint.Attributes = append(datapoint.Attributes, otlpAttribute(key, m.Dimensions[key]))
+	}
+	return datapoint
+}
+
+func otlpAttribute(key, value string) *otlp.KeyValue {
+	return &otlp.KeyValue{
+		Key:   proto.String(key),
+		Value: &otlp.AnyValue{StringValue: proto.String(value)},
+	}
+}
+
+func (o *OTLP) emitMetrics(metrics []metric.Metric) bool {
+	o.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if len(metrics) == 0 {
+		o.log.Warn("Skipping send because of an empty payload")
+		return false
+	}
+
+	serialized, err := proto.Marshal(o.convertToOTLP(metrics, time.Now()))
+	if err != nil {
+		o.log.Error("Failed to serialize the OTLP export request ", err)
+		return false
+	}
+
+	var response []byte
+	if o.protocol == otlpProtocolGRPC {
+		response, err = o.exportGRPC(serialized)
+	} else {
+		response, err = o.exportHTTP(serialized)
+	}
+	if err != nil {
+		o.log.Error("Failed to export to ", o.endpoint, ": ", err)
+		return false
+	}
+
+	exportResponse := new(otlp.ExportMetricsServiceResponse)
+	if err := proto.Unmarshal(response, exportResponse); err == nil {
+		if rejected := exportResponse.GetPartialSuccess().GetRejectedDataPoints(); rejected > 0 {
+			o.log.Warn("The OTLP receiver rejected ", rejected, " of ", len(metrics), " datapoints: ",
+				exportResponse.GetPartialSuccess().GetErrorMessage())
+		}
+	}
+
+	o.log.Info("Successfully sent ", len(metrics), " datapoints to ", o.endpoint)
+	return true
+}
+
+func (o *OTLP) exportHTTP(serialized []byte) ([]byte, error) {
+	if o.httpClient == nil {
+		return nil, fmt.Errorf("the http client is not initialized")
+	}
+
+	headers := map[string]string{"Content-Type": "application/x-protobuf"}
+	for key, value := range o.headers {
+		headers[key] = value
+	}
+
+	compressed, encoding := o.compress(serialized)
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+
+	rsp, err := o.httpClient.MakeRequest("POST", o.endpoint, bytes.NewBuffer(compressed), headers)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status was %d, rsp body was %s", rsp.StatusCode, string(rsp.Body))
+	}
+	return rsp.Body, nil
+}
+
+func (o *OTLP) exportGRPC(serialized []byte) ([]byte, error) {
+	if o.grpcClient == nil {
+		return nil, fmt.Errorf("the grpc client is not initialized")
+	}
+
+	// gRPC messages are prefixed by a compressed flag
+	// and their length as a big endian uint32
+	compressed, encoding := o.compress(serialized)
+	frame := make([]byte, 5+len(compressed))
+	if encoding != "" {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(compressed)))
+	copy(frame[5:], compressed)
+
+	uri := strings.TrimRight(o.endpoint, "/") + otlpGRPCExportPath
+	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(frame))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+	if encoding != "" {
+		req.Header.Set("Grpc-Encoding", encoding)
+	}
+	for key, value := range o.headers {
+		req.Header.Set(key, value)
+	}
+
+	rsp, err := o.grpcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status was %d", rsp.StatusCode)
+	}
+
+	// errors without a response message are sent as headers only
+	status := rsp.Header.Get("Grpc-Status")
+	message := rsp.Header.Get("Grpc-Message")
+	if status == "" {
+		status = rsp.Trailer.Get("Grpc-Status")
+		message = rsp.Trailer.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return nil, fmt.Errorf("grpc status was %s: %s", status, message)
+	}
+
+	if len(body) < 5 {
+		return nil, nil
+	}
+	return body[5:], nil
+}
@@ -0,0 +1,457 @@
+// Code generated by protoc-gen-go.
+// source: src/fullerite/handler/otlp/otlp.proto
+// DO NOT EDIT!
+
+/*
+Package otlp is a generated protocol buffer package.
+
+It is generated from these files:
+	src/fullerite/handler/otlp/otlp.proto
+
+It has these top-level messages:
+	AnyValue
+	KeyValue
+	Resource
+	InstrumentationScope
+	NumberDataPoint
+	Gauge
+	Sum
+	Metric
+	ScopeMetrics
+	ResourceMetrics
+	ExportMetricsServiceRequest
+	ExportMetricsPartialSuccess
+	ExportMetricsServiceResponse
+*/
+package otlp
+
+import proto "github.com/golang/protobuf/proto"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = math.Inf
+
+type AggregationTemporality int32
+
+const (
+	AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED AggregationTemporality = 0
+	AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA       AggregationTemporality = 1
+	AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE  AggregationTemporality = 2
+)
+
+var AggregationTemporality_name = map[int32]string{
+	0: "AGGREGATION_TEMPORALITY_UNSPECIFIED",
+	1: "AGGREGATION_TEMPORALITY_DELTA",
+	2: "AGGREGATION_TEMPORALITY_CUMULATIVE",
+}
+var AggregationTemporality_value = map[string]int32{
+	"AGGREGATION_TEMPORALITY_UNSPECIFIED": 0,
+	"AGGREGATION_TEMPORALITY_DELTA":       1,
+	"AGGREGATION_TEMPORALITY_CUMULATIVE":  2,
+}
+
+func (x AggregationTemporality) Enum() *AggregationTemporality {
+	p := new(AggregationTemporality)
+	*p = x
+	return p
+}
+func (x AggregationTemporality) String() string {
+	return proto.EnumName(AggregationTemporality_name, int32(x))
+}
+func (x *AggregationTemporality) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(AggregationTemporality_value, data, "AggregationTemporality")
+	if err != nil {
+		return err
+	}
+	*x = AggregationTemporality(value)
+	return nil
+}
+
+type AnyValue struct {
+	StringValue      *string  `protobuf:"bytes,1,opt,name=string_value" json:"string_value,omitempty"`
+	BoolValue        *bool    `protobuf:"varint,2,opt,name=bool_value" json:"bool_value,omitempty"`
+	IntValue         *int64   `protobuf:"varint,3,opt,name=int_value" json:"int_value,omitempty"`
+	DoubleValue      *float64 `protobuf:"fixed64,4,opt,name=double_value" json:"double_value,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *AnyValue) Reset()         { *m = AnyValue{} }
+func (m *AnyValue) String() string { return proto.CompactTextString(m) }
+func (*AnyValue) ProtoMessage()    {}
+
+func (m *AnyValue) GetStringValue() string {
+	if m != nil && m.StringValue != nil {
+		return *m.StringValue
+	}
+	return ""
+}
+
+func (m *AnyValue) GetBoolValue() bool {
+	if m != nil && m.BoolValue != nil {
+		return *m.BoolValue
+	}
+	return false
+}
+
+func (m *AnyValue) GetIntValue() int64 {
+	if m != nil && m.IntValue != nil {
+		return *m.IntValue
+	}
+	return 0
+}
+
+func (m *AnyValue) GetDoubleValue() float64 {
+	if m != nil && m.DoubleValue != nil {
+		return *m.DoubleValue
+	}
+	return 0
+}
+
+type KeyValue struct {
+	Key              *string   `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	Value            *AnyValue `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte    `json:"-"`
+}
+
+func (m *KeyValue) Reset()         { *m = KeyValue{} }
+func (m *KeyValue) String() string { return proto.CompactTextString(m) }
+func (*KeyValue) ProtoMessage()    {}
+
+func (m *KeyValue) GetKey() string {
+	if m != nil && m.Key != nil {
+		return *m.Key
+	}
+	return ""
+}
+
+func (m *KeyValue) GetValue() *AnyValue {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+type Resource struct {
+	Attributes             []*KeyValue `protobuf:"bytes,1,rep,name=attributes" json:"attributes,omitempty"`
+	DroppedAttributesCount *uint32     `protobuf:"varint,2,opt,name=dropped_attributes_count" json:"dropped_attributes_count,omitempty"`
+	XXX_unrecognized       []byte      `json:"-"`
+}
+
+func (m *Resource) Reset()         { *m = Resource{} }
+func (m *Resource) String() string { return proto.CompactTextString(m) }
+func (*Resource) ProtoMessage()    {}
+
+func (m *Resource) GetAttributes() []*KeyValue {
+	if m != nil {
+		return m.Attributes
+	}
+	return nil
+}
+
+func (m *Resource) GetDroppedAttributesCount() uint32 {
+	if m != nil && m.DroppedAttributesCount != nil {
+		return *m.DroppedAttributesCount
+	}
+	return 0
+}
+
+type InstrumentationScope struct {
+	Name             *string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Version          *string `protobuf:"bytes,2,opt,name=version" json:"version,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *InstrumentationScope) Reset()         { *m = InstrumentationScope{} }
+func (m *InstrumentationScope) String() string { return proto.CompactTextString(m) }
+func (*InstrumentationScope) ProtoMessage()    {}
+
+func (m *InstrumentationScope) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *InstrumentationScope) GetVersion() string {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return ""
+}
+
+type NumberDataPoint struct {
+	Attributes        []*KeyValue `protobuf:"bytes,7,rep,name=attributes" json:"attributes,omitempty"`
+	StartTimeUnixNano *uint64     `protobuf:"fixed64,2,opt,name=start_time_unix_nano" json:"start_time_unix_nano,omitempty"`
+	TimeUnixNano      *uint64     `protobuf:"fixed64,3,opt,name=time_unix_nano" json:"time_unix_nano,omitempty"`
+	AsDouble          *float64    `protobuf:"fixed64,4,opt,name=as_double" json:"as_double,omitempty"`
+	AsInt             *int64      `protobuf:"fixed64,6,opt,name=as_int" json:"as_int,omitempty"`
+	Flags             *uint32     `protobuf:"varint,8,opt,name=flags" json:"flags,omitempty"`
+	XXX_unrecognized  []byte      `json:"-"`
+}
+
+func (m *NumberDataPoint) Reset()         { *m = NumberDataPoint{} }
+func (m *NumberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*NumberDataPoint) ProtoMessage()    {}
+
+func (m *NumberDataPoint) GetAttributes() []*KeyValue {
+	if m != nil {
+		return m.Attributes
+	}
+	return nil
+}
+
+func (m *NumberDataPoint) GetStartTimeUnixNano() uint64 {
+	if m != nil && m.StartTimeUnixNano != nil {
+		return *m.StartTimeUnixNano
+	}
+	return 0
+}
+
+func (m *NumberDataPoint) GetTimeUnixNano() uint64 {
+	if m != nil && m.TimeUnixNano != nil {
+		return *m.TimeUnixNano
+	}
+	return 0
+}
+
+func (m *NumberDataPoint) GetAsDouble() float64 {
+	if m != nil && m.AsDouble != nil {
+		return *m.AsDouble
+	}
+	return 0
+}
+
+func (m *NumberDataPoint) GetAsInt() int64 {
+	if m != nil && m.AsInt != nil {
+		return *m.AsInt
+	}
+	return 0
+}
+
+func (m *NumberDataPoint) GetFlags() uint32 {
+	if m != nil && m.Flags != nil {
+		return *m.Flags
+	}
+	return 0
+}
+
+type Gauge struct {
+	DataPoints       []*NumberDataPoint `protobuf:"bytes,1,rep,name=data_points" json:"data_points,omitempty"`
+	XXX_unrecognized []byte             `json:"-"`
+}
+
+func (m *Gauge) Reset()         { *m = Gauge{} }
+func (m *Gauge) String() string { return proto.CompactTextString(m) }
+func (*Gauge) ProtoMessage()    {}
+
+func (m *Gauge) GetDataPoints() []*NumberDataPoint {
+	if m != nil {
+		return m.DataPoints
+	}
+	return nil
+}
+
+type Sum struct {
+	DataPoints             []*NumberDataPoint      `protobuf:"bytes,1,rep,name=data_points" json:"data_points,omitempty"`
+	AggregationTemporality *AggregationTemporality `protobuf:"varint,2,opt,name=aggregation_temporality,enum=otlp.AggregationTemporality" json:"aggregation_temporality,omitempty"`
+	IsMonotonic            *bool                   `protobuf:"varint,3,opt,name=is_monotonic" json:"is_monotonic,omitempty"`
+	XXX_unrecognized       []byte                  `json:"-"`
+}
+
+func (m *Sum) Reset()         { *m = Sum{} }
+func (m *Sum) String() string { return proto.CompactTextString(m) }
+func (*Sum) ProtoMessage()    {}
+
+func (m *Sum) GetDataPoints() []*NumberDataPoint {
+	if m != nil {
+		return m.DataPoints
+	}
+	return nil
+}
+
+func (m *Sum) GetAggregationTemporality() AggregationTemporality {
+	if m != nil && m.AggregationTemporality != nil {
+		return *m.AggregationTemporality
+	}
+	return AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED
+}
+
+func (m *Sum) GetIsMonotonic() bool {
+	if m != nil && m.IsMonotonic != nil {
+		return *m.IsMonotonic
+	}
+	return false
+}
+
+type Metric struct {
+	Name             *string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Description      *string `protobuf:"bytes,2,opt,name=description" json:"description,omitempty"`
+	Unit             *string `protobuf:"bytes,3,opt,name=unit" json:"unit,omitempty"`
+	Gauge            *Gauge  `protobuf:"bytes,5,opt,name=gauge" json:"gauge,omitempty"`
+	Sum              *Sum    `protobuf:"bytes,7,opt,name=sum" json:"sum,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Metric) Reset()         { *m = Metric{} }
+func (m *Metric) String() string { return proto.CompactTextString(m) }
+func (*Metric) ProtoMessage()    {}
+
+func (m *Metric) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *Metric) GetDescription() string {
+	if m != nil && m.Description != nil {
+		return *m.Description
+	}
+	return ""
+}
+
+func (m *Metric) GetUnit() string {
+	if m != nil && m.Unit != nil {
+		return *m.Unit
+	}
+	return ""
+}
+
+func (m *Metric) GetGauge() *Gauge {
+	if m != nil {
+		return m.Gauge
+	}
+	return nil
+}
+
+func (m *Metric) GetSum() *Sum {
+	if m != nil {
+		return m.Sum
+	}
+	return nil
+}
+
+type ScopeMetrics struct {
+	Scope            *InstrumentationScope `protobuf:"bytes,1,opt,name=scope" json:"scope,omitempty"`
+	Metrics          []*Metric             `protobuf:"bytes,2,rep,name=metrics" json:"metrics,omitempty"`
+	SchemaUrl        *string               `protobuf:"bytes,3,opt,name=schema_url" json:"schema_url,omitempty"`
+	XXX_unrecognized []byte                `json:"-"`
+}
+
+func (m *ScopeMetrics) Reset()         { *m = ScopeMetrics{} }
+func (m *ScopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*ScopeMetrics) ProtoMessage()    {}
+
+func (m *ScopeMetrics) GetScope() *InstrumentationScope {
+	if m != nil {
+		return m.Scope
+	}
+	return nil
+}
+
+func (m *ScopeMetrics) GetMetrics() []*Metric {
+	if m != nil {
+		return m.Metrics
+	}
+	return nil
+}
+
+func (m *ScopeMetrics) GetSchemaUrl() string {
+	if m != nil && m.SchemaUrl != nil {
+		return *m.SchemaUrl
+	}
+	return ""
+}
+
+type ResourceMetrics struct {
+	Resource         *Resource       `protobuf:"bytes,1,opt,name=resource" json:"resource,omitempty"`
+	ScopeMetrics     []*ScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics" json:"scope_metrics,omitempty"`
+	SchemaUrl        *string         `protobuf:"bytes,3,opt,name=schema_url" json:"schema_url,omitempty"`
+	XXX_unrecognized []byte          `json:"-"`
+}
+
+func (m *ResourceMetrics) Reset()         { *m = ResourceMetrics{} }
+func (m *ResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*ResourceMetrics) ProtoMessage()    {}
+
+func (m *ResourceMetrics) GetResource() *Resource {
+	if m != nil {
+		return m.Resource
+	}
+	return nil
+}
+
+func (m *ResourceMetrics) GetScopeMetrics() []*ScopeMetrics {
+	if m != nil {
+		return m.ScopeMetrics
+	}
+	return nil
+}
+
+func (m *ResourceMetrics) GetSchemaUrl() string {
+	if m != nil && m.SchemaUrl != nil {
+		return *m.SchemaUrl
+	}
+	return ""
+}
+
+type ExportMetricsServiceRequest struct {
+	ResourceMetrics  []*ResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics" json:"resource_metrics,omitempty"`
+	XXX_unrecognized []byte             `json:"-"`
+}
+
+func (m *ExportMetricsServiceRequest) Reset()         { *m = ExportMetricsServiceRequest{} }
+func (m *ExportMetricsServiceRequest) String() string { return proto.CompactTextString(m) }
+func (*ExportMetricsServiceRequest) ProtoMessage()    {}
+
+func (m *ExportMetricsServiceRequest) GetResourceMetrics() []*ResourceMetrics {
+	if m != nil {
+		return m.ResourceMetrics
+	}
+	return nil
+}
+
+type ExportMetricsPartialSuccess struct {
+	RejectedDataPoints *int64  `protobuf:"varint,1,opt,name=rejected_data_points" json:"rejected_data_points,omitempty"`
+	ErrorMessage       *string `protobuf:"bytes,2,opt,name=error_message" json:"error_message,omitempty"`
+	XXX_unrecognized   []byte  `json:"-"`
+}
+
+func (m *ExportMetricsPartialSuccess) Reset()         { *m = ExportMetricsPartialSuccess{} }
+func (m *ExportMetricsPartialSuccess) String() string { return proto.CompactTextString(m) }
+func (*ExportMetricsPartialSuccess) ProtoMessage()    {}
+
+func (m *ExportMetricsPartialSuccess) GetRejectedDataPoints() int64 {
+	if m != nil && m.RejectedDataPoints != nil {
+		return *m.RejectedDataPoints
+	}
+	return 0
+}
+
+func (m *ExportMetricsPartialSuccess) GetErrorMessage() string {
+	if m != nil && m.ErrorMessage != nil {
+		return *m.ErrorMessage
+	}
+	return ""
+}
+
+type ExportMetricsServiceResponse struct {
+	PartialSuccess   *ExportMetricsPartialSuccess `protobuf:"bytes,1,opt,name=partial_success" json:"partial_success,omitempty"`
+	XXX_unrecognized []byte                       `json:"-"`
+}
+
+func (m *ExportMetricsServiceResponse) Reset()         { *m = ExportMetricsServiceResponse{} }
+func (m *ExportMetricsServiceResponse) String() string { return proto.CompactTextString(m) }
+func (*ExportMetricsServiceResponse) ProtoMessage()    {}
+
+func (m *ExportMetricsServiceResponse) GetPartialSuccess() *ExportMetricsPartialSuccess {
+	if m != nil {
+		return m.PartialSuccess
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterEnum("otlp.AggregationTemporality", AggregationTemporality_name, AggregationTemporality_value)
+}
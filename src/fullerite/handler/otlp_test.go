@@ -0,0 +1,271 @@
+package handler
+
+import (
+	"fullerite/handler/otlp"
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func getTestOTLPHandler(interval, buffsize, timeoutsec int) *OTLP {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "otlp_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newOTLP(testChannel, interval, buffsize, timeout, testLog).(*OTLP)
+}
+
+func getTestOTLPMetrics() []metric.Metric {
+	gauge := metric.New("gauge")
+	gauge.Value = 1.5
+	gauge.AddDimension("app", "foo")
+	gauge.AddDimension("host", "overridden")
+
+	otherGauge := metric.New("gauge")
+	otherGauge.Value = 2.5
+	otherGauge.AddDimension("app", "bar")
+
+	counter := metric.New("counter")
+	counter.MetricType = metric.Counter
+	counter.Value = 3
+
+	cumcounter := metric.New("cumcounter")
+	cumcounter.MetricType = metric.CumulativeCounter
+	cumcounter.Value = 4
+
+	return []metric.Metric{gauge, otherGauge, counter, cumcounter}
+}
+
+func TestOTLPConfigureEmptyConfig(t *testing.T) {
+	config := make(map[string]interface{})
+
+	o := getTestOTLPHandler(12, 13, 14)
+	o.Configure(config)
+
+	assert.Equal(t, 12, o.Interval())
+	assert.Equal(t, 13, o.MaxBufferSize())
+	assert.Equal(t, otlpProtocolHTTP, o.Protocol())
+	assert.Equal(t, defaultOTLPHTTPEndpoint, o.Endpoint())
+}
+
+func TestOTLPConfigure(t *testing.T) {
+	config := map[string]interface{}{
+		"interval":        "10",
+		"max_buffer_size": "100",
+		"protocol":        "grpc",
+		"headers":         map[string]interface{}{"Authorization": "Bearer secret"},
+	}
+
+	o := getTestOTLPHandler(12, 13, 14)
+	o.Configure(config)
+
+	assert.Equal(t, 10, o.Interval())
+	assert.Equal(t, 100, o.MaxBufferSize())
+	assert.Equal(t, otlpProtocolGRPC, o.Protocol())
+	assert.Equal(t, defaultOTLPGRPCEndpoint, o.Endpoint())
+	assert.Equal(t, map[string]string{"Authorization": "Bearer secret"}, o.headers)
+}
+
+func TestOTLPConfigureUnknownProtocol(t *testing.T) {
+	o := getTestOTLPHandler(12, 13, 14)
+	o.Configure(map[string]interface{}{
+		"protocol": "http/json",
+		"endpoint": "http://collector:4318/v1/metrics",
+	})
+
+	assert.Equal(t, otlpProtocolHTTP, o.Protocol())
+	assert.Equal(t, "http://collector:4318/v1/metrics", o.Endpoint())
+}
+
+func TestOTLPConvert(t *testing.T) {
+	o := getTestOTLPHandler(10, 13, 14)
+	o.Configure(map[string]interface{}{
+		"defaultDimensions": map[string]string{"host": "myhost"},
+	})
+	o.SetPrefix("prefix.")
+
+	now := time.Unix(100, 0)
+	request := o.convertToOTLP(getTestOTLPMetrics(), now)
+
+	assert.Equal(t, 1, len(request.GetResourceMetrics()))
+	rm := request.GetResourceMetrics()[0]
+
+	attributes := map[string]string{}
+	for _, kv := range rm.GetResource().GetAttributes() {
+		attributes[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	assert.Equal(t, map[string]string{"host": "myhost", "service.name": "fullerite"}, attributes)
+
+	assert.Equal(t, 1, len(rm.GetScopeMetrics()))
+	assert.Equal(t, otlpScopeName, rm.GetScopeMetrics()[0].GetScope().GetName())
+	metrics := rm.GetScopeMetrics()[0].GetMetrics()
+	assert.Equal(t, 3, len(metrics))
+
+	gauge := metrics[0]
+	assert.Equal(t, "prefix.gauge", gauge.GetName())
+	assert.Nil(t, gauge.GetSum())
+	assert.Equal(t, 2, len(gauge.GetGauge().GetDataPoints()))
+	dp := gauge.GetGauge().GetDataPoints()[0]
+	assert.Equal(t, 1.5, dp.GetAsDouble())
+	assert.Equal(t, uint64(now.UnixNano()), dp.GetTimeUnixNano())
+	assert.Equal(t, 1, len(dp.GetAttributes()), "default dimensions should not be repeated")
+	assert.Equal(t, "app", dp.GetAttributes()[0].GetKey())
+	assert.Equal(t, "foo", dp.GetAttributes()[0].GetValue().GetStringValue())
+
+	counter := metrics[1]
+	assert.Nil(t, counter.GetGauge())
+	assert.Equal(t, otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+		counter.GetSum().GetAggregationTemporality())
+	assert.True(t, counter.GetSum().GetIsMonotonic())
+	assert.Equal(t, uint64(time.Unix(90, 0).UnixNano()),
+		counter.GetSum().GetDataPoints()[0].GetStartTimeUnixNano())
+
+	cumcounter := metrics[2]
+	assert.Equal(t, otlp.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		cumcounter.GetSum().GetAggregationTemporality())
+	assert.True(t, cumcounter.GetSum().GetIsMonotonic())
+	assert.Equal(t, uint64(o.startTime.UnixNano()),
+		cumcounter.GetSum().GetDataPoints()[0].GetStartTimeUnixNano())
+	assert.Equal(t, 4.0, cumcounter.GetSum().GetDataPoints()[0].GetAsDouble())
+}
+
+func TestOTLPServiceNameOverride(t *testing.T) {
+	o := getTestOTLPHandler(10, 13, 14)
+	o.Configure(map[string]interface{}{
+		"defaultDimensions": map[string]string{"service.name": "myservice"},
+	})
+
+	request := o.convertToOTLP(getTestOTLPMetrics(), time.Now())
+	attributes := request.GetResourceMetrics()[0].GetResource().GetAttributes()
+	assert.Equal(t, 1, len(attributes))
+	assert.Equal(t, "myservice", attributes[0].GetValue().GetStringValue())
+}
+
+func TestOTLPEmitMetricsHTTP(t *testing.T) {
+	received := new(otlp.ExportMetricsServiceRequest)
+	var contentType, auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		auth = r.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(r.Body)
+		proto.Unmarshal(body, received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	o := getTestOTLPHandler(10, 13, 14)
+	o.Configure(map[string]interface{}{
+		"endpoint": ts.URL,
+		"headers":  map[string]interface{}{"Authorization": "Bearer secret"},
+	})
+	o.httpClient = new(util.HTTPAlive)
+	o.httpClient.Configure(o.timeout, o.timeout, 1)
+
+	assert.False(t, o.emitMetrics([]metric.Metric{}))
+	assert.True(t, o.emitMetrics(getTestOTLPMetrics()))
+	assert.Equal(t, "application/x-protobuf", contentType)
+	assert.Equal(t, "Bearer secret", auth)
+	assert.Equal(t, 3, len(received.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()))
+}
+
+func TestOTLPEmitMetricsHTTPFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	o := getTestOTLPHandler(10, 13, 14)
+	o.Configure(map[string]interface{}{"endpoint": ts.URL})
+	o.httpClient = new(util.HTTPAlive)
+	o.httpClient.Configure(o.timeout, o.timeout, 1)
+
+	assert.False(t, o.emitMetrics(getTestOTLPMetrics()))
+}
+
+func getTestGRPCServer(grpcStatus string, received *otlp.ExportMetricsServiceRequest) *httptest.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != otlpGRPCExportPath || r.Header.Get("Content-Type") != "application/grpc+proto" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) >= 5 && int(binary.BigEndian.Uint32(body[1:5])) == len(body)-5 {
+			message := body[5:]
+			if body[0] == 1 && r.Header.Get("Grpc-Encoding") == "gzip" {
+				reader, _ := gzip.NewReader(bytes.NewReader(message))
+				message, _ = ioutil.ReadAll(reader)
+			}
+			proto.Unmarshal(message, received)
+		}
+
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", grpcStatus)
+		w.Header().Set("Grpc-Message", "test")
+	})
+	return httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+}
+
+func TestOTLPEmitMetricsGRPC(t *testing.T) {
+	received := new(otlp.ExportMetricsServiceRequest)
+	ts := getTestGRPCServer("0", received)
+	defer ts.Close()
+
+	o := getTestOTLPHandler(10, 13, 14)
+	o.Configure(map[string]interface{}{
+		"protocol": "grpc",
+		"endpoint": ts.URL,
+	})
+	o.grpcClient = o.newGRPCClient()
+
+	assert.True(t, o.emitMetrics(getTestOTLPMetrics()))
+	assert.Equal(t, 3, len(received.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()))
+}
+
+func TestOTLPEmitMetricsGRPCFailure(t *testing.T) {
+	ts := getTestGRPCServer("14", new(otlp.ExportMetricsServiceRequest))
+	defer ts.Close()
+
+	o := getTestOTLPHandler(10, 13, 14)
+	o.Configure(map[string]interface{}{
+		"protocol": "grpc",
+		"endpoint": ts.URL,
+	})
+	o.grpcClient = o.newGRPCClient()
+
+	assert.False(t, o.emitMetrics(getTestOTLPMetrics()))
+}
+
+func TestOTLPEmitMetricsGRPCCompressed(t *testing.T) {
+	received := new(otlp.ExportMetricsServiceRequest)
+	ts := getTestGRPCServer("0", received)
+	defer ts.Close()
+
+	o := getTestOTLPHandler(10, 13, 14)
+	o.Configure(map[string]interface{}{
+		"protocol":    "grpc",
+		"endpoint":    ts.URL,
+		"compression": "deflate",
+	})
+	assert.Equal(t, compressionGzip, o.Compression(), "gRPC falls back to gzip")
+	o.grpcClient = o.newGRPCClient()
+
+	assert.True(t, o.emitMetrics(getTestOTLPMetrics()))
+	assert.Equal(t, 3, len(received.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()))
+}
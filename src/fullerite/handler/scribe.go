@@ -3,10 +3,14 @@ package handler
 import (
 	"fullerite/config"
 	"fullerite/metric"
+	"fullerite/util"
 
 	"encoding/json"
 	"fmt"
 	"net"
+	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	l "github.com/Sirupsen/logrus"
@@ -25,12 +29,40 @@ type fulleriteScribeClient interface {
 // Scribe Handler
 type Scribe struct {
 	BaseHandler
-	endpoint     string
-	port         int
-	streamName   string
-	scribeClient fulleriteScribeClient
+	endpoint   string
+	port       int
+	streamName string
+
+	// streams named after the metrics' dimensions, like
+	// fullerite_{collector}, the ones missing a dimension go
+	// to streamName
+	streamTemplate string
+
+	// the client is reset when logging fails, reconnections are
+	// attempted at most every reconnectDelay, which doubles after
+	// each failure up to maxReconnectInterval. The lock guards the
+	// client, the counters are updated atomically. Each Log is bound
+	// by the handler timeout so that a stalled server resets the client
+	lock                 sync.Mutex
+	scribeClient         fulleriteScribeClient
+	conn                 net.Conn
+	reconnectInterval    time.Duration
+	maxReconnectInterval time.Duration
+	reconnectDelay       time.Duration
+	nextReconnect        time.Time
+	reconnects           uint64
+
+	// batches the server asks to send later are retried up to
+	// tryLaterRetries times, tryLaterInterval apart and doubling
+	tryLaterRetries  int
+	tryLaterInterval time.Duration
+	tryLater         uint64
 }
 
+// the characters kept in the stream names, the others are replaced
+// by '_' since scribe stores the streams as directories
+var allowedScribeStreamPuncts = []rune{'-', '_'}
+
 type scribeMetric struct {
 	Name       string            `json:"name"`
 	MetricType string            `json:"type"`
@@ -40,11 +72,17 @@ type scribeMetric struct {
 }
 
 const (
-	defaultScribeEndpoint   = "localhost"
-	defaultScribePort       = 1464
-	defaultScribeStreamName = "fullerite_to_scribe"
+	defaultScribeEndpoint             = "localhost"
+	defaultScribePort                 = 1464
+	defaultScribeStreamName           = "fullerite_to_scribe"
+	defaultScribeReconnectInterval    = 1
+	defaultScribeMaxReconnectInterval = 60
+	defaultScribeTryLaterRetries      = 3
+	defaultScribeTryLaterInterval     = 1
 )
 
+var scribeStreamPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
 // newScribe returns a new Scribe handler.
 func newScribe(
 	channel chan metric.Metric,
@@ -65,6 +103,10 @@ func newScribe(
 	inst.endpoint = defaultScribeEndpoint
 	inst.port = defaultScribePort
 	inst.streamName = defaultScribeStreamName
+	inst.reconnectInterval = defaultScribeReconnectInterval * time.Second
+	inst.maxReconnectInterval = defaultScribeMaxReconnectInterval * time.Second
+	inst.tryLaterRetries = defaultScribeTryLaterRetries
+	inst.tryLaterInterval = defaultScribeTryLaterInterval * time.Second
 
 	return inst
 }
@@ -83,36 +125,93 @@ func (s *Scribe) Configure(configMap map[string]interface{}) {
 		s.streamName = stream.(string)
 	}
 
+	if template, exists := configMap["streamTemplate"]; exists {
+		s.streamTemplate = template.(string)
+	}
+
+	if interval, exists := configMap["reconnectInterval"]; exists {
+		s.reconnectInterval = time.Duration(config.GetAsInt(interval, defaultScribeReconnectInterval)) * time.Second
+	}
+
+	if interval, exists := configMap["maxReconnectInterval"]; exists {
+		s.maxReconnectInterval = time.Duration(config.GetAsInt(interval, defaultScribeMaxReconnectInterval)) * time.Second
+	}
+
+	if retries, exists := configMap["tryLaterRetries"]; exists {
+		s.tryLaterRetries = config.GetAsInt(retries, defaultScribeTryLaterRetries)
+	}
+
+	if interval, exists := configMap["tryLaterInterval"]; exists {
+		s.tryLaterInterval = time.Duration(config.GetAsInt(interval, defaultScribeTryLaterInterval)) * time.Second
+	}
+
 	s.configureCommonParams(configMap)
 }
 
+// connectToScribe connects the client unless the previous
+// attempt failed less than reconnectDelay ago
 func (s *Scribe) connectToScribe() {
+	now := time.Now()
+	if now.Before(s.nextReconnect) {
+		s.log.Debug("Not reconnecting to scribe before ", s.nextReconnect)
+		return
+	}
+
 	server := fmt.Sprintf("%s:%d", s.endpoint, s.port)
-	conn, err := net.Dial("tcp", server)
+	conn, err := s.dial("tcp", server)
 
 	if err != nil {
-		s.log.Errorf("Failed to connect to %s. Error: %s", server, err.Error())
+		if s.reconnectDelay == 0 {
+			s.reconnectDelay = s.reconnectInterval
+		} else if s.reconnectDelay *= 2; s.reconnectDelay > s.maxReconnectInterval {
+			s.reconnectDelay = s.maxReconnectInterval
+		}
+		s.nextReconnect = now.Add(s.reconnectDelay)
+		s.log.Errorf("Failed to connect to %s, retrying in %s. Error: %s", server, s.reconnectDelay, err.Error())
 
 	} else {
 		t := thrift.NewTransport(thrift.NewFramedReadWriteCloser(conn, 0), thrift.BinaryProtocol)
 		client := thrift.NewClient(t, false)
 		s.scribeClient = &scribe.ScribeClient{Client: client}
+		s.conn = conn
+		s.reconnectDelay = 0
+		s.nextReconnect = time.Time{}
+		atomic.AddUint64(&s.reconnects, 1)
 	}
 }
 
+// resetClient closes a connection that failed, the next emission reconnects
+func (s *Scribe) resetClient() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.scribeClient = nil
+}
+
 // Run runs the handler main loop
 func (s *Scribe) Run() {
+	s.lock.Lock()
 	s.connectToScribe()
+	s.lock.Unlock()
 
 	s.run(s.emitMetrics)
 }
 
+// InternalMetrics adds the reconnections and the batches the
+// server asked to send later to the handler metrics
+func (s *Scribe) InternalMetrics() metric.InternalMetrics {
+	internal := s.BaseHandler.InternalMetrics()
+	internal.Counters["scribeReconnects"] = float64(atomic.LoadUint64(&s.reconnects))
+	internal.Counters["scribeTryLater"] = float64(atomic.LoadUint64(&s.tryLater))
+	return internal
+}
+
 func (s *Scribe) emitMetrics(metrics []metric.Metric) bool {
 	s.log.Info("Starting to emit ", len(metrics), " metrics")
 
-	if s.scribeClient == nil {
+	if !s.connected() {
 		s.log.Warn("Cannot connect to scribe server. Skipping send.")
-		s.connectToScribe()
 		return false
 	}
 
@@ -127,31 +226,125 @@ func (s *Scribe) emitMetrics(metrics []metric.Metric) bool {
 		if err != nil {
 			s.log.Warnf("JSON encode failed: %s", err.Error())
 		} else {
-			encodedMetrics = append(encodedMetrics, &scribe.LogEntry{s.streamName, string(jsonMetric)})
+			encodedMetrics = append(encodedMetrics, &scribe.LogEntry{
+				Category: s.stream(m),
+				Message:  string(jsonMetric),
+			})
 		}
 	}
 
-	if len(encodedMetrics) > 0 {
-		_, err := s.scribeClient.Log(encodedMetrics)
+	if len(encodedMetrics) > 0 && !s.logEntries(encodedMetrics) {
+		return false
+	}
+
+	s.log.Info("Successfully written ", len(encodedMetrics), " datapoints to Scribe")
+	return true
+}
+
+// connected connects the client unless it already is
+func (s *Scribe) connected() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
+	if s.scribeClient == nil {
+		s.connectToScribe()
+	}
+	return s.scribeClient != nil
+}
+
+// logEntries sends the entries, again while the server asks to try later.
+// The lock is only held while logging so that the other emissions
+// are not blocked during the backoff
+func (s *Scribe) logEntries(entries []*scribe.LogEntry) bool {
+	delay := s.tryLaterInterval
+	for attempt := 0; ; attempt++ {
+		result, err := s.logOnce(entries)
 		if err != nil {
-			s.log.Errorf("Failed to write to scribe. Error: %s", err.Error())
-			s.connectToScribe()
+			s.log.Errorf("Failed to write to scribe, resetting the connection. Error: %s", err.Error())
 			return false
 		}
+
+		if result != scribe.ResultCodeTryLater {
+			return true
+		}
+
+		atomic.AddUint64(&s.tryLater, 1)
+		if attempt >= s.tryLaterRetries {
+			s.log.Error("Scribe still asks to try later after ", attempt, " retries, dropping ", len(entries), " entries")
+			return false
+		}
+		s.log.Warn("Scribe asked to try later, retrying in ", delay)
+		time.Sleep(delay)
+		delay *= 2
 	}
+}
 
-	s.log.Info("Successfully written ", len(encodedMetrics), " datapoints to Scribe")
-	return true
+// logOnce sends the entries with the current client, reconnecting it
+// when another emission reset it and resetting it when logging fails
+func (s *Scribe) logOnce(entries []*scribe.LogEntry) (scribe.ResultCode, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.scribeClient == nil {
+		s.connectToScribe()
+		if s.scribeClient == nil {
+			return scribe.ResultCodeTryLater, fmt.Errorf("not connected to %s:%d", s.endpoint, s.port)
+		}
+	}
+
+	if s.conn != nil && s.timeout > 0 {
+		s.conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+	result, err := s.scribeClient.Log(entries)
+	if err != nil {
+		s.resetClient()
+	}
+	return result, err
+}
+
+// stream returns the stream of a metric, filled from the sanitized
+// dimensions the stream template refers to
+func (s *Scribe) stream(m metric.Metric) string {
+	if s.streamTemplate == "" {
+		return s.streamName
+	}
+
+	dimensions := m.GetDimensions(s.DefaultDimensions())
+	missing := false
+	stream := scribeStreamPlaceholder.ReplaceAllStringFunc(s.streamTemplate, func(placeholder string) string {
+		key := placeholder[1 : len(placeholder)-1]
+		if key == "name" {
+			return scribeStreamSanitize(m.Name)
+		}
+		value, exists := dimensions[key]
+		if !exists || value == "" {
+			missing = true
+			return ""
+		}
+		return scribeStreamSanitize(value)
+	})
+
+	if missing {
+		return s.streamName
+	}
+	return stream
+}
+
+func scribeStreamSanitize(value string) string {
+	return util.StrSanitize(value, false, allowedScribeStreamPuncts)
+}
+
+func (s *Scribe) createScribeMetric(m metric.Metric) scribeMetric {
+	return newScribeMetric(m, s.DefaultDimensions())
 }
 
-func (s Scribe) createScribeMetric(m metric.Metric) scribeMetric {
+// newScribeMetric builds the JSON document shared by the log bus handlers
+func newScribeMetric(m metric.Metric, defaultDimensions map[string]string) scribeMetric {
 	return scribeMetric{
 		Name:       m.Name,
 		Value:      m.Value,
 		MetricType: m.MetricType,
 		Timestamp:  time.Now().Unix(),
-		Dimensions: m.GetDimensions(s.DefaultDimensions()),
+		Dimensions: m.GetDimensions(defaultDimensions),
 	}
-
 }
@@ -3,6 +3,8 @@ package handler
 import (
 	"fullerite/metric"
 
+	"errors"
+	"net"
 	"regexp"
 	"testing"
 	"time"
@@ -21,11 +23,23 @@ func getTestScribeHandler(interval, buffsize, timeoutsec int) *Scribe {
 }
 
 type MockScribeClient struct {
-	msg []*scribe.LogEntry
+	msg   []*scribe.LogEntry
+	calls int
+
+	// results returned by the first calls, then OK
+	results []scribe.ResultCode
+	err     error
 }
 
 func (m *MockScribeClient) Log(Messages []*scribe.LogEntry) (scribe.ResultCode, error) {
 	m.msg = Messages
+	m.calls++
+	if m.err != nil {
+		return scribe.ResultCodeTryLater, m.err
+	}
+	if m.calls <= len(m.results) {
+		return m.results[m.calls-1], nil
+	}
 	return scribe.ResultCodeByName["ResultCode.OK"], nil
 }
 
@@ -136,3 +150,188 @@ func TestCreateScribeMetricsWithDefaultDimensions(t *testing.T) {
 	res := s.createScribeMetric(m)
 	assert.Equal(t, map[string]string{"region": "uswest1-devc", "ecosystem": "devc", "dim1": "val1"}, res.Dimensions)
 }
+
+func TestScribeConfigureReconnection(t *testing.T) {
+	config := map[string]interface{}{
+		"streamTemplate":       "fullerite_{collector}",
+		"reconnectInterval":    "2",
+		"maxReconnectInterval": 30,
+		"tryLaterRetries":      5,
+		"tryLaterInterval":     "3",
+	}
+
+	s := getTestScribeHandler(40, 50, 60)
+	s.Configure(config)
+
+	assert.Equal(t, "fullerite_{collector}", s.streamTemplate)
+	assert.Equal(t, 2*time.Second, s.reconnectInterval)
+	assert.Equal(t, 30*time.Second, s.maxReconnectInterval)
+	assert.Equal(t, 5, s.tryLaterRetries)
+	assert.Equal(t, 3*time.Second, s.tryLaterInterval)
+}
+
+func TestScribeEmitMetricsResetsClientOnError(t *testing.T) {
+	s := getTestScribeHandler(40, 50, 1)
+	s.scribeClient = &MockScribeClient{err: errors.New("broken pipe")}
+
+	assert.False(t, s.emitMetrics([]metric.Metric{metric.New("test")}))
+	assert.Nil(t, s.scribeClient)
+}
+
+func TestScribeReconnectBackoff(t *testing.T) {
+	// nothing listens on the port once the listener is closed
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	s := getTestScribeHandler(40, 50, 1)
+	s.Configure(map[string]interface{}{
+		"endpoint":             "127.0.0.1",
+		"port":                 addr.Port,
+		"reconnectInterval":    10,
+		"maxReconnectInterval": 30,
+	})
+
+	s.connectToScribe()
+	assert.Equal(t, 10*time.Second, s.reconnectDelay)
+	next := s.nextReconnect
+
+	// attempts during the backoff are skipped
+	s.connectToScribe()
+	assert.Equal(t, next, s.nextReconnect)
+
+	for _, expected := range []time.Duration{20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		s.nextReconnect = time.Time{}
+		s.connectToScribe()
+		assert.Equal(t, expected, s.reconnectDelay)
+	}
+	assert.Nil(t, s.scribeClient)
+
+	listener, err = net.Listen("tcp", addr.String())
+	if err != nil {
+		t.Skip("Could not listen on ", addr, " again: ", err)
+	}
+	defer listener.Close()
+
+	s.nextReconnect = time.Time{}
+	s.connectToScribe()
+	assert.NotNil(t, s.scribeClient)
+	assert.Equal(t, time.Duration(0), s.reconnectDelay)
+	assert.Equal(t, 1.0, s.InternalMetrics().Counters["scribeReconnects"])
+}
+
+func TestScribeEmitMetricsRetriesTryLater(t *testing.T) {
+	s := getTestScribeHandler(40, 50, 60)
+	s.tryLaterInterval = time.Millisecond
+	m := &MockScribeClient{results: []scribe.ResultCode{scribe.ResultCodeTryLater, scribe.ResultCodeTryLater}}
+	s.scribeClient = m
+
+	assert.True(t, s.emitMetrics([]metric.Metric{metric.New("test")}))
+	assert.Equal(t, 3, m.calls)
+	assert.Equal(t, 2.0, s.InternalMetrics().Counters["scribeTryLater"])
+
+	s.tryLaterRetries = 1
+	m = &MockScribeClient{results: []scribe.ResultCode{scribe.ResultCodeTryLater, scribe.ResultCodeTryLater}}
+	s.scribeClient = m
+
+	assert.False(t, s.emitMetrics([]metric.Metric{metric.New("test")}))
+	assert.Equal(t, 2, m.calls)
+	assert.NotNil(t, s.scribeClient)
+}
+
+func TestScribeStreamTemplate(t *testing.T) {
+	s := getTestScribeHandler(40, 50, 60)
+	s.Configure(map[string]interface{}{
+		"streamName":        "fallback",
+		"streamTemplate":    "fullerite_{service}_{collector}",
+		"defaultDimensions": map[string]string{"service": "web"},
+	})
+	m := &MockScribeClient{}
+	s.scribeClient = m
+
+	withCollector := metric.New("test1")
+	withCollector.AddDimension("collector", "Diamond")
+	assert.True(t, s.emitMetrics([]metric.Metric{withCollector, metric.New("test2")}))
+
+	assert.Equal(t, "fullerite_web_Diamond", m.msg[0].Category)
+	assert.Equal(t, "fallback", m.msg[1].Category)
+}
+
+func TestScribeTryLaterBackoffDoesNotHoldTheLock(t *testing.T) {
+	s := getTestScribeHandler(40, 50, 60)
+	s.tryLaterInterval = time.Second
+	s.tryLaterRetries = 1
+	s.scribeClient = &MockScribeClient{results: []scribe.ResultCode{scribe.ResultCodeTryLater}}
+
+	done := make(chan bool)
+	go func() {
+		done <- s.emitMetrics([]metric.Metric{metric.New("test")})
+	}()
+
+	// the first attempt is done once the try later is counted
+	for s.InternalMetrics().Counters["scribeTryLater"] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	locked := make(chan bool)
+	go func() {
+		s.lock.Lock()
+		s.lock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("The lock is held during the try later backoff")
+	}
+	assert.True(t, <-done)
+}
+
+func TestScribeStreamTemplateSanitized(t *testing.T) {
+	s := getTestScribeHandler(40, 50, 60)
+	s.Configure(map[string]interface{}{
+		"streamTemplate": "fullerite_{collector}_{name}",
+	})
+	m := &MockScribeClient{}
+	s.scribeClient = m
+
+	withCollector := metric.New("cpu.idle")
+	withCollector.AddDimension("collector", "../etc/passwd")
+	assert.True(t, s.emitMetrics([]metric.Metric{withCollector}))
+
+	assert.Equal(t, "fullerite____etc_passwd_cpu_idle", m.msg[0].Category)
+}
+
+// stalledScribeClient waits for a response the server never sends
+type stalledScribeClient struct {
+	conn net.Conn
+}
+
+func (c *stalledScribeClient) Log(Messages []*scribe.LogEntry) (scribe.ResultCode, error) {
+	_, err := c.conn.Read(make([]byte, 1))
+	return scribe.ResultCodeTryLater, err
+}
+
+func TestScribeStalledServerResetsTheClient(t *testing.T) {
+	conn, server := net.Pipe()
+	defer server.Close()
+
+	s := getTestScribeHandler(40, 50, 1)
+	s.conn = conn
+	s.scribeClient = &stalledScribeClient{conn}
+
+	done := make(chan bool)
+	go func() {
+		done <- s.emitMetrics([]metric.Metric{metric.New("test")})
+	}()
+
+	select {
+	case result := <-done:
+		assert.False(t, result)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Logging to a stalled server did not time out")
+	}
+	assert.Nil(t, s.scribeClient)
+	assert.Nil(t, s.conn)
+}
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// number of positions of each destination on the ring, as in carbon
+	hashRingReplicas = 100
+
+	defaultDestinationRetryInterval = 30
+)
+
+type hashRingEntry struct {
+	position int
+	node     int
+}
+
+// hashRing is a consistent hash ring placing nodes and keys the same way
+// carbon's ConsistentHashRing (carbon_ch) does, so that series end up
+// on the same destination as with a carbon relay configured with the
+// same destinations in the same order.
+type hashRing struct {
+	entries []hashRingEntry
+	nodes   int
+}
+
+// newHashRing builds a ring from the keys identifying each node
+func newHashRing(nodeKeys []string) *hashRing {
+	ring := &hashRing{nodes: len(nodeKeys)}
+	taken := make(map[int]bool)
+	for node, nodeKey := range nodeKeys {
+		for i := 0; i < hashRingReplicas; i++ {
+			position := hashRingPosition(fmt.Sprintf("%s:%d", nodeKey, i))
+			for taken[position] {
+				position++
+			}
+			taken[position] = true
+			ring.entries = append(ring.entries, hashRingEntry{position, node})
+		}
+	}
+	sort.Slice(ring.entries, func(i, j int) bool {
+		return ring.entries[i].position < ring.entries[j].position
+	})
+	return ring
+}
+
+func hashRingPosition(key string) int {
+	sum := md5.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]))
+}
+
+// getNodes returns all the nodes ordered by preference for a key
+func (r *hashRing) getNodes(key string) []int {
+	if r.nodes == 0 {
+		return nil
+	}
+	if r.nodes == 1 {
+		return []int{0}
+	}
+
+	position := hashRingPosition(key)
+	index := sort.Search(len(r.entries), func(i int) bool {
+		return r.entries[i].position >= position
+	}) % len(r.entries)
+
+	nodes := make([]int, 0, r.nodes)
+	seen := make(map[int]bool, r.nodes)
+	for i := 0; i < len(r.entries) && len(nodes) < r.nodes; i++ {
+		node := r.entries[(index+i)%len(r.entries)].node
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// destination is one of the backends a sharded handler sends to
+type destination struct {
+	addr      string
+	downUntil time.Time
+
+	metricsSent       int64
+	metricsDropped    int64
+	metricsFailedOver int64
+}
+
+// shards routes each series to a destination of a consistent hash ring.
+// Destinations failing to accept metrics are skipped for retryInterval
+// and their series fail over to the next destinations of the ring.
+type shards struct {
+	ring          *hashRing
+	destinations  []*destination
+	retryInterval time.Duration
+	lock          sync.Mutex
+}
+
+// newShards returns shards over addrs, ringKeys identify each
+// destination on the ring and default to the addresses
+func newShards(addrs []string, ringKeys []string, retryInterval time.Duration) *shards {
+	if ringKeys == nil {
+		ringKeys = addrs
+	}
+	s := &shards{
+		ring:          newHashRing(ringKeys),
+		retryInterval: retryInterval,
+	}
+	for _, addr := range addrs {
+		s.destinations = append(s.destinations, &destination{addr: addr})
+	}
+	return s
+}
+
+// candidates returns the destinations to try for a key, healthy ones
+// first in ring order. Destinations marked down still come last so that
+// metrics are not dropped while every destination is considered down.
+func (s *shards) candidates(nodes []int, now time.Time) []*destination {
+	var healthy, down []*destination
+	for _, node := range nodes {
+		d := s.destinations[node]
+		if now.Before(d.downUntil) {
+			down = append(down, d)
+		} else {
+			healthy = append(healthy, d)
+		}
+	}
+	return append(healthy, down...)
+}
+
+func (s *shards) markDown(d *destination) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d.downUntil = time.Now().Add(s.retryInterval)
+}
+
+type routedMetric struct {
+	metric     metric.Metric
+	primary    *destination
+	candidates []*destination
+}
+
+// emit sends each metric to the first destination of its ring accepting
+// it. Each destination is tried at most once per emission. It returns
+// false if any metric could not be delivered.
+func (s *shards) emit(
+	metrics []metric.Metric,
+	key func(metric.Metric) string,
+	send func(addr string, metrics []metric.Metric) bool) bool {
+
+	return s.emitPartial(metrics, key, func(addr string, metrics []metric.Metric) []metric.Metric {
+		if send(addr, metrics) {
+			return nil
+		}
+		return metrics
+	})
+}
+
+// emitPartial is emit for destinations which may accept part of a batch,
+// send returns the metrics it did not deliver and only those fail over.
+func (s *shards) emitPartial(
+	metrics []metric.Metric,
+	key func(metric.Metric) string,
+	send func(addr string, metrics []metric.Metric) []metric.Metric) bool {
+
+	s.lock.Lock()
+	now := time.Now()
+	pending := make([]routedMetric, 0, len(metrics))
+	for _, m := range metrics {
+		nodes := s.ring.getNodes(key(m))
+		if len(nodes) == 0 {
+			continue
+		}
+		primary := s.destinations[nodes[0]]
+		pending = append(pending, routedMetric{m, primary, s.candidates(nodes, now)})
+	}
+	s.lock.Unlock()
+
+	failed := make(map[*destination]bool)
+	delivered := true
+	for len(pending) > 0 {
+		batches := make(map[*destination][]routedMetric)
+		var order []*destination
+		for _, rm := range pending {
+			target := rm.next(failed)
+			if target == nil {
+				s.count(&rm.primary.metricsDropped, 1)
+				delivered = false
+				continue
+			}
+			if _, exists := batches[target]; !exists {
+				order = append(order, target)
+			}
+			batches[target] = append(batches[target], rm)
+		}
+
+		pending = nil
+		for _, target := range order {
+			batch := batches[target]
+			toSend := make([]metric.Metric, 0, len(batch))
+			for _, rm := range batch {
+				toSend = append(toSend, rm.metric)
+			}
+
+			// the metrics of a series share their route
+			routes := make(map[string]routedMetric, len(batch))
+			for _, rm := range batch {
+				routes[key(rm.metric)] = rm
+			}
+			var unsent []routedMetric
+			for _, m := range send(target.addr, toSend) {
+				rm := routes[key(m)]
+				rm.metric = m
+				unsent = append(unsent, rm)
+			}
+
+			s.count(&target.metricsSent, int64(len(batch)-len(unsent)))
+			failedOver := make(map[*destination]int64)
+			for _, rm := range batch {
+				if rm.primary != target {
+					failedOver[rm.primary]++
+				}
+			}
+			for _, rm := range unsent {
+				if rm.primary != target {
+					failedOver[rm.primary]--
+				}
+			}
+			for primary, count := range failedOver {
+				s.count(&primary.metricsFailedOver, count)
+			}
+
+			if len(unsent) > 0 {
+				failed[target] = true
+				s.markDown(target)
+				pending = append(pending, unsent...)
+			}
+		}
+	}
+	return delivered
+}
+
+func (rm routedMetric) next(failed map[*destination]bool) *destination {
+	for _, d := range rm.candidates {
+		if !failed[d] {
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *shards) count(counter *int64, value int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	*counter += value
+}
+
+// addInternalMetrics adds the per destination counters to a handler's metrics
+func (s *shards) addInternalMetrics(internal metric.InternalMetrics) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, d := range s.destinations {
+		internal.Counters["metricsSent."+d.addr] = float64(d.metricsSent)
+		internal.Counters["metricsDropped."+d.addr] = float64(d.metricsDropped)
+		internal.Counters["metricsFailedOver."+d.addr] = float64(d.metricsFailedOver)
+	}
+}
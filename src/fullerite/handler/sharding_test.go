@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRingMatchesCarbon(t *testing.T) {
+	// expected nodes were generated with carbon's ConsistentHashRing
+	ring := newHashRing([]string{
+		"('10.0.0.1', 'a')",
+		"('10.0.0.2', 'b')",
+		"('10.0.0.3', None)",
+	})
+
+	tests := []struct {
+		key      string
+		expected []int
+	}{
+		{"servers.web1.cpu.user", []int{2, 0, 1}},
+		{"servers.db1.disk.sda.iops", []int{2, 0, 1}},
+		{"a", []int{0, 1, 2}},
+		{"b", []int{2, 0, 1}},
+		{"c", []int{1, 2, 0}},
+		{"collectd.host.load;env=prod", []int{0, 1, 2}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, ring.getNodes(test.key), test.key)
+	}
+}
+
+func TestHashRingSingleNode(t *testing.T) {
+	assert.Equal(t, []int{0}, newHashRing([]string{"only"}).getNodes("anything"))
+	assert.Nil(t, newHashRing(nil).getNodes("anything"))
+}
+
+func getTestShardsMetrics() []metric.Metric {
+	var metrics []metric.Metric
+	for _, name := range []string{"a", "b", "c"} {
+		metrics = append(metrics, metric.New(name))
+	}
+	return metrics
+}
+
+func TestShardsEmit(t *testing.T) {
+	s := newShards([]string{"one", "two", "three"}, nil, time.Minute)
+
+	sent := make(map[string][]string)
+	ok := s.emit(getTestShardsMetrics(), func(m metric.Metric) string { return m.Name },
+		func(addr string, metrics []metric.Metric) bool {
+			for _, m := range metrics {
+				sent[addr] = append(sent[addr], m.Name)
+			}
+			return true
+		})
+
+	assert.True(t, ok)
+	total := 0
+	for _, names := range sent {
+		total += len(names)
+	}
+	assert.Equal(t, 3, total)
+
+	internal := *metric.NewInternalMetrics()
+	s.addInternalMetrics(internal)
+	for _, d := range s.destinations {
+		assert.Equal(t, float64(len(sent[d.addr])), internal.Counters["metricsSent."+d.addr])
+		assert.Equal(t, 0.0, internal.Counters["metricsDropped."+d.addr])
+		assert.Equal(t, 0.0, internal.Counters["metricsFailedOver."+d.addr])
+	}
+}
+
+func TestShardsEmitFailover(t *testing.T) {
+	s := newShards([]string{"up", "down"}, nil, time.Minute)
+
+	attempts := make(map[string]int)
+	ok := s.emit(getTestShardsMetrics(), func(m metric.Metric) string { return m.Name },
+		func(addr string, metrics []metric.Metric) bool {
+			attempts[addr]++
+			return addr == "up"
+		})
+
+	assert.True(t, ok)
+	assert.Equal(t, 1, attempts["down"], "a failing destination is tried once per emission")
+	assert.True(t, s.destinations[1].downUntil.After(time.Now()))
+
+	internal := *metric.NewInternalMetrics()
+	s.addInternalMetrics(internal)
+	assert.Equal(t, 3.0, internal.Counters["metricsSent.up"])
+	assert.Equal(t, 0.0, internal.Counters["metricsSent.down"])
+
+	failedOver := 0.0
+	for _, m := range getTestShardsMetrics() {
+		if s.ring.getNodes(m.Name)[0] == 1 {
+			failedOver++
+		}
+	}
+	assert.Equal(t, failedOver, internal.Counters["metricsFailedOver.down"])
+	assert.Equal(t, 0.0, internal.Counters["metricsFailedOver.up"])
+
+	// the destination marked down is now tried last
+	attempts = make(map[string]int)
+	s.emit(getTestShardsMetrics(), func(m metric.Metric) string { return m.Name },
+		func(addr string, metrics []metric.Metric) bool {
+			attempts[addr]++
+			return true
+		})
+	assert.Equal(t, 0, attempts["down"])
+}
+
+func TestShardsEmitAllDown(t *testing.T) {
+	s := newShards([]string{"one", "two"}, nil, time.Minute)
+
+	ok := s.emit(getTestShardsMetrics(), func(m metric.Metric) string { return m.Name },
+		func(addr string, metrics []metric.Metric) bool { return false })
+	assert.False(t, ok)
+
+	internal := *metric.NewInternalMetrics()
+	s.addInternalMetrics(internal)
+	assert.Equal(t, 3.0, internal.Counters["metricsDropped.one"]+internal.Counters["metricsDropped.two"])
+	assert.Equal(t, 0.0, internal.Counters["metricsSent.one"]+internal.Counters["metricsSent.two"])
+}
+
+func TestShardsEmitPartialFailover(t *testing.T) {
+	s := newShards([]string{"one", "two"}, nil, time.Minute)
+
+	attempts := make(map[string]int)
+	ok := s.emitPartial(getTestShardsMetrics(), func(m metric.Metric) string { return m.Name },
+		func(addr string, metrics []metric.Metric) []metric.Metric {
+			var unsent []metric.Metric
+			for _, m := range metrics {
+				attempts[m.Name]++
+				if m.Name != "a" {
+					unsent = append(unsent, m)
+				}
+			}
+			return unsent
+		})
+
+	assert.False(t, ok)
+	assert.Equal(t, 1, attempts["a"], "the metrics delivered are not sent again")
+
+	internal := *metric.NewInternalMetrics()
+	s.addInternalMetrics(internal)
+	assert.Equal(t, 1.0, internal.Counters["metricsSent.one"]+internal.Counters["metricsSent.two"])
+	assert.Equal(t, 2.0, internal.Counters["metricsDropped.one"]+internal.Counters["metricsDropped.two"])
+}
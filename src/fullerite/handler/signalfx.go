@@ -6,6 +6,13 @@ import (
 	"fullerite/util"
 
 	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	l "github.com/Sirupsen/logrus"
@@ -19,9 +26,8 @@ func init() {
 // SignalFx Handler
 type SignalFx struct {
 	BaseHandler
-	endpoint   string
-	authToken  string
-	httpClient *util.HTTPAlive
+	endpoint  string
+	authToken string
 
 	// If the following dimension exists,
 	// then batch and emit it separately to Sfx
@@ -30,6 +36,58 @@ type SignalFx struct {
 	// When emitting batches made from "batchByDimension"
 	// config, use the following auth token
 	perBatchAuthToken map[string]string
+
+	// datapoints are sent as protobuf, or as JSON with "json"
+	format string
+	source string
+
+	// metrics sent to eventEndpoint as events rather than datapoints
+	events        []*regexp.Regexp
+	eventEndpoint string
+
+	// Dimensions moved from the datapoints to properties of another
+	// dimension, synced through the dimension API of apiEndpoint
+	// only when they change
+	dimensionProperties map[string][]string
+	apiEndpoint         string
+	properties          *signalFxProperties
+}
+
+// Some sane values to default SignalFx to
+const (
+	signalFxFormatProtobuf     = "protobuf"
+	signalFxFormatJSON         = "json"
+	signalFxDefaultSource      = "fullerite"
+	signalFxDefaultAPIEndpoint = "https://api.signalfx.com"
+)
+
+type signalFxJSONDatapoint struct {
+	Metric     string            `json:"metric"`
+	Value      float64           `json:"value"`
+	Dimensions map[string]string `json:"dimensions"`
+	Timestamp  int64             `json:"timestamp"`
+}
+
+type signalFxEvent struct {
+	Category   string                 `json:"category"`
+	EventType  string                 `json:"eventType"`
+	Dimensions map[string]string      `json:"dimensions"`
+	Properties map[string]interface{} `json:"properties"`
+	Timestamp  int64                  `json:"timestamp"`
+}
+
+type signalFxDimension struct {
+	Key              string            `json:"key"`
+	Value            string            `json:"value"`
+	CustomProperties map[string]string `json:"customProperties"`
+}
+
+// signalFxProperties tracks the properties of each dimension
+// value, the pending ones changed since they were last synced
+type signalFxProperties struct {
+	lock    sync.Mutex
+	synced  map[[2]string]map[string]string
+	pending map[[2]string]map[string]string
 }
 
 var allowedNamePuncts = []rune{}
@@ -53,7 +111,15 @@ func newSignalFx(
 	inst.keepAliveInterval = DefaultKeepAliveInterval
 	inst.log = log
 	inst.channel = channel
-
+	inst.serializedSizeFunc = inst.payloadSize
+
+	inst.format = signalFxFormatProtobuf
+	inst.source = signalFxDefaultSource
+	inst.apiEndpoint = signalFxDefaultAPIEndpoint
+	inst.properties = &signalFxProperties{
+		synced:  make(map[[2]string]map[string]string),
+		pending: make(map[[2]string]map[string]string),
+	}
 	return inst
 }
 
@@ -87,6 +153,53 @@ func (s *SignalFx) Configure(configMap map[string]interface{}) {
 		s.OverrideBaseEmissionMetricsReporter()
 	}
 
+	if format, exists := configMap["format"]; exists {
+		switch format {
+		case signalFxFormatProtobuf, signalFxFormatJSON:
+			s.format = format.(string)
+		default:
+			s.log.Warn("Unknown format ", format, ", sending datapoints as ", signalFxFormatProtobuf)
+		}
+	}
+
+	if source, exists := configMap["source"]; exists {
+		s.source = source.(string)
+	}
+
+	if events, exists := configMap["events"]; exists {
+		s.events = nil
+		for _, pattern := range config.GetAsSlice(events) {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				s.log.Error("Invalid event pattern ", pattern, ": ", err)
+				continue
+			}
+			s.events = append(s.events, re)
+		}
+	}
+
+	// events go next to the datapoints by default
+	if eventEndpoint, exists := configMap["eventEndpoint"]; exists {
+		s.eventEndpoint = eventEndpoint.(string)
+	} else if strings.HasSuffix(s.endpoint, "/datapoint") {
+		s.eventEndpoint = strings.TrimSuffix(s.endpoint, "/datapoint") + "/event"
+	}
+
+	if dimensionProperties, exists := configMap["dimensionProperties"]; exists {
+		s.dimensionProperties = make(map[string][]string)
+		if asMap, ok := dimensionProperties.(map[string]interface{}); ok {
+			for key, properties := range asMap {
+				s.dimensionProperties[key] = config.GetAsSlice(properties)
+			}
+		} else {
+			s.log.Error("Invalid dimensionProperties ", dimensionProperties)
+		}
+	}
+
+	if apiEndpoint, exists := configMap["apiEndpoint"]; exists {
+		s.apiEndpoint = strings.TrimSuffix(apiEndpoint.(string), "/")
+	}
+
 	s.configureCommonParams(configMap)
 }
 
@@ -97,12 +210,6 @@ func (s SignalFx) Endpoint() string {
 
 // Run runs the handler main loop
 func (s *SignalFx) Run() {
-	httpAliveClient := new(util.HTTPAlive)
-	httpAliveClient.Configure(s.timeout,
-		time.Duration(s.KeepAliveInterval())*time.Second,
-		s.MaxIdleConnectionsPerHost())
-	s.httpClient = httpAliveClient
-
 	s.run(s.emitMetrics)
 }
 
@@ -127,7 +234,7 @@ func (s SignalFx) convertToProto(incomingMetric metric.Metric) *DataPoint {
 		DoubleValue: &value,
 	}
 	datapoint.Source = new(string)
-	*datapoint.Source = "fullerite"
+	*datapoint.Source = s.source
 
 	switch incomingMetric.MetricType {
 	case metric.Gauge:
@@ -164,6 +271,106 @@ func (s SignalFx) getSanitizedDimensions(incomingMetric metric.Metric) map[strin
 	return dimSanitized
 }
 
+func (s SignalFx) convertToJSON(incomingMetric metric.Metric) signalFxJSONDatapoint {
+	return signalFxJSONDatapoint{
+		Metric:     s.Prefix() + signalFxValueSanitize(incomingMetric.Name),
+		Value:      incomingMetric.Value,
+		Dimensions: s.getSanitizedDimensions(incomingMetric),
+		Timestamp:  time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// signalFxJSONType returns the key of the datapoints
+// of a metric's type in the JSON payload
+func signalFxJSONType(metricType string) string {
+	switch metricType {
+	case metric.Counter:
+		return "counter"
+	case metric.CumulativeCounter:
+		return "cumulative_counter"
+	}
+	return "gauge"
+}
+
+func (s SignalFx) convertToEvent(incomingMetric metric.Metric) signalFxEvent {
+	return signalFxEvent{
+		Category:   "USER_DEFINED",
+		EventType:  s.Prefix() + signalFxValueSanitize(incomingMetric.Name),
+		Dimensions: s.getSanitizedDimensions(incomingMetric),
+		Properties: map[string]interface{}{"value": incomingMetric.Value},
+		Timestamp:  time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+func (s *SignalFx) isEvent(m metric.Metric) bool {
+	for _, re := range s.events {
+		if re.MatchString(m.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractProperties moves the dimensions synced as properties out of
+// a metric, and records them as properties of their dimension value
+func (s *SignalFx) extractProperties(m metric.Metric) metric.Metric {
+	if len(s.dimensionProperties) == 0 {
+		return m
+	}
+
+	dimensions := make(map[string]string, len(m.Dimensions))
+	for name, value := range m.Dimensions {
+		dimensions[name] = value
+	}
+
+	for key, propertyNames := range s.dimensionProperties {
+		value, exists := m.Dimensions[key]
+		if !exists {
+			continue
+		}
+		properties := make(map[string]string)
+		for _, name := range propertyNames {
+			if property, exists := m.Dimensions[name]; exists {
+				properties[signalFxKeySanitize(name)] = property
+				delete(dimensions, name)
+			}
+		}
+		if len(properties) > 0 {
+			s.properties.update(signalFxKeySanitize(key), signalFxValueSanitize(value), properties)
+		}
+	}
+
+	m.Dimensions = dimensions
+	return m
+}
+
+// update records the properties of a dimension value, they are
+// pending unless they are the ones synced last
+func (p *signalFxProperties) update(key, value string, properties map[string]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	dimension := [2]string{key, value}
+	if !reflect.DeepEqual(p.synced[dimension], properties) {
+		p.pending[dimension] = properties
+	}
+}
+
+// take returns the pending properties, they are pending
+// again on their next update unless marked as synced
+func (p *signalFxProperties) take() map[[2]string]map[string]string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	pending := p.pending
+	p.pending = make(map[[2]string]map[string]string)
+	return pending
+}
+
+func (p *signalFxProperties) markSynced(dimension [2]string, properties map[string]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.synced[dimension] = properties
+}
+
 // getAuthTokenForBatch will return an AuthToken associated with a batchname
 // if no such batch name exists, the default auth token will be returned.
 func (s *SignalFx) getAuthTokenForBatch(batchName string) string {
@@ -191,58 +398,165 @@ func (s *SignalFx) makeBatches(metrics []metric.Metric) map[string][]metric.Metr
 	return m
 }
 
-func (s *SignalFx) emitBatch(batchName string, metrics []metric.Metric) bool {
-	s.log.Info("Starting to emit ", len(metrics), " metrics")
-
-	datapoints := make([]*DataPoint, 0, len(metrics))
-	for _, m := range metrics {
-		datapoints = append(datapoints, s.convertToProto(m))
+// payloadSize is the size of a metric in the upload message,
+// including the tag and length prefixing each datapoint
+func (s *SignalFx) payloadSize(m metric.Metric) int {
+	if s.format == signalFxFormatJSON {
+		serialized, _ := json.Marshal(s.convertToJSON(m))
+		return len(serialized) + 1
 	}
+	size := proto.Size(s.convertToProto(m))
+	return size + proto.SizeVarint(uint64(size)) + 1
+}
 
-	payload := new(DataPointUploadMessage)
-	payload.Datapoints = datapoints
+func (s *SignalFx) emitBatch(batchName string, metrics []metric.Metric) bool {
+	s.log.Info("Starting to emit ", len(metrics), " metrics")
 
 	// Get auth token to be used for batch
 	authToken := s.getAuthTokenForBatch(batchName)
 	if authToken == "" || s.endpoint == "" {
 		s.log.Warn("Skipping emission because we're missing the auth token ",
-			"or the endpoint, payload would have been ", payload)
+			"or the endpoint, dropping ", len(metrics), " metrics")
 		return false
 	}
 
+	var datapoints, events []metric.Metric
+	for _, m := range metrics {
+		if s.isEvent(m) {
+			events = append(events, m)
+		} else {
+			datapoints = append(datapoints, s.extractProperties(m))
+		}
+	}
+
+	result := true
+	if len(datapoints) > 0 {
+		result = s.emitDatapoints(authToken, datapoints)
+	}
+	if len(events) > 0 {
+		result = s.emitEvents(authToken, events) && result
+	}
+	s.syncProperties(authToken)
+	return result
+}
+
+func (s *SignalFx) emitDatapoints(authToken string, metrics []metric.Metric) bool {
+	var serialized []byte
+	var err error
+	contentType := "application/x-protobuf"
+
+	if s.format == signalFxFormatJSON {
+		payload := make(map[string][]signalFxJSONDatapoint)
+		for _, m := range metrics {
+			metricType := signalFxJSONType(m.MetricType)
+			payload[metricType] = append(payload[metricType], s.convertToJSON(m))
+		}
+		serialized, err = json.Marshal(payload)
+		contentType = "application/json"
+	} else {
+		payload := new(DataPointUploadMessage)
+		for _, m := range metrics {
+			payload.Datapoints = append(payload.Datapoints, s.convertToProto(m))
+		}
+		serialized, err = proto.Marshal(payload)
+	}
+
 	// Serialize the payload
-	serialized, err := proto.Marshal(payload)
 	if err != nil {
-		s.log.Error("Failed to serailize payload ", payload)
+		s.log.Error("Failed to serialize ", len(metrics), " datapoints: ", err)
+		return false
+	}
+
+	if !s.post("POST", s.endpoint, authToken, contentType, serialized) {
+		return false
+	}
+	s.log.Info("Successfully sent ", len(metrics), " datapoints to SignalFx")
+	return true
+}
+
+func (s *SignalFx) emitEvents(authToken string, metrics []metric.Metric) bool {
+	if s.eventEndpoint == "" {
+		s.log.Warn("Skipping ", len(metrics), " events because there is no event endpoint")
+		return false
+	}
+
+	events := make([]signalFxEvent, 0, len(metrics))
+	for _, m := range metrics {
+		events = append(events, s.convertToEvent(m))
+	}
+
+	serialized, err := json.Marshal(events)
+	if err != nil {
+		s.log.Error("Failed to serialize ", len(events), " events: ", err)
+		return false
+	}
+
+	if !s.post("POST", s.eventEndpoint, authToken, "application/json", serialized) {
+		return false
+	}
+	s.log.Info("Successfully sent ", len(events), " events to SignalFx")
+	return true
+}
+
+// syncProperties updates the properties of the dimensions that changed,
+// the ones that failed are synced again with the next datapoints. The
+// properties are merged with PATCH so that the tags and properties set
+// by others are kept
+func (s *SignalFx) syncProperties(authToken string) {
+	for dimension, properties := range s.properties.take() {
+		serialized, err := json.Marshal(signalFxDimension{
+			Key:              dimension[0],
+			Value:            dimension[1],
+			CustomProperties: properties,
+		})
+		if err != nil {
+			s.log.Error("Failed to serialize the properties of ", dimension, ": ", err)
+			continue
+		}
+
+		endpoint := s.apiEndpoint + "/v2/dimension/" +
+			url.PathEscape(dimension[0]) + "/" + url.PathEscape(dimension[1])
+		if s.post("PATCH", endpoint, authToken, "application/json", serialized) {
+			s.properties.markSynced(dimension, properties)
+		}
+	}
+}
+
+func (s *SignalFx) post(method, endpoint, authToken, contentType string, serialized []byte) bool {
+	if s.httpClient == nil {
+		s.log.Error("The http client is not initialized, not sending to ", endpoint)
 		return false
 	}
 
 	customHeader := map[string]string{
 		"X-SF-TOKEN":   authToken,
-		"Content-Type": "application/x-protobuf",
+		"Content-Type": contentType,
+	}
+
+	compressed, encoding := s.compress(serialized)
+	if encoding != "" {
+		customHeader["Content-Encoding"] = encoding
 	}
 
 	rsp, err := s.httpClient.MakeRequest(
-		"POST",
-		s.endpoint,
-		bytes.NewBuffer(serialized),
+		method,
+		endpoint,
+		bytes.NewBuffer(compressed),
 		customHeader)
 
 	if err != nil {
 		s.log.Error("Failed to make request ", err,
-			" to endpoint ", s.endpoint)
+			" to endpoint ", endpoint)
 		return false
 	}
 
-	if rsp.StatusCode != 200 {
-		s.log.Error("Failed to post to signalfx @", s.endpoint,
+	if rsp.StatusCode != http.StatusOK {
+		s.log.Error("Failed to post to signalfx @", endpoint,
 			" status was ", rsp.StatusCode,
 			" rsp body was ", string(rsp.Body),
-			" payload was ", payload)
+			" payload was ", len(serialized), " bytes")
 		return false
 	}
-
-	s.log.Info("Successfully sent ", len(datapoints), " datapoints to SignalFx")
 	return true
 }
 
@@ -280,8 +594,16 @@ func (s *SignalFx) emitMetrics(metrics []metric.Metric) bool {
 	// If batchByDimension key is defined,
 	// then divide the list of metrics into batches,
 	// emit them concurrently (or parallely, if GOMAXPROCS is > 1)
+	// and wait for all of them so that the emission is not over
+	// before its batches, which bounded emissions rely on
+	var wg sync.WaitGroup
 	for batchName, metricBatch := range s.makeBatches(metrics) {
-		go s.emitAndTime(batchName, metricBatch)
+		wg.Add(1)
+		go func(batchName string, metricBatch []metric.Metric) {
+			defer wg.Done()
+			s.emitAndTime(batchName, metricBatch)
+		}(batchName, metricBatch)
 	}
+	wg.Wait()
 	return true
 }
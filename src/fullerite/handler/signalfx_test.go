@@ -3,9 +3,11 @@ package handler
 import (
 	"fullerite/metric"
 
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -135,3 +137,149 @@ func TestSignalFxSanitation(t *testing.T) {
 		}
 	}
 }
+
+func TestSignalFxConfigureFormatsAndEvents(t *testing.T) {
+	s := getTestSignalfxHandler(12, 12, 12)
+	s.Configure(map[string]interface{}{
+		"endpoint": "https://ingest.signalfx.com/v2/datapoint",
+		"source":   "host1",
+		"format":   "json",
+		"events":   []interface{}{"^fullerite\\.collection_time_exceeded$"},
+	})
+
+	assert.Equal(t, signalFxFormatJSON, s.format)
+	assert.Equal(t, "https://ingest.signalfx.com/v2/event", s.eventEndpoint)
+	assert.Equal(t, "host1", s.convertToProto(metric.New("Test")).GetSource())
+	assert.True(t, s.isEvent(metric.New("fullerite.collection_time_exceeded")))
+	assert.False(t, s.isEvent(metric.New("fullerite.collection_time")))
+
+	s.Configure(map[string]interface{}{"format": "xml"})
+	assert.Equal(t, signalFxFormatJSON, s.format)
+}
+
+func TestSignalFxEmitJSONAndEvents(t *testing.T) {
+	bodies := make(map[string][]byte)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-SF-TOKEN"))
+		bodies[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	s := getTestSignalfxHandler(12, 12, 1)
+	s.Configure(map[string]interface{}{
+		"authToken": "secret",
+		"endpoint":  ts.URL + "/v2/datapoint",
+		"format":    "json",
+		"events":    []interface{}{"^deploy$"},
+	})
+
+	counter := metric.WithValue("requests", 3)
+	counter.MetricType = metric.Counter
+	event := metric.WithValue("deploy", 1)
+	event.AddDimension("service", "api")
+	assert.True(t, s.emitMetrics([]metric.Metric{metric.WithValue("load", 2), counter, event}))
+
+	var datapoints map[string][]signalFxJSONDatapoint
+	assert.Nil(t, json.Unmarshal(bodies["/v2/datapoint"], &datapoints))
+	assert.Equal(t, 1, len(datapoints["gauge"]))
+	assert.Equal(t, "load", datapoints["gauge"][0].Metric)
+	assert.Equal(t, 1, len(datapoints["counter"]))
+	assert.Equal(t, 3.0, datapoints["counter"][0].Value)
+
+	var events []signalFxEvent
+	assert.Nil(t, json.Unmarshal(bodies["/v2/event"], &events))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, "deploy", events[0].EventType)
+	assert.Equal(t, "USER_DEFINED", events[0].Category)
+	assert.Equal(t, map[string]string{"service": "api"}, events[0].Dimensions)
+}
+
+func TestSignalFxDimensionProperties(t *testing.T) {
+	var datapoints []*DataPoint
+	var dimensions []signalFxDimension
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method == "PATCH" {
+			var dimension signalFxDimension
+			assert.Nil(t, json.Unmarshal(body, &dimension))
+			dimensions = append(dimensions, dimension)
+			paths = append(paths, r.URL.Path)
+			return
+		}
+		message := &DataPointUploadMessage{}
+		assert.Nil(t, proto.Unmarshal(body, message))
+		datapoints = append(datapoints, message.Datapoints...)
+	}))
+	defer ts.Close()
+
+	s := getTestSignalfxHandler(12, 12, 1)
+	s.Configure(map[string]interface{}{
+		"authToken":   "secret",
+		"endpoint":    ts.URL + "/v2/datapoint",
+		"apiEndpoint": ts.URL,
+		"dimensionProperties": map[string]interface{}{
+			"container_id": []interface{}{"image", "owner"},
+		},
+	})
+
+	m := metric.New("cpu")
+	m.AddDimension("container_id", "abc")
+	m.AddDimension("image", "web:1")
+	m.AddDimension("owner", "team")
+	assert.True(t, s.emitMetrics([]metric.Metric{m, m}))
+
+	assert.Equal(t, 2, len(datapoints))
+	assert.Equal(t, 1, len(datapoints[0].GetDimensions()))
+	assert.Equal(t, "container_id", datapoints[0].GetDimensions()[0].GetKey())
+	assert.Equal(t, 3, len(m.Dimensions), "the metric itself should not change")
+
+	assert.Equal(t, []string{"/v2/dimension/container_id/abc"}, paths)
+	assert.Equal(t, map[string]string{"image": "web:1", "owner": "team"}, dimensions[0].CustomProperties)
+
+	// properties are only synced again when they change
+	assert.True(t, s.emitMetrics([]metric.Metric{m}))
+	assert.Equal(t, 1, len(paths))
+
+	m.AddDimension("image", "web:2")
+	assert.True(t, s.emitMetrics([]metric.Metric{m}))
+	assert.Equal(t, 2, len(paths))
+	assert.Equal(t, "web:2", dimensions[1].CustomProperties["image"])
+}
+
+func TestSignalFxDimensionPropertiesKeepTags(t *testing.T) {
+	var methods []string
+	var synced []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.HasPrefix(r.URL.Path, "/v2/dimension/") {
+			var dimension map[string]interface{}
+			assert.Nil(t, json.Unmarshal(body, &dimension))
+			methods = append(methods, r.Method)
+			synced = append(synced, dimension)
+		}
+	}))
+	defer ts.Close()
+
+	s := getTestSignalfxHandler(12, 12, 1)
+	s.Configure(map[string]interface{}{
+		"authToken":   "secret",
+		"endpoint":    ts.URL + "/v2/datapoint",
+		"apiEndpoint": ts.URL,
+		"dimensionProperties": map[string]interface{}{
+			"container_id": []interface{}{"image"},
+		},
+	})
+
+	m := metric.New("cpu")
+	m.AddDimension("container_id", "abc")
+	m.AddDimension("image", "web:1")
+	assert.True(t, s.emitMetrics([]metric.Metric{m}))
+
+	// a PUT would replace the tags and properties set by others
+	assert.Equal(t, []string{"PATCH"}, methods)
+	_, hasTags := synced[0]["tags"]
+	assert.False(t, hasTags)
+	assert.Equal(t, map[string]interface{}{"image": "web:1"}, synced[0]["customProperties"])
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket allows up to rate tokens per second, with bursts of up to
+// one second worth of tokens
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// burst is the largest number of tokens that can be taken at once
+func (b *tokenBucket) burst() int {
+	return int(b.rate)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+}
+
+// take removes n tokens if they are all available, otherwise it
+// returns how long to wait before they will be
+func (b *tokenBucket) take(n int, now time.Time) (bool, time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill(now)
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		return true, 0
+	}
+	missing := float64(n) - b.tokens
+	return false, time.Duration(missing / b.rate * float64(time.Second))
+}
+
+// wait blocks until n tokens are taken, it gives up
+// and returns false if that would be after deadline
+func (b *tokenBucket) wait(n int, deadline time.Time) bool {
+	for {
+		now := time.Now()
+		ok, delay := b.take(n, now)
+		if ok {
+			return true
+		}
+		if now.Add(delay).After(deadline) {
+			return false
+		}
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	b := newTokenBucket(10)
+	now := b.last
+	assert.Equal(t, 10, b.burst())
+
+	ok, _ := b.take(8, now)
+	assert.True(t, ok)
+
+	ok, delay := b.take(5, now)
+	assert.False(t, ok)
+	assert.Equal(t, 300*time.Millisecond, delay)
+
+	ok, _ = b.take(5, now.Add(300*time.Millisecond))
+	assert.True(t, ok)
+
+	// tokens do not accumulate beyond one second worth of them
+	ok, _ = b.take(11, now.Add(time.Hour))
+	assert.False(t, ok)
+	ok, _ = b.take(10, now.Add(time.Hour))
+	assert.True(t, ok)
+}
+
+func TestTokenBucketWait(t *testing.T) {
+	b := newTokenBucket(100)
+	assert.True(t, b.wait(100, time.Now()))
+
+	start := time.Now()
+	assert.True(t, b.wait(5, time.Now().Add(time.Second)))
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	assert.False(t, b.wait(100, time.Now().Add(10*time.Millisecond)))
+}
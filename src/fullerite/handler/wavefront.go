@@ -1,19 +1,22 @@
 package handler
 
 import (
+	"fullerite/config"
 	"fullerite/metric"
 	"fullerite/util"
-	"fullerite/config"
 
 	"bytes"
 	"fmt"
 	l "github.com/Sirupsen/logrus"
-	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 func init() {
@@ -32,6 +35,15 @@ type Wavefront struct {
 	// then batch and emit it separately to Wavefront
 	batchByDimension string
 	defaultPointTags map[string]string
+
+	// counters are sent as delta counters, aggregated by Wavefront
+	deltaCounters bool
+
+	// granularity of the histograms of distributions: !M, !H or !D
+	histogramGranularity string
+
+	// persistent connections to the proxy
+	proxyPool *util.ConnPool
 }
 
 type wavefrontPayload struct {
@@ -43,14 +55,27 @@ type wavefrontMetric struct {
 	Value     float64
 	Source    string
 	PointTags []string
+
+	// samples of a distribution, sent as a histogram
+	Distribution []float64
+}
+
+// Histogram granularities, by configured name
+var wavefrontHistogramGranularities = map[string]string{
+	"minute": "!M",
+	"hour":   "!H",
+	"day":    "!D",
 }
 
+// wavefrontDeltaPrefix makes Wavefront aggregate a counter's values
+const wavefrontDeltaPrefix = "\u2206"
+
+var wavefrontTagValueEscaper = strings.NewReplacer("\"", "\\\"", "\n", " ")
 
 var allowedKeyPuncts = []rune{'-', '_', '.'}
 var pointTagLength = 255
 var sourceLength = 1023
 
-
 // newWavefront returns a new Wavefront handler
 func newWavefront(
 	channel chan metric.Metric,
@@ -66,50 +91,57 @@ func newWavefront(
 	inst.maxBufferSize = initialBufferSize
 	inst.interval = initialInterval
 	inst.channel = channel
-	
+	inst.serializedSizeFunc = inst.payloadSize
+	inst.histogramGranularity = wavefrontHistogramGranularities["minute"]
+
 	return inst
 }
 
+// escapeQuotes escapes the quotes of a point tag value, which
+// is quoted, and replaces the newlines ending a line
 func (w Wavefront) escapeQuotes(value string) string {
-	var escapedValue = "" 
-	for _, c := range value {
-        	if c == '"' {
-        		escapedValue += "\""
-        	} else {
-            		escapedValue += string(c) 
-        	}
-    	}
-        return escapedValue
+	return wavefrontTagValueEscaper.Replace(value)
 }
 
+// wavefrontValueSanitize trims a point tag value, a trailing
+// backslash would escape its closing quote
 func (w Wavefront) wavefrontValueSanitize(value string) string {
 	value = strings.Trim(value, "_")
 	value = strings.Trim(value, "\"")
-	if strings.Contains(value, "\"") {
-		return w.escapeQuotes(value)
-	}
-	return value
+	value = strings.TrimRight(value, "\\")
+	return w.escapeQuotes(value)
 }
 
 func (w Wavefront) wavefrontKeySanitize(key string) string {
 	return util.StrSanitize(key, false, allowedKeyPuncts)
 }
 
-func (w Wavefront) wavefrontPointTagSanitize(pointTag string) string {
-	if len(pointTag) > pointTagLength {
-		runes := []rune(pointTag)
-		w.log.Warn("Truncating point tag: \"" + pointTag + "\". The maximum allowed length for a combination of a point tag key and value is 255 characters including =")
-		truncatedPointTag := string(runes[:pointTagLength])
-
-		//check if last last character is \
-		if strings.HasSuffix(truncatedPointTag, "\\") {
-			cleanTruncatedPointTag := strings.Trim(truncatedPointTag, "\\")
-			return cleanTruncatedPointTag
-		}
+// wavefrontPointTagSanitize returns the point tag name="value", its value
+// is truncated so that it fits in pointTagLength with the quotes
+func (w Wavefront) wavefrontPointTagSanitize(name, value string) string {
+	pointTag := name + "=\"" + value + "\""
+	if len(pointTag) <= pointTagLength {
+		return pointTag
+	}
+	w.log.Warn("Truncating point tag: \"" + pointTag + "\". The maximum allowed length for a combination of a point tag key and value is 255 characters including =")
+
+	// keys too long for any value are cut first, keeping a byte of value
+	name = truncateOnRune(name, pointTagLength-4)
+	value = truncateOnRune(value, pointTagLength-len(name)-3)
+	// do not leave half of an escaped quote
+	value = strings.TrimRight(value, "\\")
+	return name + "=\"" + value + "\""
+}
 
-		return truncatedPointTag
+// truncateOnRune cuts s to at most maxLength bytes without splitting a rune
+func truncateOnRune(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	for maxLength > 0 && !utf8.RuneStart(s[maxLength]) {
+		maxLength--
 	}
-	return pointTag
+	return s[:maxLength]
 }
 
 func (w Wavefront) wavefrontSourceSanitize(source string) string {
@@ -127,7 +159,7 @@ func (w Wavefront) wavefrontSourceSanitize(source string) string {
 func (w *Wavefront) Configure(configMap map[string]interface{}) {
 	// Get Metadata Tags from fullerite.conf
 	if defaultPointTags, exists := configMap["default_point_tags"]; exists {
-	        w.defaultPointTags = config.GetAsMap(defaultPointTags)
+		w.defaultPointTags = config.GetAsMap(defaultPointTags)
 	}
 
 	if proxyFlag, exists := configMap["proxyFlag"]; exists {
@@ -152,7 +184,25 @@ func (w *Wavefront) Configure(configMap map[string]interface{}) {
 		w.OverrideBaseEmissionMetricsReporter()
 	}
 
+	if deltaCounters, exists := configMap["deltaCounters"]; exists {
+		w.deltaCounters = config.GetAsBool(deltaCounters, false)
+	}
+
+	if granularity, exists := configMap["histogramGranularity"]; exists {
+		if prefix, ok := wavefrontHistogramGranularities[fmt.Sprint(granularity)]; ok {
+			w.histogramGranularity = prefix
+		} else {
+			w.log.Warn("Unknown histogramGranularity ", granularity, ", sending minute histograms")
+		}
+	}
+
 	w.configureCommonParams(configMap)
+
+	if w.proxyFlag {
+		addr := net.JoinHostPort(w.proxyServer, w.port)
+		w.proxyPool = util.NewConnPool("tcp", addr, w.MaxIdleConnectionsPerHost(), w.timeout)
+		w.proxyPool.SetTLSConfig(w.TLSConfig())
+	}
 }
 
 // Configure the Wavefront Handler for Direct Ingestion
@@ -197,30 +247,46 @@ func (w *Wavefront) Run() {
 }
 
 func (w *Wavefront) convertToWavefront(incomingMetric metric.Metric) (datapoint wavefrontMetric) {
-	wfm := new(wavefrontMetric) 
-	wfm.Name = "\"" + w.Prefix() + w.wavefrontKeySanitize(incomingMetric.Name) + "\""
+	wfm := new(wavefrontMetric)
+	name := w.Prefix() + w.wavefrontKeySanitize(incomingMetric.Name)
+	if w.deltaCounters && incomingMetric.MetricType == metric.Counter && len(incomingMetric.Distribution) == 0 {
+		name = wavefrontDeltaPrefix + name
+	}
+	wfm.Name = "\"" + name + "\""
 	wfm.Value = incomingMetric.Value
+	wfm.Distribution = incomingMetric.Distribution
 	wfm.Source = w.DefaultDimensions()["host"]
-	wfm.PointTags = w.getSanitizedDimensions(incomingMetric.GetDimensions(w.DefaultDimensions()))
-	wfm.PointTags = w.getSanitizedDimensions(w.defaultPointTags)
+
+	// the default point tags are added to the metric's own
+	dimensions := incomingMetric.GetDimensions(w.DefaultDimensions())
+	for name, value := range w.defaultPointTags {
+		dimensions[name] = value
+	}
+	wfm.PointTags = w.getSanitizedDimensions(dimensions)
 	return *wfm
 }
 
 func (w *Wavefront) makeBatches(metrics []metric.Metric) map[string][]metric.Metric {
-        m := make(map[string][]metric.Metric)
-
-        // If batchByDimension key is not defined,
-        // do not examine each metric
-        if w.batchByDimension == "" {
-                m[""] = metrics
-                return m
-        }
-
-        for _, metric := range metrics {
-                dimValue := metric.Dimensions[w.batchByDimension]
-                m[dimValue] = append(m[dimValue], metric)
-        }
-        return m
+	m := make(map[string][]metric.Metric)
+
+	// If batchByDimension key is not defined,
+	// do not examine each metric
+	if w.batchByDimension == "" {
+		m[""] = metrics
+		return m
+	}
+
+	for _, metric := range metrics {
+		dimValue := metric.Dimensions[w.batchByDimension]
+		m[dimValue] = append(m[dimValue], metric)
+	}
+	return m
+}
+
+// payloadSize is the size of a metric's line in the payload
+func (w *Wavefront) payloadSize(m metric.Metric) int {
+	series := []wavefrontMetric{w.convertToWavefront(m)}
+	return len(w.wavefrontPayloadToString(wavefrontPayload{Series: series}))
 }
 
 func (w *Wavefront) emitMetrics(metrics []metric.Metric) bool {
@@ -236,9 +302,17 @@ func (w *Wavefront) emitMetrics(metrics []metric.Metric) bool {
 	// If batchByDimension key is defined,
 	// then divide the list of metrics into batches,
 	// emit them concurrently (or parallely, if GOMAXPROCS is > 1)
+	// and wait for all of them so that the emission is not over
+	// before its batches, which bounded emissions rely on
+	var wg sync.WaitGroup
 	for _, metricBatch := range w.makeBatches(metrics) {
-		go w.emitAndTime(metricBatch)
+		wg.Add(1)
+		go func(metricBatch []metric.Metric) {
+			defer wg.Done()
+			w.emitAndTime(metricBatch)
+		}(metricBatch)
 	}
+	wg.Wait()
 	return true
 }
 
@@ -248,7 +322,7 @@ func (w *Wavefront) emitAndTime(metrics []metric.Metric) bool {
 	elapsed := time.Since(start)
 	// Report emission metrics if emission tracker is disabled in base handler
 	if w.UseCustomEmissionMetricsReporter() {
-		timing := emissionTiming {
+		timing := emissionTiming{
 			timestamp:   time.Now(),
 			duration:    elapsed,
 			metricsSent: len(metrics),
@@ -262,79 +336,130 @@ func (w *Wavefront) emitAndTime(metrics []metric.Metric) bool {
 func (w *Wavefront) emitBatch(metrics []metric.Metric) bool {
 	w.log.Info("Starting to emit ", len(metrics), " metrics to Wavefront")
 
-	series := make([]wavefrontMetric, 0, len(metrics))
+	// histograms are sent separately for direct ingestion
+	var points, histograms []wavefrontMetric
 	for _, m := range metrics {
-		series = append(series, w.convertToWavefront(m))
+		wfm := w.convertToWavefront(m)
+		if len(wfm.Distribution) > 0 {
+			histograms = append(histograms, wfm)
+		} else {
+			points = append(points, wfm)
+		}
 	}
 
-	p := wavefrontPayload{Series: series}
-	pStr := w.wavefrontPayloadToString(p)
+	pointsStr := w.wavefrontPayloadToString(wavefrontPayload{Series: points})
+	histogramsStr := w.wavefrontPayloadToString(wavefrontPayload{Series: histograms})
 
 	if w.proxyFlag {
-		return w.emitMetricsToProxy(metrics, pStr, len(series))
+		return w.emitMetricsToProxy(metrics, pointsStr+histogramsStr, len(metrics))
+	}
+
+	result := true
+	if len(points) > 0 {
+		result = w.emitMetricsForDirectIngestion(w.endpoint, pointsStr, len(points))
+	}
+	if len(histograms) > 0 {
+		result = w.emitMetricsForDirectIngestion(w.histogramURL(), histogramsStr, len(histograms)) && result
 	}
-	return w.emitMetricsForDirectIngestion(metrics, pStr, len(series))
+	return result
 }
 
+// histogramURL is the endpoint with the histogram format
+func (w *Wavefront) histogramURL() string {
+	apiURL, err := url.Parse(w.endpoint)
+	if err != nil {
+		return w.endpoint
+	}
+	query := apiURL.Query()
+	query.Set("f", "histogram")
+	apiURL.RawQuery = query.Encode()
+	return apiURL.String()
+}
 
-func (w Wavefront) emitMetricsToProxy(metrics []metric.Metric, pStr string, nDataPoints int) bool {
+// emitMetricsToProxy writes the payload on a persistent connection. The
+// proxy may have closed an idle connection since its last use, so a
+// failed write is retried once on a new connection before giving up.
+func (w *Wavefront) emitMetricsToProxy(metrics []metric.Metric, pStr string, nDataPoints int) bool {
 	w.log.Debug("Starting emission via Proxy")
-        addr := fmt.Sprintf("%s:%s", w.proxyServer, w.port)
-	conn, err := w.dialTimeout("tcp", addr)
+	if w.proxyPool == nil {
+		w.log.Error("There is no Wavefront proxy to send to, dropping ", nDataPoints, " datapoints")
+		return false
+	}
+
+	conn, err := w.proxyPool.Get()
 	if err != nil {
-		w.log.Error("Failed to connect ", addr)
+		w.log.Error("Failed to connect ", w.proxyPool.Addr(), ": ", err)
 		return false
 	}
-	conn.Write([]byte(pStr))
+
+	// the payload is only sent again when none of it was written, the
+	// proxy would otherwise count the delta counters received twice
+	if written, err := w.write(conn, pStr); err != nil {
+		conn.Close()
+		if written > 0 {
+			w.log.Error("Failed to write to ", w.proxyPool.Addr(), " after ", written, " bytes, dropping ", nDataPoints, " datapoints: ", err)
+			return false
+		}
+		w.log.Warn("Failed to write to ", w.proxyPool.Addr(), ", reconnecting: ", err)
+
+		if conn, err = w.proxyPool.Dial(); err != nil {
+			w.log.Error("Failed to connect ", w.proxyPool.Addr(), ": ", err)
+			return false
+		}
+		if _, err = w.write(conn, pStr); err != nil {
+			conn.Close()
+			w.log.Error("Failed to write to ", w.proxyPool.Addr(), ": ", err)
+			return false
+		}
+	}
+
+	w.proxyPool.Put(conn)
 	w.log.Info("Successfully sent ", nDataPoints, " datapoints to Wavefront")
-	conn.Close()
 	return true
 }
 
-func (w Wavefront) emitMetricsForDirectIngestion(metrics []metric.Metric, pStr string, nDataPoints int) bool {
-        w.log.Debug("Starting to emit metrics for Direct Ingestion")	
-        apiURL := fmt.Sprintf("%s", w.endpoint)
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBufferString(pStr))
-	if err != nil {
-		w.log.Error("Failed to create a request to endpoint ", w.endpoint)
+func (w *Wavefront) write(conn net.Conn, pStr string) (int, error) {
+	conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return conn.Write([]byte(pStr))
+}
+
+func (w *Wavefront) emitMetricsForDirectIngestion(apiURL string, pStr string, nDataPoints int) bool {
+	w.log.Debug("Starting to emit metrics for Direct Ingestion")
+	if w.httpClient == nil {
+		w.log.Error("The http client is not initialized, dropping ", nDataPoints, " datapoints")
 		return false
 	}
-	req.Header.Set("Accept", "application/json")
-	bearerAPIKey := fmt.Sprintf("Bearer %s", w.apiKey)
-	req.Header.Set("Authorization", bearerAPIKey)
 
-	transport := http.Transport{
-		Dial: w.dialTimeout,
+	headers := map[string]string{
+		"Accept":        "application/json",
+		"Authorization": fmt.Sprintf("Bearer %s", w.apiKey),
 	}
-	client := &http.Client{
-		Transport: &transport,
+	compressed, encoding := w.compress([]byte(pStr))
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
 	}
-	rsp, err := client.Do(req)
+
+	rsp, err := w.httpClient.MakeRequest("POST", apiURL, bytes.NewBuffer(compressed), headers)
 	if err != nil {
 		w.log.Error("Failed to complete POST ", err)
 		return false
 	}
 
-	defer rsp.Body.Close()
 	if (rsp.StatusCode == http.StatusOK) || (rsp.StatusCode == http.StatusAccepted) {
 		w.log.Info("Successfully sent ", nDataPoints, " datapoints to Wavefront")
 		return true
 	}
 
-	body, _ := ioutil.ReadAll(rsp.Body)
-	w.log.Error("Failed to post to Wavefront @", w.endpoint,
-		" status was ", rsp.Status,
-		" rsp body was ", string(body),
+	w.log.Error("Failed to post to Wavefront @", apiURL,
+		" status was ", rsp.StatusCode,
+		" rsp body was ", string(rsp.Body),
 		" payload was ", string(pStr))
 	return false
 }
 
-func (w Wavefront) dialTimeout(network, addr string) (net.Conn, error) {
-	return net.DialTimeout(network, addr, w.timeout)
-}
-
 func (w Wavefront) getSanitizedDimensions(dimensions map[string](string)) (sanitizedDmensions []string) {
-	for name, value := range dimensions {
+	for _, name := range sortedKeys(dimensions) {
+		value := dimensions[name]
 		if name == "host" || value == "none" {
 			continue
 		}
@@ -343,8 +468,7 @@ func (w Wavefront) getSanitizedDimensions(dimensions map[string](string)) (sanit
 		} else {
 			sanitizedName := w.wavefrontKeySanitize(name)
 			sanitizedValue := w.wavefrontValueSanitize(value)
-			pointTag := sanitizedName + "=\"" + sanitizedValue + "\""
-			sanitizedPointTag := w.wavefrontPointTagSanitize(pointTag)
+			sanitizedPointTag := w.wavefrontPointTagSanitize(sanitizedName, sanitizedValue)
 			sanitizedDmensions = append(sanitizedDmensions, sanitizedPointTag)
 		}
 	}
@@ -358,10 +482,33 @@ func (w Wavefront) wavefrontPayloadToString(p wavefrontPayload) string {
 		for _, tagPair := range series.PointTags {
 			pointTagsBuffer.WriteString(tagPair + " ")
 		}
-		payloadBuffer.WriteString(strings.Join([]string{series.Name, " ", strconv.FormatFloat(series.Value, 'f', 2, 64), " source=", series.Source, " ", pointTagsBuffer.String(), "\n"}, ""))
+		if len(series.Distribution) > 0 {
+			payloadBuffer.WriteString(w.histogramPrefix(series.Distribution))
+			payloadBuffer.WriteString(strings.Join([]string{series.Name, " source=", series.Source, " ", pointTagsBuffer.String(), "\n"}, ""))
+		} else {
+			payloadBuffer.WriteString(strings.Join([]string{series.Name, " ", strconv.FormatFloat(series.Value, 'f', 2, 64), " source=", series.Source, " ", pointTagsBuffer.String(), "\n"}, ""))
+		}
 		w.log.Debug("PAYLOAD ", i, ": ", series.Name, " ", series.Value, " source=", series.Source, " ", pointTagsBuffer.String())
 		pointTagsBuffer.Reset()
 	}
 	return payloadBuffer.String()
 }
 
+// histogramPrefix returns the start of a histogram line, its granularity,
+// timestamp and centroids: "!M 1493773500 #2 1.5 #1 3 "
+func (w Wavefront) histogramPrefix(samples []float64) string {
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+
+	var buffer bytes.Buffer
+	buffer.WriteString(w.histogramGranularity + " " + strconv.FormatInt(time.Now().Unix(), 10) + " ")
+	for i := 0; i < len(sorted); {
+		count := 1
+		for i+count < len(sorted) && sorted[i+count] == sorted[i] {
+			count++
+		}
+		buffer.WriteString("#" + strconv.Itoa(count) + " " + strconv.FormatFloat(sorted[i], 'f', -1, 64) + " ")
+		i += count
+	}
+	return buffer.String()
+}
@@ -1,69 +1,269 @@
 package handler
 
 import (
-        "fullerite/metric"
+	"fullerite/metric"
 
-        "testing"
-        "time"
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
 
-        l "github.com/Sirupsen/logrus"
-        "github.com/stretchr/testify/assert"
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
 )
 
 func getTestWavefrontHandler(interval, buffsize, timeoutsec int) *Wavefront {
-        testChannel := make(chan metric.Metric)
-        testLog := l.WithField("testing", "wavefront_handler")
-        timeout := time.Duration(timeoutsec) * time.Second
-        w :=  newWavefront(testChannel, interval, buffsize, timeout, testLog).(*Wavefront)
-        w.proxyFlag = false
-        return w
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "wavefront_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+	w := newWavefront(testChannel, interval, buffsize, timeout, testLog).(*Wavefront)
+	w.proxyFlag = false
+	return w
 }
 
 func TestWavefrontConfigureEmptyConfig(t *testing.T) {
-        config := make(map[string]interface{})
+	config := make(map[string]interface{})
 
-        w := getTestWavefrontHandler(12, 13, 14)
-        w.Configure(config)
+	w := getTestWavefrontHandler(12, 13, 14)
+	w.Configure(config)
 
-        assert.Equal(t, 12, w.Interval())
-        assert.Equal(t, 13, w.MaxBufferSize())
+	assert.Equal(t, 12, w.Interval())
+	assert.Equal(t, 13, w.MaxBufferSize())
 }
 
 func TestWavefrontConfigure(t *testing.T) {
-        config := map[string]interface{}{
-                "interval":        "10",
-                "timeout":         "10",
-                "max_buffer_size": "100",
-                "endpoint":        "wavefront.server",
-                "proxyFlag":       "true",
-                "port":            "2878",
-                "proxyServer":	   "wavefront.proxy",
-        }
-
-        w := getTestWavefrontHandler(40, 50, 60)
-        w.Configure(config)
-
-        assert.Equal(t, 10, w.Interval())
-        assert.Equal(t, 100, w.MaxBufferSize())
-        assert.Equal(t, true, w.proxyFlag)
-        assert.Equal(t, "wavefront.proxy", w.proxyServer)
-        assert.Equal(t, "2878", w.port)
+	config := map[string]interface{}{
+		"interval":        "10",
+		"timeout":         "10",
+		"max_buffer_size": "100",
+		"endpoint":        "wavefront.server",
+		"proxyFlag":       "true",
+		"port":            "2878",
+		"proxyServer":     "wavefront.proxy",
+	}
+
+	w := getTestWavefrontHandler(40, 50, 60)
+	w.Configure(config)
+
+	assert.Equal(t, 10, w.Interval())
+	assert.Equal(t, 100, w.MaxBufferSize())
+	assert.Equal(t, true, w.proxyFlag)
+	assert.Equal(t, "wavefront.proxy", w.proxyServer)
+	assert.Equal(t, "2878", w.port)
 }
 
 func TestWavefrontSanitation(t *testing.T) {
-        w := getTestWavefrontHandler(12, 12, 12)
+	w := getTestWavefrontHandler(12, 12, 12)
+
+	m1 := metric.New(" Test= .me$tric ")
+	var host = []byte{260: 'x'}
+	m1.AddDimension("host", string(host))
+	m1.AddDimension("With_quotes", "_Value_with-\"quotes++\"_")
+	datapoint1 := w.convertToWavefront(m1)
+
+	m2 := metric.New("Test-_.metric")
+	var tag = []byte{1030: 'x'}
+	m2.AddDimension("long_tag", string(tag))
+	datapoint2 := w.convertToWavefront(m2)
+
+	assert.Equal(t, datapoint1.Name, datapoint2.Name, "the metric name should be the same")
+	assert.Equal(t, len(datapoint1.PointTags), len(datapoint2.PointTags))
+}
+
+func TestWavefrontPointTags(t *testing.T) {
+	w := getTestWavefrontHandler(12, 12, 12)
+	w.Configure(map[string]interface{}{
+		"default_point_tags": map[string]interface{}{"env": "prod"},
+	})
+
+	m := metric.New("test")
+	m.AddDimension("quoted", "say \"hi\" twice")
+	m.AddDimension("backslash", "trailing\\")
+	m.AddDimension("host", "web1")
+	datapoint := w.convertToWavefront(m)
+
+	assert.Equal(t, []string{
+		`backslash="trailing"`,
+		`env="prod"`,
+		`quoted="say \"hi\" twice"`,
+	}, datapoint.PointTags)
+}
+
+func TestWavefrontPointTagTruncation(t *testing.T) {
+	w := getTestWavefrontHandler(12, 12, 12)
+
+	// the limit falls between the backslash and the quote it escapes
+	value := strings.Repeat("x", 248) + "\"quote"
+	pointTag := w.wavefrontPointTagSanitize("tag", w.wavefrontValueSanitize(value))
+	assert.Equal(t, pointTagLength-1, len(pointTag))
+	assert.True(t, strings.HasPrefix(pointTag, "tag=\""))
+	assert.True(t, strings.HasSuffix(pointTag, "x\""), pointTag)
+}
+
+func TestWavefrontDeltaCountersAndHistograms(t *testing.T) {
+	w := getTestWavefrontHandler(12, 12, 12)
+	w.SetDefaultDimensions(map[string]string{"host": "web1"})
+	w.Configure(map[string]interface{}{
+		"deltaCounters":        true,
+		"histogramGranularity": "hour",
+	})
+
+	counter := metric.WithValue("requests", 3)
+	counter.MetricType = metric.Counter
+	latency := metric.New("latency")
+	latency.Distribution = []float64{3, 1.5, 1.5}
+	gauge := metric.WithValue("load", 0.5)
+
+	payload := w.wavefrontPayloadToString(wavefrontPayload{Series: []wavefrontMetric{
+		w.convertToWavefront(counter),
+		w.convertToWavefront(latency),
+		w.convertToWavefront(gauge),
+	}})
+	lines := strings.Split(payload, "\n")
+
+	assert.Equal(t, "\"∆requests\" 3.00 source=web1 ", lines[0])
+	assert.Regexp(t, `^!H [0-9]+ #2 1.5 #1 3 "latency" source=web1 $`, lines[1])
+	assert.Equal(t, "\"load\" 0.50 source=web1 ", lines[2])
+}
+
+func TestWavefrontEmitHistogramsForDirectIngestion(t *testing.T) {
+	bodies := make(map[string]string)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies[r.URL.Query().Get("f")] = string(body)
+	}))
+	defer ts.Close()
+
+	w := getTestWavefrontHandler(12, 12, 1)
+	w.Configure(map[string]interface{}{
+		"proxyFlag": "false",
+		"apiKey":    "secret",
+		"endpoint":  ts.URL + "/report?f=wavefront",
+	})
+
+	latency := metric.New("latency")
+	latency.Distribution = []float64{1}
+	assert.True(t, w.emitMetrics([]metric.Metric{metric.New("load"), latency}))
+	assert.True(t, strings.HasPrefix(bodies["wavefront"], "\"load\""))
+	assert.True(t, strings.HasPrefix(bodies["histogram"], "!M "))
+}
+
+func TestWavefrontProxyConnectionIsReused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	var accepted int32
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func(conn net.Conn) {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}(conn)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	w := getTestWavefrontHandler(12, 12, 1)
+	w.Configure(map[string]interface{}{
+		"proxyFlag":   "true",
+		"proxyServer": host,
+		"port":        port,
+	})
+
+	for _, name := range []string{"first", "second"} {
+		assert.True(t, w.emitMetrics([]metric.Metric{metric.New(name)}))
+		select {
+		case line := <-lines:
+			assert.True(t, strings.HasPrefix(line, "\""+name+"\""), line)
+		case <-time.After(2 * time.Second):
+			t.Fatal("The proxy did not receive ", name)
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&accepted))
+}
+
+func TestWavefrontPointTagLongKey(t *testing.T) {
+	w := getTestWavefrontHandler(12, 12, 12)
+
+	for _, length := range []int{250, 253, 300} {
+		pointTag := w.wavefrontPointTagSanitize(strings.Repeat("k", length), "value")
+		assert.True(t, len(pointTag) <= pointTagLength, pointTag)
+		assert.Regexp(t, `^k+="v?a?"$`, pointTag)
+	}
+}
+
+func TestWavefrontPointTagTruncationKeepsRunes(t *testing.T) {
+	w := getTestWavefrontHandler(12, 12, 12)
+
+	pointTag := w.wavefrontPointTagSanitize("tag", strings.Repeat("é", 200))
+	assert.True(t, len(pointTag) <= pointTagLength)
+	assert.True(t, utf8.ValidString(pointTag))
+	assert.True(t, strings.HasSuffix(pointTag, "é\""))
+}
+
+// failingConn is a pooled connection whose writes fail after written bytes
+type failingConn struct {
+	net.Conn
+	written int
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	return c.written, errors.New("connection reset")
+}
+
+func (c *failingConn) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *failingConn) Close() error { return nil }
+
+func TestWavefrontProxyPartialWriteIsNotResent(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go ioutil.ReadAll(conn)
+		}
+	}()
 
-        m1 := metric.New(" Test= .me$tric ")
-        var host = []byte{260: 'x'}
-        m1.AddDimension("host",string(host))
-        m1.AddDimension("With_quotes", "_Value_with-\"quotes++\"_")
-        datapoint1 := w.convertToWavefront(m1)
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	w := getTestWavefrontHandler(12, 12, 1)
+	w.Configure(map[string]interface{}{
+		"proxyFlag":   "true",
+		"proxyServer": host,
+		"port":        port,
+	})
 
-        m2 := metric.New("Test-_.metric")
-        var tag = []byte{1030: 'x'}
-        m2.AddDimension("long_tag", string(tag))
-        datapoint2 := w.convertToWavefront(m2)
+	// a stale connection that wrote nothing is replaced
+	w.proxyPool.Put(&failingConn{})
+	assert.True(t, w.emitMetrics([]metric.Metric{metric.New("first")}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&accepted))
 
-        assert.Equal(t, datapoint1.Name, datapoint2.Name, "the metric name should be the same")
-        assert.Equal(t, len(datapoint1.PointTags), len(datapoint2.PointTags))
+	// part of the payload may have reached the proxy already
+	w.proxyPool.Close()
+	w.proxyPool.Put(&failingConn{written: 3})
+	assert.False(t, w.emitMetrics([]metric.Metric{metric.New("second")}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&accepted))
 }
@@ -14,6 +14,10 @@ type Metric struct {
 	MetricType string            `json:"type"`
 	Value      float64           `json:"value"`
 	Dimensions map[string]string `json:"dimensions"`
+
+	// Distribution holds the samples of a distribution, such as latencies,
+	// handlers that don't support distributions only send Value
+	Distribution []float64 `json:"distribution,omitempty"`
 }
 
 // New returns a new metric with name. Default metric type is "gauge"
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// ConnPool keeps up to size idle connections to a single address so that
+// they can be reused across emissions. Connections are dialed on demand
+// when none is idle, so the pool never blocks callers.
+type ConnPool struct {
+	network string
+	addr    string
+	timeout time.Duration
+	idle    chan net.Conn
+
+	tlsConfig *tls.Config
+}
+
+// NewConnPool returns a ConnPool dialing network/addr with the given timeout
+func NewConnPool(network, addr string, size int, timeout time.Duration) *ConnPool {
+	if size < 1 {
+		size = 1
+	}
+	return &ConnPool{
+		network: network,
+		addr:    addr,
+		timeout: timeout,
+		idle:    make(chan net.Conn, size),
+	}
+}
+
+// Addr returns the address connections are made to
+func (p *ConnPool) Addr() string {
+	return p.addr
+}
+
+// SetTLSConfig makes new connections use TLS, nil disables it
+func (p *ConnPool) SetTLSConfig(tlsConfig *tls.Config) {
+	p.tlsConfig = tlsConfig
+}
+
+// Get returns an idle connection or dials a new one
+func (p *ConnPool) Get() (net.Conn, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+		return p.Dial()
+	}
+}
+
+// Dial always opens a new connection, bypassing the idle ones
+func (p *ConnPool) Dial() (net.Conn, error) {
+	return DialTimeout(p.network, p.addr, p.timeout, p.tlsConfig)
+}
+
+// DialTimeout connects to addr, over TLS when tlsConfig is set
+func DialTimeout(network, addr string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig == nil {
+		return net.DialTimeout(network, addr, timeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, addr, tlsConfig)
+}
+
+// Put hands back a healthy connection, it is closed if the pool is full.
+// Connections which failed must be closed instead of being put back.
+func (p *ConnPool) Put(conn net.Conn) {
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Close closes all the idle connections
+func (p *ConnPool) Close() {
+	for {
+		select {
+		case conn := <-p.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
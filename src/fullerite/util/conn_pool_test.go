@@ -0,0 +1,91 @@
+package util
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnPoolReusesConnections(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	pool := NewConnPool("tcp", listener.Addr().String(), 1, time.Second)
+	defer pool.Close()
+	assert.Equal(t, listener.Addr().String(), pool.Addr())
+
+	first, err := pool.Get()
+	assert.Nil(t, err)
+	pool.Put(first)
+
+	second, err := pool.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, first, second, "the idle connection should be reused")
+
+	third, err := pool.Get()
+	assert.Nil(t, err)
+	assert.NotEqual(t, second, third, "a new connection should be dialed when none is idle")
+
+	pool.Put(second)
+	pool.Put(third)
+	_, err = third.Write([]byte("x"))
+	assert.NotNil(t, err, "connections above the pool size should be closed")
+}
+
+func TestConnPoolDialFailure(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	pool := NewConnPool("tcp", addr, 1, time.Second)
+	_, err := pool.Get()
+	assert.NotNil(t, err)
+}
+
+func TestConnPoolTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fullerite-tls")
+	defer os.RemoveAll(dir)
+	caFile, _, cert := writeTestCertificate(t, dir, "carbon")
+
+	listener, _ := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+		conn.Close()
+	}()
+
+	tlsConfig, err := TLSSettings{Enabled: true, CAFile: caFile, ServerName: "carbon"}.Config()
+	assert.Nil(t, err)
+
+	pool := NewConnPool("tcp", listener.Addr().String(), 1, time.Second)
+	pool.SetTLSConfig(tlsConfig)
+	conn, err := pool.Get()
+	assert.Nil(t, err)
+	conn.Write([]byte("metric 1 1\n"))
+	assert.Equal(t, "metric 1 1\n", <-received)
+	conn.Close()
+}
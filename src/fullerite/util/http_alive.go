@@ -1,10 +1,14 @@
 package util
 
 import (
+	"crypto/tls"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,6 +16,19 @@ import (
 type HTTPAlive struct {
 	client    *http.Client
 	transport *http.Transport
+
+	// connection reuse statistics
+	requests           uint64
+	connectionsReused  uint64
+	connectionsCreated uint64
+}
+
+// HTTPAliveStats counts the requests made by an HTTPAlive
+// and whether they reused an idle connection or opened one
+type HTTPAliveStats struct {
+	Requests           uint64
+	ConnectionsReused  uint64
+	ConnectionsCreated uint64
 }
 
 // HTTPAliveResponse returns a response
@@ -32,6 +49,7 @@ func (connection *HTTPAlive) Configure(timeout time.Duration,
 				KeepAlive: aliveDuration,
 			}).Dial,
 			MaxIdleConnsPerHost: maxIdleConnections,
+			Proxy:               http.ProxyFromEnvironment,
 		}
 	}
 
@@ -42,6 +60,17 @@ func (connection *HTTPAlive) Configure(timeout time.Duration,
 	}
 }
 
+// SetTLSConfig sets the TLS configuration of https connections
+func (connection *HTTPAlive) SetTLSConfig(tlsConfig *tls.Config) {
+	connection.transport.TLSClientConfig = tlsConfig
+}
+
+// SetProxy sets the function choosing the proxy of each request,
+// nil connects directly, by default the environment is used
+func (connection *HTTPAlive) SetProxy(proxy func(*http.Request) (*url.URL, error)) {
+	connection.transport.Proxy = proxy
+}
+
 // MakeRequest make a new http request
 func (connection *HTTPAlive) MakeRequest(method string,
 	uri string, body io.Reader, header map[string]string) (*HTTPAliveResponse, error) {
@@ -59,7 +88,28 @@ func (connection *HTTPAlive) MakeRequest(method string,
 	return connection.submitRequest(req)
 }
 
+// Stats returns the connection reuse statistics
+func (connection *HTTPAlive) Stats() HTTPAliveStats {
+	return HTTPAliveStats{
+		Requests:           atomic.LoadUint64(&connection.requests),
+		ConnectionsReused:  atomic.LoadUint64(&connection.connectionsReused),
+		ConnectionsCreated: atomic.LoadUint64(&connection.connectionsCreated),
+	}
+}
+
 func (connection *HTTPAlive) submitRequest(req *http.Request) (*HTTPAliveResponse, error) {
+	atomic.AddUint64(&connection.requests, 1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&connection.connectionsReused, 1)
+			} else {
+				atomic.AddUint64(&connection.connectionsCreated, 1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
 	rsp, err := connection.client.Do(req)
 
 	if rsp != nil {
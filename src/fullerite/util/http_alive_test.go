@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -34,3 +35,68 @@ func TestMakeRequest(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, string(resp.Body), "done\n")
 }
+
+func TestHTTPAliveStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "done")
+	}))
+	defer ts.Close()
+
+	httpClient := new(HTTPAlive)
+	httpClient.Configure(time.Second, time.Minute, 1)
+
+	for i := 0; i < 3; i++ {
+		_, err := httpClient.MakeRequest("POST", ts.URL, bytes.NewBufferString("fullerite"), nil)
+		assert.Nil(t, err)
+	}
+
+	stats := httpClient.Stats()
+	assert.Equal(t, uint64(3), stats.Requests)
+	assert.Equal(t, uint64(1), stats.ConnectionsCreated)
+	assert.Equal(t, uint64(2), stats.ConnectionsReused)
+}
+
+func benchmarkTLSServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+// BenchmarkHTTPAliveReuse posts over a single keep-alive client
+// the way handlers do, each request reuses the TLS connection
+func BenchmarkHTTPAliveReuse(b *testing.B) {
+	ts := benchmarkTLSServer()
+	defer ts.Close()
+
+	httpClient := new(HTTPAlive)
+	httpClient.Configure(time.Second, time.Minute, 2)
+	httpClient.transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := httpClient.MakeRequest("POST", ts.URL, bytes.NewBufferString("fullerite"), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkHTTPClientPerRequest builds a new transport for every
+// request, paying for a TCP and TLS handshake each time
+func BenchmarkHTTPClientPerRequest(b *testing.B) {
+	ts := benchmarkTLSServer()
+	defer ts.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		client := &http.Client{Transport: transport}
+		rsp, err := client.Post(ts.URL, "text/plain", bytes.NewBufferString("fullerite"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		rsp.Body.Close()
+		transport.CloseIdleConnections()
+	}
+}
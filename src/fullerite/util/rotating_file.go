@@ -0,0 +1,191 @@
+package util
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an io.WriteCloser appending to a file that is rotated
+// once it grows past maxBytes or has been open for longer than interval.
+// Rotated segments are renamed to path.1, path.2, ... (path.1 being the
+// most recent) and only the last maxFiles are kept. A zero maxBytes or
+// interval disables the corresponding rotation trigger.
+type RotatingFile struct {
+	path     string
+	maxBytes int64
+	interval time.Duration
+	maxFiles int
+	compress bool
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// NewRotatingFile returns a RotatingFile writing to path, the file
+// itself is only opened on the first write
+func NewRotatingFile(path string, maxBytes int64, interval time.Duration, maxFiles int, compress bool) *RotatingFile {
+	return &RotatingFile{
+		path:     path,
+		maxBytes: maxBytes,
+		interval: interval,
+		maxFiles: maxFiles,
+		compress: compress,
+	}
+}
+
+// Path returns the path of the file currently written to
+func (r *RotatingFile) Path() string {
+	return r.path
+}
+
+// Write appends p to the current file, rotating it beforehand if needed.
+// p is never split across two files.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file != nil && r.shouldRotate(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingFile) shouldRotate(incoming int64) bool {
+	if r.maxBytes > 0 && r.size > 0 && r.size+incoming > r.maxBytes {
+		return true
+	}
+	if r.interval > 0 && time.Since(r.openedAt) >= r.interval {
+		return true
+	}
+	return false
+}
+
+func (r *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// a file written before a restart keeps aging from its last write
+	r.file = file
+	r.size = info.Size()
+	r.openedAt = time.Now()
+	if r.size > 0 && info.ModTime().Before(r.openedAt) {
+		r.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+
+	if r.maxFiles < 1 {
+		return os.Remove(r.path)
+	}
+
+	// a segment left uncompressed by a failed gzip is compressed again
+	// first, it would be overwritten by the current file otherwise
+	rotated := fmt.Sprintf("%s.1", r.path)
+	if r.compress {
+		if _, err := os.Stat(rotated); err == nil {
+			if err := gzipFile(rotated); err != nil {
+				return fmt.Errorf("failed to compress the previous segment %s: %s", rotated, err)
+			}
+		}
+	}
+
+	os.Remove(r.segmentName(r.maxFiles))
+	for i := r.maxFiles - 1; i > 0; i-- {
+		if _, err := os.Stat(r.segmentName(i)); err == nil {
+			if err := os.Rename(r.segmentName(i), r.segmentName(i+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	if r.compress {
+		return gzipFile(rotated)
+	}
+	return nil
+}
+
+func (r *RotatingFile) segmentName(index int) string {
+	name := fmt.Sprintf("%s.%d", r.path, index)
+	if r.compress {
+		name += ".gz"
+	}
+	return name
+}
+
+// gzipFile replaces path by its gzipped version path.gz
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
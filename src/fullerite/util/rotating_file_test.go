@@ -0,0 +1,134 @@
+package util
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFileWrite(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rotating_file")
+	defer os.RemoveAll(dir)
+
+	r := NewRotatingFile(path.Join(dir, "sub", "metrics.log"), 0, 0, 3, false)
+	r.Write([]byte("abc\n"))
+	r.Write([]byte("def\n"))
+	assert.Nil(t, r.Close())
+
+	content, err := ioutil.ReadFile(r.Path())
+	assert.Nil(t, err)
+	assert.Equal(t, "abc\ndef\n", string(content))
+}
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rotating_file")
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "metrics.log")
+	r := NewRotatingFile(filePath, 8, 0, 2, false)
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		_, err := r.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	r.Close()
+
+	current, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "five\n", string(current))
+	first, _ := ioutil.ReadFile(filePath + ".1")
+	assert.Equal(t, "four\n", string(first))
+	second, _ := ioutil.ReadFile(filePath + ".2")
+	assert.Equal(t, "three\n", string(second))
+
+	_, err := os.Stat(filePath + ".3")
+	assert.True(t, os.IsNotExist(err), "only maxFiles segments should be kept")
+}
+
+func TestRotatingFileRotatesByTime(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rotating_file")
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "metrics.log")
+	r := NewRotatingFile(filePath, 0, time.Millisecond, 1, false)
+	r.Write([]byte("old\n"))
+	time.Sleep(5 * time.Millisecond)
+	r.Write([]byte("new\n"))
+	r.Close()
+
+	current, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "new\n", string(current))
+	rotated, _ := ioutil.ReadFile(filePath + ".1")
+	assert.Equal(t, "old\n", string(rotated))
+}
+
+func TestRotatingFileCompress(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rotating_file")
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "metrics.log")
+	r := NewRotatingFile(filePath, 4, 0, 2, true)
+	r.Write([]byte("abcd"))
+	r.Write([]byte("efgh"))
+	r.Close()
+
+	_, err := os.Stat(filePath + ".1")
+	assert.True(t, os.IsNotExist(err), "the uncompressed segment should be removed")
+
+	f, err := os.Open(filePath + ".1.gz")
+	assert.Nil(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	content, _ := ioutil.ReadAll(gz)
+	assert.Equal(t, "abcd", string(content))
+}
+
+func TestRotatingFileAgesFromLastWrite(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rotating_file")
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "metrics.log")
+	assert.Nil(t, ioutil.WriteFile(filePath, []byte("before restart\n"), 0644))
+	hourAgo := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(filePath, hourAgo, hourAgo))
+
+	r := NewRotatingFile(filePath, 0, time.Minute, 1, false)
+	r.Write([]byte("first\n"))
+	r.Write([]byte("second\n"))
+	r.Close()
+
+	current, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "second\n", string(current))
+	rotated, _ := ioutil.ReadFile(filePath + ".1")
+	assert.Equal(t, "before restart\nfirst\n", string(rotated))
+}
+
+func TestRotatingFileCompressesLeftoverSegment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "rotating_file")
+	defer os.RemoveAll(dir)
+
+	// as left by a gzip that failed
+	filePath := path.Join(dir, "metrics.log")
+	assert.Nil(t, ioutil.WriteFile(filePath+".1", []byte("left"), 0644))
+
+	r := NewRotatingFile(filePath, 4, 0, 3, true)
+	r.Write([]byte("abcd"))
+	r.Write([]byte("efgh"))
+	r.Close()
+
+	_, err := os.Stat(filePath + ".1")
+	assert.True(t, os.IsNotExist(err))
+	for segment, expected := range map[string]string{".1.gz": "abcd", ".2.gz": "left"} {
+		f, err := os.Open(filePath + segment)
+		assert.Nil(t, err)
+		gz, err := gzip.NewReader(f)
+		assert.Nil(t, err)
+		content, _ := ioutil.ReadAll(gz)
+		assert.Equal(t, expected, string(content), segment)
+		f.Close()
+	}
+}
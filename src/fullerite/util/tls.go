@@ -0,0 +1,123 @@
+package util
+
+import (
+	"fullerite/config"
+
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// TLSSettings describes how outbound connections are secured, as read
+// from a "tls" configuration block:
+//
+//	"tls": {
+//	    "enabled": true,
+//	    "caFile": "/etc/ssl/ca.pem",
+//	    "certFile": "/etc/ssl/client.pem",
+//	    "keyFile": "/etc/ssl/client.key",
+//	    "serverName": "metrics.example.com",
+//	    "insecureSkipVerify": false
+//	}
+//
+// Setting the block enables TLS unless "enabled" is false. HTTP clients
+// only use it for https URLs while plain TCP connections are wrapped.
+type TLSSettings struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// ParseTLSSettings reads a "tls" configuration block
+func ParseTLSSettings(value interface{}) TLSSettings {
+	settings := TLSSettings{Enabled: true}
+
+	// blocks given as JSON strings only hold string values
+	block, ok := value.(map[string]interface{})
+	if !ok {
+		block = make(map[string]interface{})
+		for k, v := range config.GetAsMap(value) {
+			block[k] = v
+		}
+	}
+
+	for key, v := range block {
+		switch key {
+		case "enabled":
+			settings.Enabled = config.GetAsBool(v, true)
+		case "caFile":
+			settings.CAFile = fmt.Sprint(v)
+		case "certFile":
+			settings.CertFile = fmt.Sprint(v)
+		case "keyFile":
+			settings.KeyFile = fmt.Sprint(v)
+		case "serverName":
+			settings.ServerName = fmt.Sprint(v)
+		case "insecureSkipVerify":
+			settings.InsecureSkipVerify = config.GetAsBool(v, false)
+		}
+	}
+	return settings
+}
+
+// Config builds the corresponding tls.Config, it is nil when TLS is disabled
+func (s TLSSettings) Config() (*tls.Config, error) {
+	if !s.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	if s.CAFile != "" {
+		ca, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", s.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if s.CertFile != "" || s.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// ParseProxy reads a "proxy" setting: the URL of the HTTP proxy to send
+// requests through, "none" to connect directly or empty to use the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func ParseProxy(value interface{}) (func(*http.Request) (*url.URL, error), error) {
+	proxy := fmt.Sprint(value)
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "none":
+		return nil, nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %s", proxy)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
@@ -0,0 +1,177 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate writes a self signed certificate and its key,
+// valid for 127.0.0.1, returning their paths and the certificate
+func writeTestCertificate(t *testing.T, dir, name string) (string, string, tls.Certificate) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, certPEM, 0600)
+	ioutil.WriteFile(keyFile, keyPEM, 0600)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+	return certFile, keyFile, cert
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	settings := ParseTLSSettings(map[string]interface{}{
+		"caFile":             "/etc/ca.pem",
+		"certFile":           "/etc/client.pem",
+		"keyFile":            "/etc/client.key",
+		"serverName":         "metrics",
+		"insecureSkipVerify": true,
+	})
+	assert.Equal(t, TLSSettings{
+		Enabled:            true,
+		CAFile:             "/etc/ca.pem",
+		CertFile:           "/etc/client.pem",
+		KeyFile:            "/etc/client.key",
+		ServerName:         "metrics",
+		InsecureSkipVerify: true,
+	}, settings)
+
+	settings = ParseTLSSettings(`{"enabled": "false", "serverName": "metrics"}`)
+	assert.False(t, settings.Enabled)
+	assert.Equal(t, "metrics", settings.ServerName)
+
+	tlsConfig, err := settings.Config()
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig, "disabled settings have no tls config")
+}
+
+func TestTLSSettingsConfigErrors(t *testing.T) {
+	_, err := TLSSettings{Enabled: true, CAFile: "/does/not/exist"}.Config()
+	assert.NotNil(t, err)
+
+	_, err = TLSSettings{Enabled: true, CertFile: "/does/not/exist"}.Config()
+	assert.NotNil(t, err)
+}
+
+func TestHTTPAliveMutualTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fullerite-tls")
+	defer os.RemoveAll(dir)
+
+	serverCertFile, _, serverCert := writeTestCertificate(t, dir, "server")
+	clientCertFile, clientKeyFile, _ := writeTestCertificate(t, dir, "client")
+
+	clientCAs := x509.NewCertPool()
+	clientPEM, _ := ioutil.ReadFile(clientCertFile)
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	settings := TLSSettings{
+		Enabled:    true,
+		CAFile:     serverCertFile,
+		CertFile:   clientCertFile,
+		KeyFile:    clientKeyFile,
+		ServerName: "server",
+	}
+	tlsConfig, err := settings.Config()
+	assert.Nil(t, err)
+
+	httpClient := new(HTTPAlive)
+	httpClient.Configure(time.Second, time.Minute, 1)
+	httpClient.SetTLSConfig(tlsConfig)
+
+	rsp, err := httpClient.MakeRequest("GET", ts.URL, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "client", string(rsp.Body))
+
+	// without a client certificate the handshake is refused
+	settings.CertFile, settings.KeyFile = "", ""
+	tlsConfig, _ = settings.Config()
+	anonymous := new(HTTPAlive)
+	anonymous.Configure(time.Second, time.Minute, 1)
+	anonymous.SetTLSConfig(tlsConfig)
+
+	_, err = anonymous.MakeRequest("GET", ts.URL, nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestParseProxy(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://metrics.example.com/", nil)
+
+	proxy, err := ParseProxy("http://proxy.example.com:3128")
+	assert.Nil(t, err)
+	proxyURL, _ := proxy(req)
+	assert.Equal(t, "proxy.example.com:3128", proxyURL.Host)
+
+	proxy, err = ParseProxy("none")
+	assert.Nil(t, err)
+	assert.Nil(t, proxy)
+
+	proxy, err = ParseProxy("")
+	assert.Nil(t, err)
+	assert.NotNil(t, proxy)
+
+	_, err = ParseProxy("proxy.example.com")
+	assert.NotNil(t, err)
+}
+
+func TestHTTPAliveProxy(t *testing.T) {
+	var proxiedHost string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHost = r.URL.Host
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+
+	proxyFunc, _ := ParseProxy(proxy.URL)
+	httpClient := new(HTTPAlive)
+	httpClient.Configure(time.Second, time.Minute, 1)
+	httpClient.SetProxy(proxyFunc)
+
+	rsp, err := httpClient.MakeRequest("POST", "http://metrics.invalid/api", nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	assert.Equal(t, "metrics.invalid", proxiedHost)
+}